@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jxskiss/ssl-cert-server/server"
+)
+
+/*
+Sub commands to manage certificates in the configured storage offline.
+*/
+
+type certSubCommand struct {
+	usage   string
+	flagSet *flag.FlagSet
+	run     func(ctx context.Context, key string)
+}
+
+var certSubCommands = map[string]*certSubCommand{}
+var certSubCommandNames = []string{"list", "show", "import", "export", "delete", "check"}
+
+var certOptions = struct {
+	config   string
+	certFile string
+	keyFile  string
+	chain    string
+	format   string
+	password string
+	out      string
+	keyType  string
+
+	layout    string
+	dir       string
+	account   bool
+	issuer    string
+	overwrite bool
+	dryRun    bool
+}{}
+
+func init() {
+	addCommand := func(name string, usage string, run func(ctx context.Context, key string)) *flag.FlagSet {
+		cmdFlags := flag.NewFlagSet(name, flag.ExitOnError)
+		cmdFlags.StringVar(&certOptions.config, "config", "./conf.yaml", "configuration filename")
+		certSubCommands[name] = &certSubCommand{usage: usage, flagSet: cmdFlags, run: run}
+		return cmdFlags
+	}
+	addCommand("list", "list [options]", cmdList)
+	addCommand("show", "show [options] <key>", cmdShow)
+	cmdFlags := addCommand("import", "import [options] <key>, or import -layout <layout> [options]", cmdImport)
+	cmdFlags.StringVar(&certOptions.certFile, "cert", "", "certificate file in PEM format, may contain the chain")
+	cmdFlags.StringVar(&certOptions.keyFile, "key", "", "private key file in PEM format")
+	cmdFlags.StringVar(&certOptions.chain, "chain", "", "intermediate certificates file in PEM format (optional)")
+	cmdFlags.StringVar(&certOptions.layout, "layout", "", "import all certificates from the storage of another ACME client: certbot, acme.sh or caddy")
+	cmdFlags.StringVar(&certOptions.dir, "dir", "", "storage directory of the layout (default /etc/letsencrypt, ~/.acme.sh or ~/.local/share/caddy)")
+	cmdFlags.BoolVar(&certOptions.account, "account", false, "also import the ACME account key of the layout")
+	cmdFlags.StringVar(&certOptions.issuer, "issuer", "", "issuer to import the account key for (default the primary issuer)")
+	cmdFlags.BoolVar(&certOptions.overwrite, "overwrite", false, "overwrite existing certificates and account key of the layout")
+	cmdFlags.BoolVar(&certOptions.dryRun, "dry-run", false, "report what would be imported from the layout without writing")
+	cmdFlags = addCommand("export", "export [options] <key>", cmdExport)
+	cmdFlags.StringVar(&certOptions.format, "format", server.FormatPEM, "output format: pem or pkcs12")
+	cmdFlags.StringVar(&certOptions.password, "password", "", "password of the PKCS#12 file")
+	cmdFlags.StringVar(&certOptions.out, "out", "", "output file (default stdout)")
+	addCommand("delete", "delete [options] <key>", cmdDelete)
+	cmdFlags = addCommand("check", "check [options] <domain>", cmdCheck)
+	cmdFlags.StringVar(&certOptions.keyType, "key-type", "", "key type: ecdsa or rsa (default lets_encrypt default key type)")
+}
+
+func runCertSubCommand(name string) {
+	cmd := certSubCommands[name]
+	// the key may be given before options
+	args := os.Args[2:]
+	key := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		key, args = args[0], args[1:]
+	}
+	cmd.flagSet.Parse(args)
+	if key == "" {
+		key = cmd.flagSet.Arg(0)
+	}
+	if key == "" && name != "list" && !(name == "import" && certOptions.layout != "") {
+		log.Fatalf("[FATAL] %s: missing argument, usage: %s %s", name, os.Args[0], cmd.usage)
+	}
+
+	server.Flags.ConfigFile = certOptions.config
+	server.InitConfig()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	cmd.run(ctx, key)
+}
+
+func cmdList(ctx context.Context, _ string) {
+	certs, err := server.ListCertificates(ctx)
+	if err != nil {
+		log.Fatalf("[FATAL] list: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tDOMAINS\tNOT AFTER\tDAYS LEFT\tISSUER")
+	for _, x := range certs {
+		leaf := x.Certificate.Leaf
+		issuer := x.Issuer
+		if issuer == "" {
+			issuer = leaf.Issuer.CommonName
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", x.Key, strings.Join(certNames(x.Certificate), ","),
+			leaf.NotAfter.Format(time.RFC3339), daysLeft(leaf.NotAfter), issuer)
+	}
+	w.Flush()
+}
+
+func cmdShow(ctx context.Context, key string) {
+	x, err := server.GetStoredCertificate(ctx, key)
+	if err != nil {
+		log.Fatalf("[FATAL] show: %v", err)
+	}
+	leaf := x.Certificate.Leaf
+	sha1sum := sha1.Sum(leaf.Raw)
+	sha256sum := sha256.Sum256(leaf.Raw)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Key:\t%s\n", x.Key)
+	fmt.Fprintf(w, "Subject:\t%s\n", leaf.Subject)
+	fmt.Fprintf(w, "Domains:\t%s\n", strings.Join(certNames(x.Certificate), ", "))
+	fmt.Fprintf(w, "Issuer:\t%s\n", leaf.Issuer)
+	if x.Issuer != "" {
+		fmt.Fprintf(w, "ACME issuer:\t%s, issued at %s\n", x.Issuer, time.Unix(x.IssuedAt, 0).Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Serial:\t%x\n", leaf.SerialNumber)
+	fmt.Fprintf(w, "Not before:\t%s\n", leaf.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(w, "Not after:\t%s (%d days left)\n", leaf.NotAfter.Format(time.RFC3339), daysLeft(leaf.NotAfter))
+	fmt.Fprintf(w, "Public key:\t%s\n", leaf.PublicKeyAlgorithm)
+	fmt.Fprintf(w, "SHA-1:\t%x\n", sha1sum)
+	fmt.Fprintf(w, "SHA-256:\t%x\n", sha256sum)
+	fmt.Fprintf(w, "Chain:\t%d certificates\n", len(x.Certificate.Certificate))
+	if len(leaf.OCSPServer) > 0 {
+		fmt.Fprintf(w, "OCSP:\t%s\n", strings.Join(leaf.OCSPServer, ", "))
+	}
+	w.Flush()
+}
+
+func cmdImport(ctx context.Context, key string) {
+	opts := certOptions
+	if opts.layout != "" {
+		if key != "" {
+			log.Fatalf("[FATAL] import: unexpected key %q with -layout", key)
+		}
+		cmdImportLayout(ctx)
+		return
+	}
+	if opts.certFile == "" || opts.keyFile == "" {
+		log.Fatalf("[FATAL] import: missing -cert or -key")
+	}
+	var data [3][]byte
+	for i, file := range []string{opts.certFile, opts.keyFile, opts.chain} {
+		if file == "" {
+			continue
+		}
+		var err error
+		if data[i], err = ioutil.ReadFile(file); err != nil {
+			log.Fatalf("[FATAL] import: %v", err)
+		}
+	}
+	cert, err := server.ImportCertificate(ctx, key, data[0], data[1], data[2])
+	if err != nil {
+		log.Fatalf("[FATAL] import: %v", err)
+	}
+	fmt.Printf("imported %s: %s, not after %s\n", key,
+		strings.Join(certNames(cert), ","), cert.Leaf.NotAfter.Format(time.RFC3339))
+}
+
+func cmdImportLayout(ctx context.Context) {
+	opts := certOptions
+	results, err := server.GetManager().ImportLayout(ctx, server.LayoutImportOptions{
+		Layout:    opts.layout,
+		Dir:       opts.dir,
+		Account:   opts.account,
+		Issuer:    opts.issuer,
+		Overwrite: opts.overwrite,
+		DryRun:    opts.dryRun,
+	})
+	imported := "imported"
+	if opts.dryRun {
+		imported = "would import"
+	}
+	var certs, accounts int
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tDOMAIN\tKEY\tNOT AFTER\tRESULT\tSOURCE")
+	for _, x := range results {
+		result, notAfter := imported, "-"
+		if x.Skipped != "" {
+			result = "skipped: " + x.Skipped
+		} else if x.Kind == "account" {
+			accounts++
+		} else {
+			certs++
+		}
+		if !x.NotAfter.IsZero() {
+			notAfter = x.NotAfter.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", x.Kind, x.Domain, x.Key, notAfter, result, x.Source)
+	}
+	w.Flush()
+	if err != nil {
+		log.Fatalf("[FATAL] import: %v", err)
+	}
+	fmt.Printf("%s %d certificates and %d account keys from %s\n", imported, certs, accounts, opts.layout)
+	if accounts > 0 && !opts.dryRun {
+		fmt.Println("restart running servers to load the new account key")
+	}
+}
+
+func cmdExport(ctx context.Context, key string) {
+	opts := certOptions
+	x, err := server.GetStoredCertificate(ctx, key)
+	if err != nil {
+		log.Fatalf("[FATAL] export: %v", err)
+	}
+	out, err := server.EncodeCertificate(x.Certificate, opts.format, opts.password)
+	if err != nil {
+		log.Fatalf("[FATAL] export: %v", err)
+	}
+	if opts.out == "" {
+		os.Stdout.Write(out)
+		return
+	}
+	if err = ioutil.WriteFile(opts.out, out, 0600); err != nil {
+		log.Fatalf("[FATAL] export: %v", err)
+	}
+}
+
+func cmdDelete(ctx context.Context, key string) {
+	if err := server.DeleteCertificate(ctx, key); err != nil {
+		log.Fatalf("[FATAL] delete: %v", err)
+	}
+	fmt.Printf("deleted %s\n", key)
+}
+
+func cmdCheck(ctx context.Context, domain string) {
+	exp := server.GetManager().ExplainCertificate(ctx, domain, certOptions.keyType)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", exp.Name)
+	fmt.Fprintf(w, "Key type:\t%s\n", exp.KeyType)
+	fmt.Fprintf(w, "Type:\t%s\n", exp.CertType)
+	if exp.Key != "" {
+		fmt.Fprintf(w, "Key:\t%s\n", exp.Key)
+	}
+	if exp.Stored != nil {
+		notAfter := exp.Stored.Certificate.Leaf.NotAfter
+		fmt.Fprintf(w, "Stored:\tyes, not after %s (%d days left)\n", notAfter.Format(time.RFC3339), daysLeft(notAfter))
+	} else if exp.Key != "" {
+		fmt.Fprintf(w, "Stored:\tno, created on first request\n")
+	}
+	for i, reason := range exp.Reasons {
+		title := ""
+		if i == 0 {
+			title = "Why:"
+		}
+		fmt.Fprintf(w, "%s\t- %s\n", title, reason)
+	}
+	w.Flush()
+}
+
+func certNames(cert *tls.Certificate) []string {
+	names := append([]string{}, cert.Leaf.DNSNames...)
+	for _, ip := range cert.Leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = append(names, cert.Leaf.Subject.CommonName)
+	}
+	return names
+}
+
+func daysLeft(notAfter time.Time) int {
+	return int(time.Until(notAfter).Hours() / 24)
+}
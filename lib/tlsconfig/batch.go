@@ -0,0 +1,155 @@
+package tlsconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	preloadBatchSize          = 100
+	defaultPreloadConcurrency = 4
+)
+
+type batchItem struct {
+	Domain string        `json:"domain"`
+	Error  string        `json:"error"`
+	Cert   *certResponse `json:"cert"`
+	ETag   string        `json:"etag"`
+
+	OCSP         []byte `json:"ocsp"`
+	OCSPExpireAt int64  `json:"ocsp_expire_at"` // seconds since epoch
+	OCSPTTL      int64  `json:"ocsp_ttl"`       // in seconds
+}
+
+// requestCertificates requests certificates and OCSP staplings of
+// the domains in a single request by the batch API of the cert server.
+func (c *Client) requestCertificates(ctx context.Context, domains []string, keyType string) ([]*batchItem, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"domains":  domains,
+		"key_type": keyType,
+	})
+	if err != nil {
+		return nil, err
+	}
+	apiPath := c.serverHost + "/certs"
+	req, err := http.NewRequestWithContext(ctx, "POST", apiPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := doRequest(req, "tlsconfig.requestCertificates", attribute.Int("domains", len(domains)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("bad http status %d", resp.StatusCode)
+	}
+	var response struct {
+		Certificates []*batchItem `json:"certificates"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	if len(response.Certificates) != len(domains) {
+		return nil, fmt.Errorf("bad batch response: want %d certificates, got %d", len(domains), len(response.Certificates))
+	}
+	return response.Certificates, nil
+}
+
+// preloadBatch preloads certificates of the domains by the batch API,
+// it falls back to request the certificates one by one if the batch
+// API is not available.
+func (c *Client) preloadBatch(domains []string, keyType string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	items, err := c.requestCertificates(ctx, domains, keyType)
+	if err != nil {
+		c.opts.ErrorLog("[WARN] tlsconfig: failed batch preload certificates, fall back to one by one: err= %v", err)
+		for _, domainName := range domains {
+			_, err := c.getCertificate(domainName, keyType)
+			if err != nil {
+				c.opts.ErrorLog("[WARN] tlsconfig: failed preload certificate: domain= %s err= %v", domainName, err)
+			}
+		}
+		return
+	}
+
+	now := time.Now().Unix()
+	for i, item := range items {
+		domainName := domains[i]
+		if item.Error != "" || item.Cert == nil {
+			c.opts.ErrorLog("[WARN] tlsconfig: failed preload certificate: domain= %s err= %s", domainName, item.Error)
+			continue
+		}
+		cacheCert, err := newCacheCertificate(domainName, keyType, item.Cert, item.ETag)
+		if err != nil {
+			c.opts.ErrorLog("[WARN] tlsconfig: failed preload certificate: domain= %s err= %v", domainName, err)
+			continue
+		}
+		cacheKey := certCacheKey(domainName, keyType)
+		if !c.opts.DisableStapling && hasStapling(cacheCert.certType, cacheCert.cert) &&
+			len(item.OCSP) > 0 && item.OCSPExpireAt-now > 60 {
+			cacheCert.cert.OCSPStaple = item.OCSP
+			cacheCert.staplingExpire = item.OCSPExpireAt
+			cacheCert.staplingRefresh = now + item.OCSPTTL
+		}
+		c.addCachedCert(cacheKey, cacheCert)
+
+		// ensure OCSP stapling loaded as soon as possible
+		if !c.opts.DisableStapling && hasStapling(cacheCert.certType, cacheCert.cert) &&
+			len(cacheCert.cert.OCSPStaple) == 0 {
+			go c.eagerPullOCSPStapling(cacheKey)
+		}
+	}
+}
+
+func (c *Client) preloadDomains(async bool, domains ...string) {
+	loadFunc := func() {
+		keyType := KeyTypeECDSA
+		var pending []string
+		for _, domainName := range domains {
+			if c.getCachedCert(certCacheKey(domainName, keyType)) == nil {
+				pending = append(pending, domainName)
+			}
+		}
+		concurrency := c.opts.PreloadConcurrency
+		if concurrency <= 0 {
+			concurrency = defaultPreloadConcurrency
+		}
+		sem := make(chan struct{}, concurrency)
+		var wg sync.WaitGroup
+		for len(pending) > 0 {
+			n := preloadBatchSize
+			if n > len(pending) {
+				n = len(pending)
+			}
+			batch := pending[:n]
+			pending = pending[n:]
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				c.preloadBatch(batch, keyType)
+			}()
+		}
+		wg.Wait()
+	}
+	if async {
+		go loadFunc()
+	} else {
+		loadFunc()
+	}
+}
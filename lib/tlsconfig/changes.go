@@ -0,0 +1,162 @@
+package tlsconfig
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Types of change events sent by the cert server.
+const (
+	changeCertificate = "cert"
+	changeOCSP        = "ocsp"
+)
+
+const (
+	// the server sends heartbeat every 30 seconds, the stream is
+	// considered broken if nothing is received for a longer time
+	changeStreamIdleTimeout = 90 * time.Second
+
+	changeStreamMinBackoff = time.Second
+	changeStreamMaxBackoff = 5 * time.Minute
+)
+
+type changeEvent struct {
+	ID      uint64   `json:"id"`
+	Type    string   `json:"type"`
+	Domains []string `json:"domains"`
+}
+
+// subscribeChanges subscribes the change stream of the cert server, and
+// refreshes the affected certificates immediately when they are changed.
+// Refreshing by TTL still works if the stream is not available.
+func (c *Client) subscribeChanges() {
+	backoff := changeStreamMinBackoff
+	connected := false
+	for {
+		start := time.Now()
+		err := c.readChanges(func() {
+			// events may be missed while disconnected
+			if connected {
+				go c.refreshChanged("", nil)
+			}
+			connected = true
+		})
+		if time.Since(start) > changeStreamIdleTimeout {
+			backoff = changeStreamMinBackoff
+		}
+		c.opts.ErrorLog("[WARN] tlsconfig: change stream disconnected: err= %v", err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > changeStreamMaxBackoff {
+			backoff = changeStreamMaxBackoff
+		}
+	}
+}
+
+func (c *Client) readChanges(onConnect func()) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idle := time.AfterFunc(changeStreamIdleTimeout, cancel)
+	defer idle.Stop()
+
+	apiPath := c.serverHost + "/events"
+	if len(c.opts.AllowDomains) > 0 {
+		apiPath += "?domain=" + url.QueryEscape(strings.Join(c.opts.AllowDomains, ","))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", apiPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("bad http status %d", resp.StatusCode)
+	}
+	onConnect()
+
+	var eventType, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		idle.Reset(changeStreamIdleTimeout)
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data != "" {
+				c.handleChange(eventType, data)
+			}
+			eventType, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(line[len("event:"):])
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(line[len("data:"):])
+		}
+	}
+	if err = scanner.Err(); err == nil {
+		err = errors.New("stream closed by server")
+	}
+	return err
+}
+
+func (c *Client) handleChange(eventType string, data string) {
+	var event changeEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		c.opts.ErrorLog("[WARN] tlsconfig: got invalid change event: data= %s err= %v", data, err)
+		return
+	}
+	if event.Type == "" {
+		event.Type = eventType
+	}
+	c.refreshChanged(event.Type, event.Domains)
+}
+
+// refreshChanged refreshes the cached certificates matched by domains
+// immediately, changeType tells whether the certificate or the OCSP
+// stapling is changed, if it is empty, both are refreshed.
+// All cached certificates are refreshed if domains is nil.
+func (c *Client) refreshChanged(changeType string, domains []string) {
+	for cacheKey, cacheCert := range c.getCacheMap() {
+		if domains != nil && !matchAnyDomain(domains, cacheCert.domain) {
+			continue
+		}
+		copyCert := *cacheCert
+		if changeType != changeOCSP {
+			copyCert.certRefresh = 0
+		}
+		if changeType != changeCertificate {
+			copyCert.staplingRefresh = 0
+		}
+		newCacheCert, updated, err := c.refreshDomainCertificate(&copyCert)
+		if updated {
+			c.addCachedCert(cacheKey, newCacheCert)
+		}
+		if err != nil {
+			c.opts.ErrorLog("[WARN] tlsconfig: failed refresh changed certificate: domain= %s err= %v", cacheCert.domain, err)
+		}
+	}
+}
+
+// matchAnyDomain tells whether name is matched by any of domains,
+// which may contain wildcard names.
+func matchAnyDomain(domains []string, name string) bool {
+	for _, x := range domains {
+		if x == name {
+			return true
+		}
+		if strings.HasPrefix(x, "*.") {
+			if i := strings.IndexByte(name, '.'); i > 0 && name[i:] == x[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -16,14 +16,18 @@ import (
 	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/net/idna"
 )
 
 type cacheCertificate struct {
+	domain      string
+	keyType     string
 	cert        *tls.Certificate
 	certType    int
 	fingerprint string
+	etag        string
 
 	certExpire  int64
 	certRefresh int64
@@ -56,6 +60,9 @@ func NewClient(sslCertServerHost string, opts Options) *Client {
 	}
 	client.cache.Store(make(map[string]*cacheCertificate))
 	go client.watch()
+	if !opts.DisableChangeStream {
+		go client.subscribeChanges()
+	}
 
 	// make host policy
 	client.hostPolicy = makeHostWhitelist(opts.AllowDomains...)
@@ -113,7 +120,14 @@ func (c *Client) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, e
 	if isALPN01 {
 		cert, err = c.getALPN01Certificate(name)
 	} else {
-		cert, err = c.getCertificate(name)
+		keyType := KeyTypeRSA
+		if supportsECDSA(hello) {
+			keyType = KeyTypeECDSA
+		}
+		cert, err = c.getCertificate(name, keyType)
+		if err == nil && isEd25519(cert) && !supportsEd25519(hello) {
+			err = errors.New("client does not support Ed25519 certificate")
+		}
 	}
 	if err != nil {
 		return nil, fmt.Errorf("tlsconfig: failed get certificate: %v", err)
@@ -121,8 +135,8 @@ func (c *Client) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, e
 	return cert, err
 }
 
-func (c *Client) getCertificate(domainName string) (*tls.Certificate, error) {
-	cacheKey := domainName
+func (c *Client) getCertificate(domainName string, keyType string) (*tls.Certificate, error) {
+	cacheKey := certCacheKey(domainName, keyType)
 	cacheCert := c.getCachedCert(cacheKey)
 	if cacheCert != nil {
 		now := time.Now().Unix()
@@ -131,9 +145,12 @@ func (c *Client) getCertificate(domainName string) (*tls.Certificate, error) {
 			newCert := *cacheCert.cert
 			newCert.OCSPStaple = nil
 			newCacheCert := &cacheCertificate{
+				domain:          cacheCert.domain,
+				keyType:         cacheCert.keyType,
 				cert:            &newCert,
 				certType:        cacheCert.certType,
 				fingerprint:     cacheCert.fingerprint,
+				etag:            cacheCert.etag,
 				certExpire:      cacheCert.certExpire,
 				certRefresh:     cacheCert.certRefresh,
 				staplingExpire:  0,
@@ -149,7 +166,7 @@ func (c *Client) getCertificate(domainName string) (*tls.Certificate, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
-	cacheCert, err := c.requestCertificate(ctx, domainName, false)
+	cacheCert, _, err := c.requestCertificate(ctx, domainName, keyType, false, "")
 	if err != nil {
 		return nil, err
 	}
@@ -159,7 +176,7 @@ func (c *Client) getCertificate(domainName string) (*tls.Certificate, error) {
 	// in case of OCSP stapling unavailable.
 	if !c.opts.DisableStapling &&
 		hasStapling(cacheCert.certType, cacheCert.cert) {
-		stapling, staplingExpire, staplingRefresh, err := c.requestStapling(ctx, domainName, cacheCert.fingerprint)
+		stapling, staplingExpire, staplingRefresh, err := c.requestStapling(ctx, domainName, keyType, cacheCert.fingerprint)
 		if err != nil {
 			c.opts.ErrorLog("[WARN] tlsconfig: failed request OCSP stapling: domain= %s err= %v", domainName, err)
 		} else {
@@ -169,7 +186,7 @@ func (c *Client) getCertificate(domainName string) (*tls.Certificate, error) {
 		}
 		// ensure OCSP stapling loaded as soon as possible
 		if len(cacheCert.cert.OCSPStaple) == 0 {
-			go c.eagerPullOCSPStapling(domainName)
+			go c.eagerPullOCSPStapling(cacheKey)
 		}
 	}
 
@@ -179,14 +196,14 @@ func (c *Client) getCertificate(domainName string) (*tls.Certificate, error) {
 
 func (c *Client) getALPN01Certificate(domainName string) (*tls.Certificate, error) {
 	ctx := context.Background()
-	respCert, err := c.requestCertificate(ctx, domainName, true)
+	respCert, _, err := c.requestCertificate(ctx, domainName, "", true, "")
 	if err != nil {
 		return nil, err
 	}
 	return respCert.cert, nil
 }
 
-func (c *Client) eagerPullOCSPStapling(domainName string) {
+func (c *Client) eagerPullOCSPStapling(cacheKey string) {
 	var sleep = 10 * time.Millisecond
 	for i := 0; true; i++ {
 		sleep *= 2
@@ -195,47 +212,60 @@ func (c *Client) eagerPullOCSPStapling(domainName string) {
 		}
 		time.Sleep(sleep)
 
-		cacheCert := c.getCachedCert(domainName)
+		cacheCert := c.getCachedCert(cacheKey)
 		if cacheCert == nil { // this shall not happen
 			continue
 		}
 		if len(cacheCert.cert.OCSPStaple) > 0 {
 			break
 		}
-		newCacheCert, _, _ := c.refreshDomainCertificate(domainName, cacheCert)
+		newCacheCert, _, _ := c.refreshDomainCertificate(cacheCert)
 		if len(newCacheCert.cert.OCSPStaple) > 0 {
-			c.addCachedCert(domainName, newCacheCert)
+			c.addCachedCert(cacheKey, newCacheCert)
 			break
 		}
 	}
 }
 
-func (c *Client) requestCertificate(ctx context.Context, domainName string, isALPN01 bool) (
-	cacheCert *cacheCertificate, err error,
+// requestCertificate requests certificate from the cert server.
+// If etag is not empty, the request is conditional, when the certificate
+// is not modified, the returned cacheCert carries only the refreshed
+// expiration and TTL, and notModified is true.
+func (c *Client) requestCertificate(ctx context.Context, domainName string, keyType string, isALPN01 bool, etag string) (
+	cacheCert *cacheCertificate, notModified bool, err error,
 ) {
-	var response struct {
-		Type        int    `json:"type"`
-		Cert        string `json:"cert"`
-		PKey        string `json:"pkey"`
-		Fingerprint string `json:"fingerprint"`
-		ExpireAt    int64  `json:"expire_at"` // seconds since epoch
-		TTL         int64  `json:"ttl"`       // in seconds
-	}
-
+	var response certResponse
 	apiPath := c.serverHost + "/cert/" + domainName
 	if isALPN01 {
 		apiPath += "?alpn=1"
+	} else if keyType != "" {
+		apiPath += "?key_type=" + keyType
 	}
 	req, err := http.NewRequestWithContext(ctx, "GET", apiPath, nil)
 	if err != nil {
 		return
 	}
-	resp, err := http.DefaultClient.Do(req)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := doRequest(req, "tlsconfig.requestCertificate", attribute.String("domain", domainName))
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified && etag != "" {
+		expireAt, _ := strconv.ParseInt(resp.Header.Get("X-Expire-At"), 10, 64)
+		ttl, _ := strconv.ParseInt(resp.Header.Get("X-TTL"), 10, 64)
+		cacheCert = &cacheCertificate{
+			domain:      domainName,
+			keyType:     keyType,
+			etag:        etag,
+			certExpire:  expireAt,
+			certRefresh: time.Now().Unix() + ttl,
+		}
+		return cacheCert, true, nil
+	}
 	if resp.StatusCode != 200 {
 		err = fmt.Errorf("bad http status %d", resp.StatusCode)
 		return
@@ -244,35 +274,52 @@ func (c *Client) requestCertificate(ctx context.Context, domainName string, isAL
 	if err != nil {
 		return
 	}
+	cacheCert, err = newCacheCertificate(domainName, keyType, &response, resp.Header.Get("ETag"))
+	return
+}
+
+type certResponse struct {
+	Type        int    `json:"type"`
+	Cert        string `json:"cert"`
+	PKey        string `json:"pkey"`
+	Fingerprint string `json:"fingerprint"`
+	ExpireAt    int64  `json:"expire_at"` // seconds since epoch
+	TTL         int64  `json:"ttl"`       // in seconds
+}
+
+func newCacheCertificate(domainName string, keyType string, response *certResponse, etag string) (*cacheCertificate, error) {
 	cert, err := tls.X509KeyPair([]byte(response.Cert), []byte(response.PKey))
 	if err != nil {
-		return
+		return nil, err
 	}
 	leaf, err := x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
-		return
+		return nil, err
 	}
 	cert.Leaf = leaf
 
-	cacheCert = &cacheCertificate{
+	cacheCert := &cacheCertificate{
+		domain:      domainName,
+		keyType:     keyType,
 		cert:        &cert,
 		certType:    response.Type,
 		fingerprint: response.Fingerprint,
+		etag:        etag,
 		certExpire:  response.ExpireAt,
 		certRefresh: time.Now().Unix() + response.TTL,
 	}
-	return
+	return cacheCert, nil
 }
 
-func (c *Client) requestStapling(ctx context.Context, domainName string, fingerprint string) (
+func (c *Client) requestStapling(ctx context.Context, domainName string, keyType string, fingerprint string) (
 	stapling []byte, expireAt, refreshAt int64, err error,
 ) {
-	apiPath := c.serverHost + "/ocsp/" + domainName + "?fp=" + fingerprint
+	apiPath := c.serverHost + "/ocsp/" + domainName + "?key_type=" + keyType + "&fp=" + fingerprint
 	req, err := http.NewRequestWithContext(ctx, "GET", apiPath, nil)
 	if err != nil {
 		return
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doRequest(req, "tlsconfig.requestStapling", attribute.String("domain", domainName))
 	if err != nil {
 		return
 	}
@@ -313,10 +360,10 @@ func (c *Client) watch() {
 }
 
 func (c *Client) refresh(cached map[string]*cacheCertificate) error {
-	for domainName, cacheCert := range cached {
-		newCacheCert, updated, err := c.refreshDomainCertificate(domainName, cacheCert)
+	for cacheKey, cacheCert := range cached {
+		newCacheCert, updated, err := c.refreshDomainCertificate(cacheCert)
 		if updated {
-			c.addCachedCert(domainName, newCacheCert)
+			c.addCachedCert(cacheKey, newCacheCert)
 		}
 		if err != nil {
 			return err
@@ -325,9 +372,10 @@ func (c *Client) refresh(cached map[string]*cacheCertificate) error {
 	return nil
 }
 
-func (c *Client) refreshDomainCertificate(domainName string, cacheCert *cacheCertificate) (
+func (c *Client) refreshDomainCertificate(cacheCert *cacheCertificate) (
 	newCacheCert *cacheCertificate, updated bool, err error,
 ) {
+	domainName, keyType := cacheCert.domain, cacheCert.keyType
 	now := time.Now().Unix()
 	if cacheCert.certRefresh > now && cacheCert.staplingRefresh > now {
 		return cacheCert, false, nil
@@ -342,9 +390,12 @@ func (c *Client) refreshDomainCertificate(domainName string, cacheCert *cacheCer
 	// we may change the OCSPStaple below
 	copyCert := *cacheCert.cert
 	newCacheCert = &cacheCertificate{
+		domain:          domainName,
+		keyType:         keyType,
 		cert:            &copyCert,
 		certType:        cacheCert.certType,
 		fingerprint:     cacheCert.fingerprint,
+		etag:            cacheCert.etag,
 		certRefresh:     cacheCert.certRefresh,
 		certExpire:      cacheCert.certExpire,
 		staplingRefresh: cacheCert.staplingRefresh,
@@ -352,7 +403,8 @@ func (c *Client) refreshDomainCertificate(domainName string, cacheCert *cacheCer
 	}
 
 	if newCacheCert.certRefresh <= now {
-		respCert, err := c.requestCertificate(ctx, domainName, false)
+		// the certificate is downloaded again only if it has been changed
+		respCert, notModified, err := c.requestCertificate(ctx, domainName, keyType, false, newCacheCert.etag)
 		if err != nil {
 			c.opts.ErrorLog("[WARN] tlsconfig: failed refresh certificate: domain= %s err= %v", domainName, err)
 			return newCacheCert, updated, err
@@ -360,11 +412,12 @@ func (c *Client) refreshDomainCertificate(domainName string, cacheCert *cacheCer
 		updated = true
 		newCacheCert.certExpire = respCert.certExpire
 		newCacheCert.certRefresh = respCert.certRefresh
+		newCacheCert.etag = respCert.etag
 
 		// certificate renewed or type changed
 		// save new cert and drop the old OCSP stapling information
-		if newCacheCert.certType != respCert.certType ||
-			newCacheCert.fingerprint != respCert.fingerprint {
+		if !notModified && (newCacheCert.certType != respCert.certType ||
+			newCacheCert.fingerprint != respCert.fingerprint) {
 			newCacheCert.cert = respCert.cert
 			newCacheCert.certType = respCert.certType
 			newCacheCert.fingerprint = respCert.fingerprint
@@ -376,7 +429,7 @@ func (c *Client) refreshDomainCertificate(domainName string, cacheCert *cacheCer
 	if !c.opts.DisableStapling &&
 		hasStapling(newCacheCert.certType, newCacheCert.cert) &&
 		newCacheCert.staplingRefresh <= now {
-		newStapling, expireAt, refreshAt, err := c.requestStapling(ctx, domainName, newCacheCert.fingerprint)
+		newStapling, expireAt, refreshAt, err := c.requestStapling(ctx, domainName, keyType, newCacheCert.fingerprint)
 		if err != nil {
 			c.opts.ErrorLog("[WARN] tlsconfig: failed refresh OCSP stapling: domain= %s err= %v", domainName, err)
 			// if the OCSP stapling is going to expire, abandon it
@@ -398,6 +451,92 @@ func (c *Client) refreshDomainCertificate(domainName string, cacheCert *cacheCer
 	return newCacheCert, updated, nil
 }
 
+// Key types of certificates.
+const (
+	KeyTypeECDSA = "ecdsa"
+	KeyTypeRSA   = "rsa"
+)
+
+func certCacheKey(domainName string, keyType string) string {
+	if keyType == KeyTypeRSA {
+		return domainName + "+rsa"
+	}
+	return domainName
+}
+
+// supportsECDSA tells whether the client supports ECDSA certificates.
+// It is taken from package golang.org/x/crypto/acme/autocert, with
+// TLS 1.3 support added.
+func supportsECDSA(hello *tls.ClientHelloInfo) bool {
+	// The "signature_algorithms" extension, if present, limits the key exchange
+	// algorithms allowed by the cipher suites. See RFC 5246, section 7.4.1.4.1.
+	if hello.SignatureSchemes != nil {
+		ecdsaOK := false
+	schemeLoop:
+		for _, scheme := range hello.SignatureSchemes {
+			const tlsECDSAWithSHA1 tls.SignatureScheme = 0x0203 // constant added in Go 1.10
+			switch scheme {
+			case tlsECDSAWithSHA1, tls.ECDSAWithP256AndSHA256,
+				tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512:
+				ecdsaOK = true
+				break schemeLoop
+			}
+		}
+		if !ecdsaOK {
+			return false
+		}
+	}
+	if hello.SupportedCurves != nil {
+		ecdsaOK := false
+		for _, curve := range hello.SupportedCurves {
+			if curve == tls.CurveP256 {
+				ecdsaOK = true
+				break
+			}
+		}
+		if !ecdsaOK {
+			return false
+		}
+	}
+	// TLS 1.3 cipher suites are not restricted to key type.
+	for _, version := range hello.SupportedVersions {
+		if version == tls.VersionTLS13 {
+			return true
+		}
+	}
+	for _, suite := range hello.CipherSuites {
+		switch suite {
+		case tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:
+			return true
+		}
+	}
+	return false
+}
+
+// isEd25519 tells whether the certificate has an Ed25519 key, which
+// can be configured for self-signed, internal CA or managed certificates.
+func isEd25519(cert *tls.Certificate) bool {
+	return cert.Leaf != nil && cert.Leaf.PublicKeyAlgorithm == x509.Ed25519
+}
+
+// supportsEd25519 tells whether the client supports Ed25519 certificates.
+// Ed25519 signatures are only available in TLS 1.2 and later, when the
+// client lists it in the "signature_algorithms" extension.
+func supportsEd25519(hello *tls.ClientHelloInfo) bool {
+	for _, scheme := range hello.SignatureSchemes {
+		if scheme == tls.Ed25519 {
+			return true
+		}
+	}
+	return false
+}
+
 func hasStapling(certType int, cert *tls.Certificate) bool {
 	return certType < 100 && len(cert.Leaf.OCSPServer) > 0
 }
@@ -24,12 +24,23 @@ type Options struct {
 	// As you may guess, this option will slow down the server startup
 	// time, you may enable the following PreloadAsync option to preload
 	// the certificates asynchronously in background.
-	PreloadDomains []string
-	PreloadAsync   bool
+	//
+	// The certificates are preloaded in batches by the batch API of the
+	// cert server, PreloadConcurrency limits the number of concurrent
+	// batch requests, by default it is 4.
+	PreloadDomains     []string
+	PreloadAsync       bool
+	PreloadConcurrency int
 
 	// DisableStapling optionally disables OCSP stapling.
 	DisableStapling bool
 
+	// DisableChangeStream optionally disables subscribing the change
+	// stream of the cert server, then certificates and OCSP staplings
+	// are refreshed only by TTL. The stream is subscribed for the
+	// AllowDomains, or all domains if AllowDomains is not specified.
+	DisableChangeStream bool
+
 	// ErrorLog specifies an optional function to log error messages.
 	// If nil, error messages will be logged using the default logger from
 	// "log" package.
@@ -53,19 +64,3 @@ func makeHostWhitelist(hosts ...string) func(string) error {
 		return nil
 	}
 }
-
-func (c *Client) preloadDomains(async bool, domains ...string) {
-	loadFunc := func() {
-		for _, domainName := range domains {
-			_, err := c.getCertificate(domainName)
-			if err != nil {
-				c.opts.ErrorLog("[WARN] tlsconfig: failed preload certificate: domain= %s err= %v", domainName, err)
-			}
-		}
-	}
-	if async {
-		go loadFunc()
-	} else {
-		loadFunc()
-	}
-}
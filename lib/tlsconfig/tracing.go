@@ -0,0 +1,40 @@
+package tlsconfig
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/jxskiss/ssl-cert-server/lib/tlsconfig"
+
+// doRequest sends req to the cert server in a client span, the trace
+// context is propagated to the server by the global propagator of
+// OpenTelemetry, spans are not recorded if the application does not
+// set up OpenTelemetry.
+func doRequest(req *http.Request, spanName string, attrs ...attribute.KeyValue) (*http.Response, error) {
+	ctx, span := otel.Tracer(tracerName).Start(req.Context(), spanName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.HTTPURLKey.String(req.URL.String()),
+		))
+	defer span.End()
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(resp.StatusCode))
+	return resp, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -39,6 +40,26 @@ func main() {
 		cmdGenerateSelfSignedCertificate()
 		return
 	}
+	if len(os.Args) >= 2 && os.Args[1] == accountSubCommand {
+		cmdAccount()
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == migrateSubCommand {
+		cmdMigrate()
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == backupSubCommand {
+		cmdBackup()
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == restoreSubCommand {
+		cmdRestore()
+		return
+	}
+	if len(os.Args) >= 2 && certSubCommands[os.Args[1]] != nil {
+		runCertSubCommand(os.Args[1])
+		return
+	}
 	server.InitFlags()
 	if server.Flags.ShowVersion {
 		fmt.Printf("ssl-cert-server v%s\n", VERSION)
@@ -47,9 +68,13 @@ func main() {
 	Cfg := server.Cfg
 
 	server.InitConfig()
+	serverLog := server.NewLogger("server")
+	server.StartEventWebhooks()
 	mux := http.NewServeMux()
 	manager := server.GetManager()
 	manager.BuildRoutes(mux)
+	server.StartMonitor()
+	server.StartCertSync(manager)
 
 	// Graceful restarts.
 	upg, err := tableflip.New(tableflip.Options{
@@ -57,7 +82,7 @@ func main() {
 		PIDFile:        Cfg.PIDFile,
 	})
 	if err != nil {
-		log.Fatalf("[FATAL] server: failed init upgrader: %v", err)
+		server.Fatal(serverLog, "failed init upgrader", "err", err)
 	}
 	defer upg.Stop()
 
@@ -68,7 +93,7 @@ func main() {
 		for range sig {
 			err := upg.Upgrade()
 			if err != nil {
-				log.Printf("[ERROR] server: filed do upgrade: err= %v", err)
+				serverLog.Error("failed do upgrade", "err", err)
 			}
 		}
 	}()
@@ -76,40 +101,43 @@ func main() {
 	// Listen must be called before Ready
 	ln, err := upg.Listen("tcp", Cfg.Listen)
 	if err != nil {
-		log.Fatalf("[FATAL] server: fialed listen: %v", err)
+		server.Fatal(serverLog, "failed listen", "err", err)
 	}
 	httpServer := http.Server{Handler: mux}
+	httpServer.RegisterOnShutdown(server.Changes.Close)
 	go func() {
-		log.Printf("[INFO] server: listening on http://%v", Cfg.Listen)
+		serverLog.Info("listening", "addr", "http://"+Cfg.Listen)
 		err := httpServer.Serve(ln)
 		if err != http.ErrServerClosed {
-			log.Fatalf("[FATAL] server: stopped unexpectedly: %v", err)
+			server.Fatal(serverLog, "stopped unexpectedly", "err", err)
 		}
 	}()
 
 	if err := upg.Ready(); err != nil {
-		log.Fatalf("[FATAL] server: upgrader not ready: %v", err)
+		server.Fatal(serverLog, "upgrader not ready", "err", err)
 	}
 
-	stop := make(chan os.Signal)
+	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	select {
 	case <-upg.Exit():
-		log.Printf("[INFO] server: received exit signal from upgrader")
+		serverLog.Info("received exit signal from upgrader")
 	case <-stop:
-		log.Printf("[INFO] server: received stop signal from system")
+		serverLog.Info("received stop signal from system")
 	}
 
 	// Graceful shutdown the old process.
 	// Make sure to set a deadline on exiting the process after upg.Exit()
 	// is closed. No new upgrades can be performed if the parent doesn't exit.
-	ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 	err = httpServer.Shutdown(ctx)
 	if err == nil {
-		log.Printf("[INFO] server: shutdown gracefully")
+		serverLog.Info("shutdown gracefully")
 	} else {
-		log.Printf("[WARN] server: failed graceful shutdown: %v", err)
+		serverLog.Warn("failed graceful shutdown", "err", err)
 	}
+	server.ShutdownTracing(ctx)
 }
 
 func PrintUsage() {
@@ -120,6 +148,34 @@ func PrintUsage() {
 	fmt.Fprintf(flag.CommandLine.Output(), "To generate self-signed certificate:\n%s %s\n",
 		os.Args[0], generateSelfSignedCertSubCommand)
 	generateSelfSignedCertFlagSet.PrintDefaults()
+
+	fmt.Fprintf(flag.CommandLine.Output(), "\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "To manage ACME account:\n%s %s [options] show|update-contact|key-rollover|deactivate\n",
+		os.Args[0], accountSubCommand)
+	accountFlagSet.PrintDefaults()
+
+	fmt.Fprintf(flag.CommandLine.Output(), "\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "To manage certificates in the configured storage:\n")
+	for _, name := range certSubCommandNames {
+		cmd := certSubCommands[name]
+		fmt.Fprintf(flag.CommandLine.Output(), "%s %s\n", os.Args[0], cmd.usage)
+		cmd.flagSet.PrintDefaults()
+	}
+
+	fmt.Fprintf(flag.CommandLine.Output(), "\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "To copy all entries of the storage to another one:\n%s %s [options]\n",
+		os.Args[0], migrateSubCommand)
+	migrateFlagSet.PrintDefaults()
+
+	fmt.Fprintf(flag.CommandLine.Output(), "\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "To backup the storage to an encrypted archive:\n%s %s [options]\n",
+		os.Args[0], backupSubCommand)
+	backupFlagSet.PrintDefaults()
+
+	fmt.Fprintf(flag.CommandLine.Output(), "\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "To restore the storage from an archive:\n%s %s [options]\n",
+		os.Args[0], restoreSubCommand)
+	restoreFlagSet.PrintDefaults()
 }
 
 /*
@@ -134,6 +190,7 @@ var generateSelfSignedCertOptions = struct {
 	out          string
 	certOut      string
 	keyOut       string
+	keyAlgorithm string
 	organization StringArray
 }{}
 
@@ -147,6 +204,8 @@ func init() {
 		"cert-out", "./self_signed.cert", "output certificate file")
 	cmdFlags.StringVar(&generateSelfSignedCertOptions.keyOut,
 		"key-out", "./self_signed.key", "output private key file")
+	cmdFlags.StringVar(&generateSelfSignedCertOptions.keyAlgorithm,
+		"key-algorithm", server.KeyAlgoP256, "private key algorithm: P-256, P-384, RSA-2048, RSA-3072, RSA-4096 or Ed25519")
 	cmdFlags.Var(&generateSelfSignedCertOptions.organization,
 		"organization", "certificate organization (may be given multiple times)")
 }
@@ -158,7 +217,11 @@ func cmdGenerateSelfSignedCertificate() {
 		opts.organization = server.DefaultSelfSignedOrganization
 	}
 
-	certPEM, privKeyPEM, err := server.CreateSelfSignedCertificate(opts.validDays, opts.organization)
+	keyAlgorithm, err := server.ParseKeyAlgorithm(opts.keyAlgorithm)
+	if err != nil {
+		log.Fatalf("[FATAL] self_signed: %v", err)
+	}
+	certPEM, privKeyPEM, err := server.CreateSelfSignedCertificate(opts.validDays, opts.organization, keyAlgorithm)
 	if err != nil {
 		log.Fatalf("[FATAL] %v", err)
 	}
@@ -174,3 +237,63 @@ func cmdGenerateSelfSignedCertificate() {
 		log.Fatalf("[FATAL] self_signed: failed write certificate files: %v", err)
 	}
 }
+
+/*
+Sub command to manage ACME account.
+*/
+
+const accountSubCommand = "account"
+
+var accountFlagSet = flag.NewFlagSet(accountSubCommand, flag.ExitOnError)
+var accountOptions = struct {
+	config  string
+	issuer  string
+	contact StringArray
+}{}
+
+func init() {
+	cmdFlags := accountFlagSet
+	cmdFlags.StringVar(&accountOptions.config,
+		"config", "./conf.yaml", "configuration filename")
+	cmdFlags.StringVar(&accountOptions.issuer,
+		"issuer", "", "issuer name (default the primary issuer)")
+	cmdFlags.Var(&accountOptions.contact,
+		"contact", "account contact for update-contact, e.g. mailto:abc@example.com (may be given multiple times)")
+}
+
+func cmdAccount() {
+	accountFlagSet.Parse(os.Args[2:])
+	opts := accountOptions
+	action := accountFlagSet.Arg(0)
+
+	server.Flags.ConfigFile = opts.config
+	server.InitConfig()
+	manager := server.GetManager()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	var err error
+	switch action {
+	case "show":
+	case "update-contact":
+		if len(opts.contact) == 0 {
+			log.Fatalf("[FATAL] account: missing -contact for update-contact")
+		}
+		_, err = manager.UpdateAccountContact(ctx, opts.issuer, opts.contact)
+	case "key-rollover":
+		err = manager.RolloverAccountKey(ctx, opts.issuer)
+	case "deactivate":
+		err = manager.DeactivateAccount(ctx, opts.issuer)
+	default:
+		log.Fatalf("[FATAL] account: unknown action %q, want one of show, update-contact, key-rollover, deactivate", action)
+	}
+	if err != nil {
+		log.Fatalf("[FATAL] account: failed %s: %v", action, err)
+	}
+	acct, err := manager.GetAccount(ctx, opts.issuer)
+	if err != nil {
+		log.Fatalf("[FATAL] account: failed get account: %v", err)
+	}
+	out, _ := json.MarshalIndent(acct, "", "  ")
+	fmt.Println(string(out))
+}
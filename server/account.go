@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/alyx/x/autocert"
+	"golang.org/x/crypto/acme"
+)
+
+// The ACME account of an issuer is registered implicitly when the first
+// certificate is ordered, the functions here manage the account after
+// that, i.e. show account detail, update contacts, rollover account key
+// and deactivate the account.
+//
+// When the account key changes, the issuer's autocert.Manager is replaced
+// by a new one after the new key is saved in storage, other server
+// instances sharing the same storage should be restarted to load the
+// new key.
+
+const pendingAccountKeySuffix = "+next"
+
+var ErrIssuerNotFound = errors.New("issuer not found")
+
+// AccountInfo describes an ACME account registered with an issuer.
+type AccountInfo struct {
+	Issuer       string   `json:"issuer"`
+	DirectoryURL string   `json:"directory_url"`
+	URI          string   `json:"uri"`
+	Status       string   `json:"status"`
+	Contact      []string `json:"contact"`
+	OrdersURL    string   `json:"orders_url,omitempty"`
+}
+
+// getIssuer returns the issuer of the given name, an empty name means the
+// primary issuer.
+func (m *Manager) getIssuer(name string) (*issuer, error) {
+	if name == "" {
+		return m.issuers[0], nil
+	}
+	for _, iss := range m.issuers {
+		if iss.Name == name {
+			return iss, nil
+		}
+	}
+	return nil, ErrIssuerNotFound
+}
+
+// getAccountIssuer returns the issuer like getIssuer, and recovers the
+// account key if a previous key rollover failed to save it.
+func (m *Manager) getAccountIssuer(ctx context.Context, name string) (*issuer, error) {
+	iss, err := m.getIssuer(name)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.recoverAccountKey(ctx, iss); err != nil {
+		return nil, fmt.Errorf("recover account key: %v", err)
+	}
+	return iss, nil
+}
+
+// GetAccount returns the ACME account registered with the issuer.
+func (m *Manager) GetAccount(ctx context.Context, issuerName string) (*AccountInfo, error) {
+	iss, err := m.getAccountIssuer(ctx, issuerName)
+	if err != nil {
+		return nil, err
+	}
+	client, err := iss.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	acct, err := client.GetReg(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return iss.accountInfo(acct), nil
+}
+
+// UpdateAccountContact replaces the contacts of the ACME account, an email
+// address without scheme is treated as "mailto:" contact.
+func (m *Manager) UpdateAccountContact(ctx context.Context, issuerName string, contact []string) (*AccountInfo, error) {
+	iss, err := m.getAccountIssuer(ctx, issuerName)
+	if err != nil {
+		return nil, err
+	}
+	client, err := iss.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	acct, err := client.GetReg(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	uri := acct.URI
+	acct.Contact = normalizeContact(contact)
+	acct, err = client.UpdateReg(ctx, acct)
+	if err != nil {
+		return nil, err
+	}
+	if acct.URI == "" {
+		acct.URI = uri
+	}
+	accountLog.Info("updated account contact", "issuer", iss.Name, "contact", acct.Contact)
+	return iss.accountInfo(acct), nil
+}
+
+// RolloverAccountKey replaces the ACME account key with a newly generated
+// one, as described in RFC 8555 section 7.3.5.
+//
+// The new key is saved in storage under a pending name before the rollover,
+// thus it won't be lost if the rollover succeeds but the storage fails,
+// in which case it is recovered by the next account operation.
+func (m *Manager) RolloverAccountKey(ctx context.Context, issuerName string) error {
+	iss, err := m.getAccountIssuer(ctx, issuerName)
+	if err != nil {
+		return err
+	}
+	oldKey, err := iss.accountKey(ctx)
+	if err != nil {
+		return err
+	}
+	newKey, err := GeneratePrivateKey(KeyAlgoP256)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = EncodePrivateKey(&buf, newKey); err != nil {
+		return err
+	}
+	pendingKeyName := iss.cache.accountKeyName + pendingAccountKeySuffix
+	if err = Cfg.Storage.Cache.Put(ctx, pendingKeyName, buf.Bytes()); err != nil {
+		return fmt.Errorf("save pending account key: %v", err)
+	}
+	// Rollover with a dedicated client, the running clients keep using
+	// the old key until the new one is saved.
+	if err = iss.newACMEClient(oldKey).AccountKeyRollover(ctx, newKey); err != nil {
+		Cfg.Storage.Cache.Delete(ctx, pendingKeyName)
+		return err
+	}
+	if err = iss.cache.Put(ctx, acmeAccountKeyName, buf.Bytes()); err != nil {
+		accountLog.Error("failed save new account key, it is kept as pending key", "issuer", iss.Name, "pending_key", pendingKeyName, "err", err)
+		return fmt.Errorf("save account key: %v", err)
+	}
+	Cfg.Storage.Cache.Delete(ctx, pendingKeyName)
+	iss.setAccountKey(m)
+	accountLog.Info("rolled over account key", "issuer", iss.Name)
+	return nil
+}
+
+// recoverAccountKey completes a previous key rollover which succeeded but
+// failed to save the new key. The pending key is saved as the account key
+// if the ACME account is found by it, else it is dropped.
+func (m *Manager) recoverAccountKey(ctx context.Context, iss *issuer) error {
+	pendingKeyName := iss.cache.accountKeyName + pendingAccountKeySuffix
+	data, err := Cfg.Storage.Cache.Get(ctx, pendingKeyName)
+	if err == autocert.ErrCacheMiss {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	key, err := parsePrivateKeyPEM(data)
+	if err != nil {
+		return fmt.Errorf("invalid pending account key: %v", err)
+	}
+	_, err = iss.newACMEClient(key).GetReg(ctx, "")
+	if err == acme.ErrNoAccount {
+		Cfg.Storage.Cache.Delete(ctx, pendingKeyName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = iss.cache.Put(ctx, acmeAccountKeyName, data); err != nil {
+		return fmt.Errorf("save account key: %v", err)
+	}
+	Cfg.Storage.Cache.Delete(ctx, pendingKeyName)
+	iss.setAccountKey(m)
+	accountLog.Info("recovered account key from pending key", "issuer", iss.Name)
+	return nil
+}
+
+// DeactivateAccount deactivates the ACME account, then registers a new
+// account with a new key, since the issuer can't work without an account.
+func (m *Manager) DeactivateAccount(ctx context.Context, issuerName string) error {
+	iss, err := m.getAccountIssuer(ctx, issuerName)
+	if err != nil {
+		return err
+	}
+	client, err := iss.acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+	if err = client.DeactivateReg(ctx); err != nil {
+		return err
+	}
+	accountLog.Info("deactivated account", "issuer", iss.Name)
+	if err = iss.cache.Delete(ctx, acmeAccountKeyName); err != nil && err != autocert.ErrCacheMiss {
+		return fmt.Errorf("delete account key: %v", err)
+	}
+	if iss.cache.accountKeyName == acmeAccountKeyName {
+		// the legacy key left by a failed migration must not be reloaded
+		if err = iss.cache.Cache.Delete(ctx, legacyAccountKeyName); err != nil && err != autocert.ErrCacheMiss {
+			return fmt.Errorf("delete legacy account key: %v", err)
+		}
+	}
+	// a new key is generated and saved when the new client is created
+	iss.setAccountKey(m)
+	if _, err = iss.acmeClient(ctx); err != nil {
+		return fmt.Errorf("register new account: %v", err)
+	}
+	accountLog.Info("registered new account", "issuer", iss.Name)
+	return nil
+}
+
+// setAccountKey makes the issuer use the account key in storage. The ACME
+// client is created again, and since autocert initializes its client only
+// once, the autocert.Manager is replaced by a new one.
+func (iss *issuer) setAccountKey(m *Manager) {
+	iss.clientMu.Lock()
+	iss.client = nil
+	iss.clientMu.Unlock()
+	iss.retireAutocertManager(m)
+}
+
+func (iss *issuer) accountInfo(acct *acme.Account) *AccountInfo {
+	return &AccountInfo{
+		Issuer:       iss.Name,
+		DirectoryURL: iss.DirectoryURL,
+		URI:          acct.URI,
+		Status:       acct.Status,
+		Contact:      acct.Contact,
+		OrdersURL:    acct.OrdersURL,
+	}
+}
+
+func normalizeContact(contact []string) []string {
+	out := make([]string, 0, len(contact))
+	for _, x := range contact {
+		x = strings.TrimSpace(x)
+		if x == "" {
+			continue
+		}
+		if !strings.Contains(x, ":") {
+			x = "mailto:" + x
+		}
+		out = append(out, x)
+	}
+	return out
+}
@@ -0,0 +1,367 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyx/x/autocert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/acme"
+)
+
+// Most certificates are ordered and renewed by autocert.Manager, which
+// only supports single domain certificates with P-256 or RSA-2048 keys.
+// The order flow here is used where autocert can not help, the result is
+// stored in the same format autocert uses, thus autocert loads and renews
+// it later for single domain certificates, keeping the private key type.
+
+var (
+	orderLocks  sync.Map // key name -> *sync.Mutex
+	orderedKeys sync.Map // key name -> bool, certificates available in storage
+)
+
+func lockOrder(keyName string) func() {
+	mu, _ := orderLocks.LoadOrStore(keyName, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// acmeClient returns an ACME client registered with the issuer's account.
+// It uses the same account key in storage as the issuer's autocert.Manager.
+func (iss *issuer) acmeClient(ctx context.Context) (*acme.Client, error) {
+	iss.clientMu.Lock()
+	defer iss.clientMu.Unlock()
+	if iss.client != nil {
+		return iss.client, nil
+	}
+
+	key, err := iss.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := iss.newACMEClient(key)
+	var contact []string
+	if iss.conf.Email != "" {
+		contact = []string{"mailto:" + iss.conf.Email}
+	}
+	a := &acme.Account{Contact: contact}
+	if eab := iss.autocertManager().ExternalAccountBinding; eab != nil {
+		a.ExternalAccountBinding = eab
+	}
+	_, err = client.Register(ctx, a, autocert.AcceptTOS)
+	if err != nil && !isAccountAlreadyExist(err) {
+		return nil, err
+	}
+	iss.client = client
+	return client, nil
+}
+
+// newACMEClient returns an ACME client of the issuer using the given
+// account key, the account is not registered.
+func (iss *issuer) newACMEClient(key crypto.Signer) *acme.Client {
+	return &acme.Client{
+		Key:          key,
+		DirectoryURL: iss.DirectoryURL,
+		UserAgent:    "ssl-cert-server",
+		HTTPClient:   newACMEHTTPClient(iss.Name, iss.DirectoryURL),
+	}
+}
+
+// accountKey loads the issuer's account key from storage, or generates
+// and saves a new one if not exists, the same way autocert loads it.
+func (iss *issuer) accountKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := iss.cache.Get(ctx, acmeAccountKeyName)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKeyPEM(data)
+}
+
+func isAccountAlreadyExist(err error) bool {
+	if err == acme.ErrAccountAlreadyExists {
+		return true
+	}
+	ae, ok := err.(*acme.Error)
+	return ok && ae.StatusCode == http.StatusConflict
+}
+
+// orderCertificate orders a certificate for names from the issuer, using
+// the private key, and saves the certificate into storage under keyName.
+func (iss *issuer) orderCertificate(ctx context.Context, keyName string, names []string, key crypto.Signer) (_ *tls.Certificate, err error) {
+	ctx, span := tracer.Start(ctx, "acme.OrderCertificate", trace.WithAttributes(
+		attribute.String("key_name", keyName),
+		attribute.String("issuer", iss.Name),
+		attribute.StringSlice("domains", names),
+	))
+	defer func() { endSpan(span, err) }()
+
+	client, err := iss.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := client.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if dir.OrderURL == "" {
+		return nil, errors.New("acme: issuer is not RFC 8555 compliant")
+	}
+	authzCtx, authzSpan := tracer.Start(ctx, "acme.AuthorizeOrder")
+	order, err := iss.authorizeOrder(authzCtx, client, names)
+	endSpan(authzSpan, err)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := certRequest(key, names)
+	if err != nil {
+		return nil, err
+	}
+	finalizeCtx, finalizeSpan := tracer.Start(ctx, "acme.FinalizeOrder")
+	der, _, err := client.CreateOrderCert(finalizeCtx, order.FinalizeURL, csr, true)
+	endSpan(finalizeSpan, err)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err = EncodePrivateKey(&buf, key); err != nil {
+		return nil, err
+	}
+	for _, b := range der {
+		pb := &pem.Block{Type: "CERTIFICATE", Bytes: b}
+		if err = pem.Encode(&buf, pb); err != nil {
+			return nil, err
+		}
+	}
+	tlscert, err := parseCertificate(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("acme: invalid certificate: %v", err)
+	}
+	for _, name := range names {
+		if err = tlscert.Leaf.VerifyHostname(name); err != nil {
+			return nil, fmt.Errorf("acme: invalid certificate: %v", err)
+		}
+	}
+	if err = iss.cache.Put(ctx, keyName, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return tlscert, nil
+}
+
+// authorizeOrder creates an order for names and satisfies all the
+// authorizations, it's similar with autocert.Manager.verifyRFC.
+func (iss *issuer) authorizeOrder(ctx context.Context, client *acme.Client, names []string) (*acme.Order, error) {
+	// The nextTyp index of the next challenge type to try is shared across
+	// all order authorizations: if we've tried a challenge type once and it
+	// didn't work, it will most likely not work on another order's
+	// authorization either.
+	challengeTypes := []string{"tls-alpn-01", "http-01"}
+	nextTyp := 0
+AuthorizeOrderLoop:
+	for {
+		order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+		if err != nil {
+			return nil, err
+		}
+		switch order.Status {
+		case acme.StatusReady:
+			return order, nil
+		case acme.StatusPending:
+		default:
+			return nil, fmt.Errorf("acme: invalid new order status %q; order URL: %q", order.Status, order.URI)
+		}
+
+		for _, zurl := range order.AuthzURLs {
+			z, err := client.GetAuthorization(ctx, zurl)
+			if err != nil {
+				return nil, err
+			}
+			if z.Status == acme.StatusInvalid {
+				return nil, &authorizationError{domain: z.Identifier.Value,
+					err: fmt.Errorf("acme: invalid authorization %q for domain %q", z.URI, z.Identifier.Value)}
+			}
+			if z.Status != acme.StatusPending {
+				continue
+			}
+			var chal *acme.Challenge
+			for chal == nil && nextTyp < len(challengeTypes) {
+				chal = pickChallenge(challengeTypes[nextTyp], z.Challenges)
+				if chal == nil {
+					nextTyp++
+				}
+			}
+			if chal == nil {
+				return nil, &authorizationError{domain: z.Identifier.Value,
+					err: fmt.Errorf("acme: unable to satisfy %q for domain %q: no viable challenge type found", z.URI, z.Identifier.Value)}
+			}
+			cleanup, err := fulfillChallenge(ctx, client, chal, z.Identifier.Value)
+			if err != nil {
+				issuerLog.Warn("failed fulfill challenge", "domain", z.Identifier.Value, "type", chal.Type, "err", err)
+				nextTyp++
+				continue AuthorizeOrderLoop
+			}
+			defer cleanup()
+			if _, err = client.Accept(ctx, chal); err != nil {
+				issuerLog.Warn("failed accept challenge", "domain", z.Identifier.Value, "type", chal.Type, "err", err)
+				nextTyp++
+				continue AuthorizeOrderLoop
+			}
+			if _, err = client.WaitAuthorization(ctx, z.URI); err != nil {
+				issuerLog.Warn("failed authorization", "domain", z.Identifier.Value, "type", chal.Type, "err", err)
+				nextTyp++
+				continue AuthorizeOrderLoop
+			}
+		}
+
+		order, err = client.WaitOrder(ctx, order.URI)
+		if err != nil {
+			continue AuthorizeOrderLoop
+		}
+		return order, nil
+	}
+}
+
+// authorizationError tells that the authorization of a domain failed.
+type authorizationError struct {
+	domain string
+	err    error
+}
+
+func (e *authorizationError) Error() string { return e.err.Error() }
+
+func (e *authorizationError) Unwrap() error { return e.err }
+
+// failedDomains returns the domain names which fail an order, either
+// the authorization failed or the CA rejected them, as told by err.
+func failedDomains(err error) []string {
+	var authzErr *authorizationError
+	if errors.As(err, &authzErr) {
+		return []string{authzErr.domain}
+	}
+	var acmeErr *acme.Error
+	if errors.As(err, &acmeErr) {
+		var domains []string
+		for _, sp := range acmeErr.Subproblems {
+			if sp.Identifier != nil {
+				domains = append(domains, sp.Identifier.Value)
+			}
+		}
+		return domains
+	}
+	return nil
+}
+
+func pickChallenge(typ string, chal []*acme.Challenge) *acme.Challenge {
+	for _, c := range chal {
+		if c.Type == typ {
+			return c
+		}
+	}
+	return nil
+}
+
+// fulfillChallenge provisions a response to the challenge in storage,
+// where autocert finds and serves it.
+func fulfillChallenge(ctx context.Context, client *acme.Client, chal *acme.Challenge, domain string) (cleanup func(), err error) {
+	var tokenKey string
+	var tokenData []byte
+	switch chal.Type {
+	case "tls-alpn-01":
+		cert, err := client.TLSALPN01ChallengeCert(chal.Token, domain)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err = EncodePrivateKey(&buf, cert.PrivateKey); err != nil {
+			return nil, err
+		}
+		for _, b := range cert.Certificate {
+			pb := &pem.Block{Type: "CERTIFICATE", Bytes: b}
+			if err = pem.Encode(&buf, pb); err != nil {
+				return nil, err
+			}
+		}
+		tokenKey = domain + "+token"
+		tokenData = buf.Bytes()
+	case "http-01":
+		resp, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		tokenKey = path.Base(client.HTTP01ChallengePath(chal.Token)) + "+http-01"
+		tokenData = []byte(resp)
+	default:
+		return nil, fmt.Errorf("acme: unknown challenge type %q", chal.Type)
+	}
+	if err = Cfg.Storage.Cache.Put(ctx, tokenKey, tokenData); err != nil {
+		return nil, err
+	}
+	cleanup = func() {
+		go Cfg.Storage.Cache.Delete(context.Background(), tokenKey)
+	}
+	return cleanup, nil
+}
+
+// certRequest generates a CSR for the given names, the first name is
+// used as common name.
+func certRequest(key crypto.Signer, names []string) ([]byte, error) {
+	req := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+	}
+	return x509.CreateCertificateRequest(rand.Reader, req, key)
+}
+
+// orderWithKeyAlgorithm orders a single domain certificate with the
+// issuer's configured key algorithm, if the algorithm is not one autocert
+// would generate and the certificate is not available in storage.
+// Once saved, autocert loads the certificate and keeps it renewed.
+func (m *Manager) orderWithKeyAlgorithm(ctx context.Context, iss *issuer, name string, keyType string) error {
+	algo := iss.keyAlgorithm(keyType)
+	if isAutocertKeyAlgorithm(keyType, algo) {
+		return nil
+	}
+	keyName := m.KeyName(name, keyType)
+	if _, ok := orderedKeys.Load(keyName); ok {
+		return nil
+	}
+	unlock := lockOrder(keyName)
+	defer unlock()
+
+	_, err := loadCertificateFromStore(keyName)
+	if err == nil {
+		orderedKeys.Store(keyName, true)
+		return nil
+	}
+	orderCtx, cancel := context.WithTimeout(detachContext(ctx), 5*time.Minute)
+	defer cancel()
+	if err = m.autocertManager().HostPolicy(orderCtx, name); err != nil {
+		return err
+	}
+	key, err := GeneratePrivateKey(algo)
+	if err != nil {
+		return err
+	}
+	issuerLog.Info("ordering certificate", "key_name", keyName, "issuer", iss.Name, "key_algorithm", algo)
+	_, err = iss.orderCertificate(orderCtx, keyName, []string{strings.TrimSuffix(name, ".")}, key)
+	if err != nil {
+		return err
+	}
+	orderedKeys.Store(keyName, true)
+	recordCertSource(ctx, certFromIssuer)
+	return nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	RspUnauthorized     = []byte("Unauthorized.")
+	RspMethodNotAllowed = []byte("Method not allowed.")
+	RspInvalidRequest   = []byte("Invalid request.")
+	RspIssuerNotFound   = []byte("Issuer not found.")
+	RspCertNotFound     = []byte("Certificate not found.")
+)
+
+// buildAdminRoutes registers the admin endpoints, which are available
+// only if the option "admin.enable" is true.
+func (m *Manager) buildAdminRoutes(mux *http.ServeMux, mw func(http.Handler) http.Handler) {
+	if !Cfg.Admin.Enable {
+		return
+	}
+	_mw := func(h http.HandlerFunc) http.Handler {
+		return mw(adminAuthMiddleware(h))
+	}
+	mux.Handle("/admin/account", _mw(m.HandleAccount))
+	mux.Handle("/admin/account/contact", _mw(m.HandleAccountContact))
+	mux.Handle("/admin/account/key-rollover", _mw(m.HandleAccountKeyRollover))
+	mux.Handle("/admin/account/deactivate", _mw(m.HandleAccountDeactivate))
+	mux.Handle("/admin/inventory", _mw(m.HandleInventory))
+	mux.Handle("/admin/internal-ca/revoke", _mw(m.HandleInternalCARevoke))
+}
+
+// adminAuthMiddleware checks the bearer token configured by "admin.token",
+// requests are rejected if the token is empty.
+func adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if Cfg.Admin.Token == "" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(Cfg.Admin.Token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write(RspUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleAccount responds the ACME account detail of an issuer.
+// The optional query parameter "issuer" selects the issuer by name,
+// by default it is the primary issuer.
+func (m *Manager) HandleAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(RspMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	m.writeAccount(ctx, w, r.URL.Query().Get("issuer"))
+}
+
+// HandleAccountContact updates contacts of an ACME account, the request
+// body is a JSON object like {"contact": ["mailto:abc@example.com"]}.
+func (m *Manager) HandleAccountContact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(RspMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Contact []string `json:"contact"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(RspInvalidRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	issuerName := r.URL.Query().Get("issuer")
+	acct, err := m.UpdateAccountContact(ctx, issuerName, req.Contact)
+	if err != nil {
+		writeAdminError(w, "failed update account contact", issuerName, err)
+		return
+	}
+	writeJSON(w, acct)
+}
+
+// HandleAccountKeyRollover replaces the account key with a new one.
+func (m *Manager) HandleAccountKeyRollover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(RspMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	issuerName := r.URL.Query().Get("issuer")
+	if err := m.RolloverAccountKey(ctx, issuerName); err != nil {
+		writeAdminError(w, "failed rollover account key", issuerName, err)
+		return
+	}
+	m.writeAccount(ctx, w, issuerName)
+}
+
+// HandleAccountDeactivate deactivates the account and registers a new one.
+func (m *Manager) HandleAccountDeactivate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(RspMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	issuerName := r.URL.Query().Get("issuer")
+	if err := m.DeactivateAccount(ctx, issuerName); err != nil {
+		writeAdminError(w, "failed deactivate account", issuerName, err)
+		return
+	}
+	m.writeAccount(ctx, w, issuerName)
+}
+
+// HandleInternalCARevoke revokes a certificate issued by the internal CA,
+// the request body is a JSON object like {"domain": "example.com"} or
+// {"serial": "<hex serial number>"}, with an optional "reason" code.
+func (m *Manager) HandleInternalCARevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(RspMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Domain string `json:"domain"`
+		Serial string `json:"serial"`
+		Reason int    `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Domain == "" && req.Serial == "") {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(RspInvalidRequest)
+		return
+	}
+	record, err := RevokeInternalCACertificate(r.Context(), req.Domain, req.Serial, req.Reason)
+	if err != nil {
+		switch err {
+		case ErrInternalCADisabled:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+		case ErrInternalCACertUnknown:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(RspCertNotFound)
+		default:
+			adminLog.Error("failed revoke certificate", "domain", req.Domain, "serial", req.Serial, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+		}
+		return
+	}
+	writeJSON(w, record)
+}
+
+func (m *Manager) writeAccount(ctx context.Context, w http.ResponseWriter, issuerName string) {
+	acct, err := m.GetAccount(ctx, issuerName)
+	if err != nil {
+		writeAdminError(w, "failed get account", issuerName, err)
+		return
+	}
+	writeJSON(w, acct)
+}
+
+func writeAdminError(w http.ResponseWriter, msg string, issuerName string, err error) {
+	if err == ErrIssuerNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(RspIssuerNotFound)
+		return
+	}
+	adminLog.Error(msg, "issuer", issuerName, "err", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(err.Error()))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/tls"
@@ -11,11 +12,13 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/idna"
 )
 
@@ -26,12 +29,14 @@ import (
 const (
 	LetsEncrypt = 0
 	Managed     = 1
+	InternalCA  = 2
 	SelfSigned  = 100
 	ALPNCert    = 101
 )
 
 var (
 	RspInvalidDomainName     = []byte("Invalid domain name.")
+	RspInvalidKeyType        = []byte("Invalid key type.")
 	RspHostNotPermitted      = []byte("Host name not permitted.")
 	RspCertificateIsExpired  = []byte("Certificate is expired.")
 	RspErrGetCertificate     = []byte("Error getting certificate.")
@@ -40,75 +45,176 @@ var (
 
 func (m *Manager) BuildRoutes(mux *http.ServeMux) {
 	var _mw = func(h http.Handler) http.Handler {
-		return loggingMiddleware(recoverMiddleware(h))
+		return metricsMiddleware(mux, tracingMiddleware(mux, loggingMiddleware(recoverMiddleware(h))))
 	}
 	mux.Handle("/cert/", _mw(http.HandlerFunc(m.HandleCertificate)))
+	mux.Handle("/certs", _mw(http.HandlerFunc(m.HandleCertificates)))
 	mux.Handle("/ocsp/", _mw(http.HandlerFunc(m.HandleOCSPStapling)))
-	mux.Handle("/.well-known/acme-challenge/", _mw(m.m.HTTPHandler(nil)))
+	mux.Handle("/events", _mw(http.HandlerFunc(m.HandleChanges)))
+	mux.Handle("/metrics", _mw(promhttp.Handler()))
+	mux.Handle("/healthz", _mw(http.HandlerFunc(m.HandleHealthz)))
+	mux.Handle("/readyz", _mw(http.HandlerFunc(m.HandleReadyz)))
+	mux.Handle("/.well-known/acme-challenge/", _mw(http.HandlerFunc(m.HandleHTTP01Challenge)))
+	if Cfg.SelfSigned.InternalCA.Enable {
+		mux.Handle(internalCAOCSPPath, _mw(http.HandlerFunc(m.HandleInternalCAOCSP)))
+		mux.Handle(internalCAOCSPPath+"/", _mw(http.HandlerFunc(m.HandleInternalCAOCSP)))
+	}
+	m.buildAdminRoutes(mux, _mw)
 }
 
 // HandleCertificate handlers requests of SSL certificate.
 //
+// The optional query parameter "key_type" (rsa or ecdsa) selects key type
+// of the auto issued certificate, RSA is always used if the configuration
+// option "force_rsa" is enabled.
+//
+// The response format is selected by the query parameter "format" or
+// the "Accept" header, see FormatJSON and the other formats.
+//
+// The response carries an ETag derived from the certificate chain, type
+// and response format, a request with matching "If-None-Match" gets 304
+// with refreshed TTL headers "X-Expire-At" and "X-TTL", without the
+// certificate data.
+//
 // Possible responses are:
 // - 200 with the certificate data as response
-// - 400 the requested domain name is invalid or not permitted
+// - 304 the certificate is not modified
+// - 400 the requested domain name, key type or format is invalid, or the
+//       domain name is not permitted
 // - 500 which indicates the server failed to process the request,
 //       in such case, the body will be filled with the error message
 func (m *Manager) HandleCertificate(w http.ResponseWriter, r *http.Request) {
 	domain := strings.TrimPrefix(r.URL.Path, "/cert/")
 	domain, err := idna.Lookup.ToASCII(domain)
 	if err != nil {
-		log.Printf("[INFO] manager: got invalid domain name: err= %v", err)
+		managerLog.Info("got invalid domain name", "err", err)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write(RspInvalidDomainName)
 		return
 	}
+	keyType, err := m.parseKeyType(r)
+	if err != nil {
+		managerLog.Info("got invalid key type", "domain", domain, "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(RspInvalidKeyType)
+		return
+	}
+	format, err := parseCertFormat(r)
+	if err != nil {
+		managerLog.Info("got invalid certificate format", "domain", domain, "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(RspInvalidFormat)
+		return
+	}
+	password := r.Header.Get(pkcs12PasswordHeader)
+	if format == FormatPKCS12 && password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(RspPKCS12PasswordRequired)
+		return
+	}
 
-	var tlscert *tls.Certificate
-	var certType int
-	var isALPN01 = r.URL.Query().Get("alpn") == "1"
-	if isALPN01 {
-		certType = ALPNCert
+	var res *certResult
+	if r.URL.Query().Get("alpn") == "1" {
+		var tlscert *tls.Certificate
 		tlscert, err = m.GetAutocertALPN01Certificate(domain)
+		observeCertLookup(ALPNCert, err)
+		if err != nil {
+			err = lookupError(domain, err)
+		}
+		res = &certResult{cert: tlscert, certType: ALPNCert}
 	} else {
-		tlscert, certType, err = m.GetCertificateByName(domain)
+		res, err = m.lookupCertificate(r.Context(), domain, keyType)
 	}
 	if err != nil {
-		if err == ErrHostNotPermitted {
-			log.Printf("[INFO] manager: domain name not permitted: domain= %s", domain)
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(RspHostNotPermitted)
-		} else {
-			log.Printf("[ERROR] manager: failed get certificate: domain= %s err= %v", domain, err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(RspErrGetCertificate)
-		}
+		rspErr := err.(*certLookupError)
+		w.WriteHeader(rspErr.status)
+		w.Write(rspErr.body)
 		return
 	}
+	tlscert, certType, ttlSeconds := res.cert, res.certType, res.ttl
+	setAccessInfo(r, domain, certType)
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		attribute.String("domain", domain),
+		attribute.String("cert_type", certTypeName(certType)),
+	)
 
-	var ttlSeconds int
-	if !isALPN01 {
-		var ttl = time.Until(tlscert.Leaf.NotAfter)
-		if ttl <= 0 {
-			log.Printf("[WARN] manager: got expired certificate: domain= %s", domain)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(RspCertificateIsExpired)
+	w.Header().Set("Vary", "Accept")
+	if tlscert.Leaf != nil {
+		etag := certETag(tlscert, certType, format)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("X-Expire-At", fmt.Sprintf("%d", tlscert.Leaf.NotAfter.Unix()))
+		w.Header().Set("X-TTL", fmt.Sprintf("%d", ttlSeconds))
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
 			return
 		}
-		ttlSeconds = m.limitTTL(ttl)
 	}
-	response, err := marshalCertificate(tlscert, certType, ttlSeconds)
+	response, err := encodeCertificate(format, tlscert, certType, ttlSeconds, res.issuer, password)
 	if err != nil {
-		log.Printf("[ERROR] manager: failed marshal certificate: domain= %s err= %v", domain, err)
+		managerLog.Error("failed marshal certificate", "domain", domain, "cert_type", certTypeName(certType), "format", format, "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write(RspErrMarshalCertificate)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", formatContentTypes[format])
 	w.Write(response)
 }
 
-func marshalCertificate(cert *tls.Certificate, certType int, ttl int) ([]byte, error) {
+// certResult is a certificate looked up for a request, with the details
+// to respond it.
+type certResult struct {
+	cert     *tls.Certificate
+	certType int
+	ttl      int    // in seconds
+	issuer   string // for ACME certificates
+}
+
+// certLookupError tells the status code and message to respond when a
+// certificate can't be served.
+type certLookupError struct {
+	status int
+	body   []byte
+}
+
+func (e *certLookupError) Error() string {
+	return string(e.body)
+}
+
+// lookupError logs err and converts it to a *certLookupError.
+func lookupError(domain string, err error) error {
+	if err == ErrHostNotPermitted {
+		managerLog.Info("domain name not permitted", "domain", domain)
+		return &certLookupError{http.StatusBadRequest, RspHostNotPermitted}
+	}
+	managerLog.Error("failed get certificate", "domain", domain, "err", err)
+	return &certLookupError{http.StatusInternalServerError, RspErrGetCertificate}
+}
+
+// lookupCertificate gets the certificate to respond for domain, it is
+// shared by HandleCertificate and HandleCertificates. The returned error
+// is a *certLookupError.
+func (m *Manager) lookupCertificate(ctx context.Context, domain string, keyType string) (*certResult, error) {
+	tlscert, certType, err := m.GetCertificateByName(ctx, domain, keyType)
+	if err != nil {
+		return nil, lookupError(domain, err)
+	}
+	var ttl = time.Until(tlscert.Leaf.NotAfter)
+	if ttl <= 0 {
+		managerLog.Warn("got expired certificate", "domain", domain, "cert_type", certTypeName(certType))
+		return nil, &certLookupError{http.StatusInternalServerError, RspCertificateIsExpired}
+	}
+	res := &certResult{
+		cert:     tlscert,
+		certType: certType,
+		ttl:      m.limitTTL(ttl),
+	}
+	if certType == LetsEncrypt {
+		res.issuer = m.GetCertificateIssuer(domain, keyType)
+	}
+	return res, nil
+}
+
+func marshalCertificate(cert *tls.Certificate, certType int, ttl int, issuer string) ([]byte, error) {
 	var (
 		err        error
 		certBuf    bytes.Buffer
@@ -120,14 +226,7 @@ func marshalCertificate(cert *tls.Certificate, certType int, ttl int) ([]byte, e
 			return nil, fmt.Errorf("encode certificate: %v", err)
 		}
 	}
-	switch key := cert.PrivateKey.(type) {
-	case *rsa.PrivateKey:
-		err = EncodeRSAKey(&privKeyBuf, key)
-	case *ecdsa.PrivateKey:
-		err = EncodeECDSAKey(&privKeyBuf, key)
-	default:
-		err = fmt.Errorf("unknown private key type")
-	}
+	err = EncodePrivateKey(&privKeyBuf, cert.PrivateKey)
 	if err != nil {
 		return nil, fmt.Errorf("encode private key: %v", err)
 	}
@@ -147,6 +246,8 @@ func marshalCertificate(cert *tls.Certificate, certType int, ttl int) ([]byte, e
 		Fingerprint string `json:"fingerprint"`
 		ExpireAt    int64  `json:"expire_at"` // seconds since epoch
 		TTL         int    `json:"ttl"`       // in seconds
+		KeyType     string `json:"key_type"`
+		Issuer      string `json:"issuer,omitempty"`
 	}{
 		Type:        certType,
 		Cert:        string(certBuf.Bytes()),
@@ -154,25 +255,79 @@ func marshalCertificate(cert *tls.Certificate, certType int, ttl int) ([]byte, e
 		Fingerprint: fingerprint,
 		ExpireAt:    expireAt,
 		TTL:         ttl,
+		KeyType:     certKeyType(cert),
+		Issuer:      issuer,
 	}
 	return json.Marshal(response)
 }
 
-func (m *Manager) GetCertificateByName(name string) (tlscert *tls.Certificate, certType int, err error) {
+// parseKeyType gets the requested key type from query parameter "key_type".
+func (m *Manager) parseKeyType(r *http.Request) (string, error) {
+	return m.validateKeyType(r.URL.Query().Get("key_type"))
+}
+
+// validateKeyType checks the requested key type and returns the key type
+// to use, an empty key type selects the default one.
+func (m *Manager) validateKeyType(keyType string) (string, error) {
+	keyType = strings.ToLower(keyType)
+	switch keyType {
+	case "":
+		return m.DefaultKeyType(), nil
+	case KeyTypeECDSA, KeyTypeRSA:
+		// RSA certificates work for all clients, "force_rsa" wins
+		if m.ForceRSA {
+			return KeyTypeRSA, nil
+		}
+		return keyType, nil
+	}
+	return "", fmt.Errorf("unknown key type %q", keyType)
+}
+
+// certKeyType returns key type of the certificate's private key.
+func certKeyType(cert *tls.Certificate) string {
+	switch cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return KeyTypeRSA
+	case *ecdsa.PrivateKey:
+		return KeyTypeECDSA
+	case ed25519.PrivateKey:
+		return KeyTypeEd25519
+	}
+	return ""
+}
+
+func (m *Manager) GetCertificateByName(ctx context.Context, name string, keyType string) (tlscert *tls.Certificate, certType int, err error) {
+	ctx, span := tracer.Start(ctx, "GetCertificateByName", trace.WithAttributes(
+		attribute.String("domain", name),
+		attribute.String("key_type", keyType),
+	))
+	defer func() {
+		observeCertLookup(certType, err)
+		span.SetAttributes(attribute.String("cert_type", certTypeName(certType)))
+		endSpan(span, err)
+	}()
 	// check managed domains first
 	if certKey, ok := IsManagedDomain(name); ok {
 		certType = Managed
-		tlscert, err = GetManagedCertificate(certKey)
+		tlscert, err = GetManagedCertificate(ctx, certKey)
 	} else
 	// check auto issued certificates from Let's Encrypt
-	if err = m.m.HostPolicy(context.Background(), name); err == nil {
+	if err = m.autocertManager().HostPolicy(context.Background(), name); err == nil {
 		certType = LetsEncrypt
-		tlscert, err = m.GetAutocertCertificate(name)
+		tlscert, err = m.getSANGroupCertificate(ctx, name, keyType)
+		if tlscert == nil && err == nil {
+			tlscert, err = m.GetAutocertCertificate(ctx, name, keyType)
+		}
 	} else
 	// check self-signed
 	if IsSelfSignedAllowed(name) {
-		certType = SelfSigned
-		tlscert, err = GetSelfSignedCertificate()
+		if Cfg.SelfSigned.InternalCA.Enable {
+			certType = InternalCA
+			tlscert, err = GetInternalCACertificate(ctx, name)
+		} else {
+			certType = SelfSigned
+			tlscert, err = GetSelfSignedCertificate(ctx)
+		}
 	} else
 	// host not allowed
 	{
@@ -187,7 +342,8 @@ func (m *Manager) GetCertificateByName(name string) (tlscert *tls.Certificate, c
 // - 200 with the OCSP response as body
 // - 204 without body, which indicates OCSP stapling for the requested domain
 //       is not available, temporarily or permanently
-// - 400 which indicates the requested domain name is invalid or not permitted
+// - 400 which indicates the requested domain name is invalid or not permitted,
+//       or the requested key type is invalid
 func (m *Manager) HandleOCSPStapling(w http.ResponseWriter, r *http.Request) {
 	domain := strings.TrimPrefix(r.URL.Path, "/ocsp/")
 	domain, err := idna.Lookup.ToASCII(domain)
@@ -199,8 +355,14 @@ func (m *Manager) HandleOCSPStapling(w http.ResponseWriter, r *http.Request) {
 		w.Write(RspHostNotPermitted)
 		return
 	}
+	keyType, err := m.parseKeyType(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(RspInvalidKeyType)
+		return
+	}
 	fingerprint := r.URL.Query().Get("fp")
-	response, nextUpdate, err := m.GetOCSPStaplingByName(domain, fingerprint)
+	response, nextUpdate, err := m.GetOCSPStaplingByName(domain, keyType, fingerprint)
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -208,7 +370,7 @@ func (m *Manager) HandleOCSPStapling(w http.ResponseWriter, r *http.Request) {
 
 	var ttl = time.Until(nextUpdate)
 	if ttl <= 0 {
-		log.Printf("[WARN] manager: got expired OCSP stapling: domain= %s", domain)
+		managerLog.Warn("got expired OCSP stapling", "domain", domain)
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
@@ -220,15 +382,23 @@ func (m *Manager) HandleOCSPStapling(w http.ResponseWriter, r *http.Request) {
 	w.Write(response)
 }
 
-func (m *Manager) GetOCSPStaplingByName(name string, fingerprint string) ([]byte, time.Time, error) {
+func (m *Manager) GetOCSPStaplingByName(name string, keyType string, fingerprint string) ([]byte, time.Time, error) {
 	var keyName string
 	// check managed domains first
 	if certKey, ok := IsManagedDomain(name); ok {
 		keyName = managedCertOCSPKeyName(certKey)
 	} else
 	// check auto issued certificates from Let's Encrypt
-	if err := m.m.HostPolicy(context.Background(), name); err == nil {
-		keyName = m.OCSPKeyName(name)
+	if err := m.autocertManager().HostPolicy(context.Background(), name); err == nil {
+		if group := m.servingSANGroup(name, keyType); group != nil {
+			keyName = group.OCSPKeyName()
+		} else {
+			keyName = m.OCSPKeyName(name, keyType)
+		}
+	} else
+	// check certificates issued by the internal CA
+	if Cfg.SelfSigned.InternalCA.Enable && IsSelfSignedAllowed(name) {
+		keyName = internalCAOCSPKeyName(name)
 	}
 	if keyName == "" {
 		return nil, time.Time{}, ErrStaplingNotCached
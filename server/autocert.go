@@ -1,7 +1,9 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/tls"
@@ -14,6 +16,8 @@ import (
 	"net"
 	"net/http"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/alyx/x/autocert"
@@ -89,42 +93,66 @@ var manager *Manager
 func GetManager() *Manager {
 	if manager == nil {
 		manager = &Manager{
-			m: &autocert.Manager{
-				Prompt:      autocert.AcceptTOS,
-				Cache:       Cfg.Storage.Cache,
-				RenewBefore: time.Duration(Cfg.LetsEncrypt.RenewBefore) * 24 * time.Hour,
-				Client:      &acme.Client{DirectoryURL: Cfg.LetsEncrypt.DirectoryURL},
-				Email:       Cfg.LetsEncrypt.Email,
-				HostPolicy:  Cfg.LetsEncrypt.HostPolicy,
-			},
-			ForceRSA: Cfg.LetsEncrypt.ForceRSA,
+			ForceRSA:     Cfg.LetsEncrypt.ForceRSA,
+			DualKeyTypes: Cfg.LetsEncrypt.DualKeyTypes,
 		}
-		if Cfg.LetsEncrypt.EABKID != "" && Cfg.LetsEncrypt.EABKey != "" {
-			manager.m.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: Cfg.LetsEncrypt.EABKID, Key: []byte(Cfg.LetsEncrypt.EABKey)}
+		for i, conf := range issuerConfigs() {
+			accountKeyName := issuerAccountKeyName(i, conf.Name)
+			iss := newIssuer(conf, accountKeyName)
+			iss.cache.onOwnerChange = manager.certOwnerChanged
+			manager.issuers = append(manager.issuers, iss)
 		}
+		manager.groups = newSANGroupManager(manager)
 	}
 	return manager
 }
 
 type Manager struct {
-	m        *autocert.Manager
+	issuers  []*issuer
+	groups   *sanGroupManager
 	ForceRSA bool
+
+	// DualKeyTypes makes the Manager obtain and maintain both ECDSA
+	// and RSA certificates for a domain when either one is requested.
+	DualKeyTypes bool
+	dualKeyMu    sync.Mutex
+	dualKeyDone  map[string]bool
 }
 
-func (m *Manager) KeyName(domain string) string {
-	if !m.ForceRSA {
+// Key types of certificates, ACME certificates are either ECDSA or RSA.
+const (
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeRSA     = "rsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// DefaultKeyType returns the key type to use when it's not specified
+// by the client.
+func (m *Manager) DefaultKeyType() string {
+	if m.ForceRSA {
+		return KeyTypeRSA
+	}
+	return KeyTypeECDSA
+}
+
+func (m *Manager) KeyName(domain string, keyType string) string {
+	if keyType != KeyTypeRSA {
 		return domain
 	}
 	return domain + "+rsa"
 }
 
-func (m *Manager) OCSPKeyName(domain string) string {
-	return fmt.Sprintf("autocert|%s", m.KeyName(domain))
+func (m *Manager) OCSPKeyName(domain string, keyType string) string {
+	return autocertOCSPKeyName(m.KeyName(domain, keyType))
+}
+
+func autocertOCSPKeyName(keyName string) string {
+	return fmt.Sprintf("autocert|%s", keyName)
 }
 
-func (m *Manager) helloInfo(domain string) *tls.ClientHelloInfo {
+func (m *Manager) helloInfo(domain string, keyType string) *tls.ClientHelloInfo {
 	helloInfo := &tls.ClientHelloInfo{ServerName: domain}
-	if !m.ForceRSA {
+	if keyType != KeyTypeRSA {
 		helloInfo.SignatureSchemes = append(helloInfo.SignatureSchemes,
 			tls.ECDSAWithP256AndSHA256,
 			tls.ECDSAWithP384AndSHA384,
@@ -144,26 +172,232 @@ func (m *Manager) helloInfo(domain string) *tls.ClientHelloInfo {
 	return helloInfo
 }
 
-func (m *Manager) GetAutocertCertificate(name string) (*tls.Certificate, error) {
-	helloInfo := m.helloInfo(name)
-	cert, err := m.m.GetCertificate(helloInfo)
+func (m *Manager) GetAutocertCertificate(ctx context.Context, name string, keyType string) (*tls.Certificate, error) {
+	cert, err := m.getAutocertCertificate(ctx, name, keyType)
 	if err != nil {
 		return nil, err
 	}
 
-	ocspKeyName := m.OCSPKeyName(name)
-	OCSPManager.Watch(ocspKeyName, func() (*tls.Certificate, error) {
-		helloInfo := m.helloInfo(name)
-		return m.m.GetCertificate(helloInfo)
+	ocspKeyName := m.OCSPKeyName(name, keyType)
+	OCSPManager.Watch(ocspKeyName, cert, func() (*tls.Certificate, error) {
+		return m.getAutocertCertificate(context.Background(), name, keyType)
+	})
+	OCSPManager.OnRevoked(ocspKeyName, func(revoked *tls.Certificate) {
+		m.reissueRevokedCertificate(name, keyType, revoked)
 	})
 
+	if m.DualKeyTypes {
+		m.ensureDualKeyTypes(name, keyType)
+	}
 	return cert, nil
 }
 
+// getSANGroupCertificate returns the shared certificate if name belongs to
+// a SAN group. Group certificates are of the default key type, it returns
+// nil without error if the name should be served by a single domain
+// certificate.
+func (m *Manager) getSANGroupCertificate(ctx context.Context, name string, keyType string) (*tls.Certificate, error) {
+	if keyType != m.DefaultKeyType() {
+		return nil, nil
+	}
+	cert, _, err := m.groups.GetCertificate(ctx, name)
+	return cert, err
+}
+
+// servingSANGroup returns the SAN group which serves certificate for name.
+func (m *Manager) servingSANGroup(name string, keyType string) *sanGroup {
+	if keyType != m.DefaultKeyType() {
+		return nil
+	}
+	return m.groups.Serving(name)
+}
+
+// ensureDualKeyTypes obtains certificate of the other key type in
+// background, once the certificate is loaded or issued, autocert takes
+// responsibility to keep it renewed.
+func (m *Manager) ensureDualKeyTypes(name string, keyType string) {
+	otherKeyType := KeyTypeRSA
+	if keyType == KeyTypeRSA {
+		otherKeyType = KeyTypeECDSA
+	}
+	otherKeyName := m.KeyName(name, otherKeyType)
+
+	m.dualKeyMu.Lock()
+	if m.dualKeyDone[otherKeyName] {
+		m.dualKeyMu.Unlock()
+		return
+	}
+	if m.dualKeyDone == nil {
+		m.dualKeyDone = make(map[string]bool)
+	}
+	m.dualKeyDone[otherKeyName] = true
+	m.dualKeyMu.Unlock()
+
+	go func() {
+		_, err := m.GetAutocertCertificate(context.Background(), name, otherKeyType)
+		if err != nil {
+			managerLog.Warn("failed get dual key type certificate", "key_name", otherKeyName, "err", err)
+			m.dualKeyMu.Lock()
+			delete(m.dualKeyDone, otherKeyName)
+			m.dualKeyMu.Unlock()
+		}
+	}()
+}
+
+// getAutocertCertificate tries the issuers, the owner of the certificate
+// first, until a certificate is obtained from cache or ordered from an
+// issuer successfully.
+func (m *Manager) getAutocertCertificate(ctx context.Context, name string, keyType string) (cert *tls.Certificate, err error) {
+	keyName := m.KeyName(name, keyType)
+	issuers := m.issuersFor(ctx, keyName)
+	for i, iss := range issuers {
+		err = m.orderWithKeyAlgorithm(ctx, iss, name, keyType)
+		if err == ErrHostNotPermitted {
+			return nil, err
+		}
+		if err != nil {
+			managerLog.Warn("failed order certificate", "domain", name, "key_type", keyType, "issuer", iss.Name, "err", err)
+			continue
+		}
+		helloInfo := m.helloInfo(name, keyType)
+		endSpan := startAutocertSpan(ctx, autocertOCSPKeyName(keyName), name, keyType, iss.Name)
+		gen := iss.generation()
+		loaded, puts := gen.loadState(keyName)
+		cert, err = gen.m.GetCertificate(helloInfo)
+		endSpan(err)
+		if err == nil {
+			recordCertSource(ctx, gen.certSource(keyName, loaded, puts))
+		}
+		if err == nil || err == ErrHostNotPermitted {
+			return cert, err
+		}
+		if i < len(issuers)-1 {
+			managerLog.Warn("failed get certificate, try next issuer", "domain", name, "issuer", iss.Name, "err", err)
+		}
+	}
+	if err != nil {
+		emitIssuanceFailed(m.OCSPKeyName(name, keyType), LetsEncrypt, []string{strings.TrimSuffix(name, ".")}, err)
+	}
+	return nil, err
+}
+
+// reissueRevokedCertificate orders a new certificate with a new private
+// key to replace the revoked one, then resets the issuers' autocert
+// managers to load the new certificate from storage. It retries until
+// the certificate is replaced.
+func (m *Manager) reissueRevokedCertificate(name string, keyType string, revoked *tls.Certificate) {
+	keyName := m.KeyName(name, keyType)
+	ocspKeyName := m.OCSPKeyName(name, keyType)
+	unlock := lockOrder(keyName)
+	defer unlock()
+
+	// the certificate may have been replaced by another instance
+	cert, err := loadCertificateFromStore(keyName)
+	if err != nil || bytes.Equal(cert.Certificate[0], revoked.Certificate[0]) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+		for _, iss := range m.issuers {
+			var key crypto.Signer
+			key, err = GeneratePrivateKey(iss.keyAlgorithm(keyType))
+			if err != nil {
+				break
+			}
+			managerLog.Info("reissuing revoked certificate", "key_name", keyName, "issuer", iss.Name)
+			_, err = iss.orderCertificate(ctx, keyName, []string{strings.TrimSuffix(name, ".")}, key)
+			if err == nil {
+				break
+			}
+			managerLog.Warn("failed reissue certificate", "key_name", keyName, "issuer", iss.Name, "err", err)
+		}
+		if err != nil {
+			Inventory.RaiseAlert(ocspKeyName, AlertReissueFailed, "failed reissue revoked certificate: %v", err)
+			emitIssuanceFailed(ocspKeyName, LetsEncrypt, []string{strings.TrimSuffix(name, ".")}, err)
+			next := renewJitter / 2
+			next += time.Duration(rand63n(int64(next)))
+			time.AfterFunc(next, func() { m.reissueRevokedCertificate(name, keyType, revoked) })
+			return
+		}
+	}
+
+	// autocert keeps certificates in memory, retire the managers which
+	// have loaded the revoked certificate to serve the new one
+	for _, iss := range m.issuers {
+		if iss.hasLoaded(keyName) {
+			iss.retireAutocertManager(m)
+		}
+	}
+	OCSPManager.NotifyChange(ocspKeyName)
+	Inventory.ResolveAlert(ocspKeyName, AlertReissueFailed)
+	managerLog.Info("replaced revoked certificate", "key_name", keyName)
+}
+
+// GetCertificateIssuer returns name of the issuer which issued the
+// certificate for domain, it returns an empty string if unknown.
+func (m *Manager) GetCertificateIssuer(domain string, keyType string) string {
+	keyName := m.KeyName(domain, keyType)
+	if group := m.servingSANGroup(domain, keyType); group != nil {
+		keyName = group.KeyName()
+	}
+	return lookupCertIssuer(context.Background(), keyName)
+}
+
+// certOwner returns the issuer which owns the certificate of keyName,
+// i.e. the issuer recorded in metadata, or the primary issuer if unknown.
+// Only the owner loads the certificate into its autocert.Manager, thus
+// the certificate is renewed only once.
+func (m *Manager) certOwner(ctx context.Context, keyName string) *issuer {
+	name := lookupCertIssuer(ctx, keyName)
+	for _, iss := range m.issuers {
+		if iss.Name == name {
+			return iss
+		}
+	}
+	return m.issuers[0]
+}
+
+// issuersFor returns the issuers to try for the certificate of keyName,
+// the owner comes first, then the others in configured order, which
+// order a new certificate only if the owner fails.
+func (m *Manager) issuersFor(ctx context.Context, keyName string) []*issuer {
+	owner := m.certOwner(ctx, keyName)
+	out := make([]*issuer, 0, len(m.issuers))
+	out = append(out, owner)
+	for _, iss := range m.issuers {
+		if iss != owner {
+			out = append(out, iss)
+		}
+	}
+	return out
+}
+
+// certOwnerChanged retires the previous owner's autocert.Manager if it
+// has loaded the certificate, which would renew it otherwise.
+func (m *Manager) certOwnerChanged(keyName string, prev string) {
+	for i, iss := range m.issuers {
+		if iss.Name == prev || (prev == "" && i == 0) {
+			if iss.hasLoaded(keyName) {
+				go iss.retireAutocertManager(m)
+			}
+			return
+		}
+	}
+}
+
+// autocertManager returns the primary issuer's current autocert.Manager.
+func (m *Manager) autocertManager() *autocert.Manager {
+	return m.issuers[0].autocertManager()
+}
+
 func (m *Manager) GetAutocertALPN01Certificate(name string) (*tls.Certificate, error) {
-	helloInfo := m.helloInfo(name)
+	helloInfo := m.helloInfo(name, m.DefaultKeyType())
 	helloInfo.SupportedProtos = []string{acme.ALPNProto}
-	return m.m.GetCertificate(helloInfo)
+	return m.autocertManager().GetCertificate(helloInfo)
+}
+
+// HandleHTTP01Challenge serves http-01 challenge responses, which are
+// shared in storage, by the primary issuer's current autocert.Manager.
+func (m *Manager) HandleHTTP01Challenge(w http.ResponseWriter, r *http.Request) {
+	m.autocertManager().HTTPHandler(nil).ServeHTTP(w, r)
 }
 
 var rand63n = mathrand.Int63n
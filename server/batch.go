@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	batchMaxDomains  = 1000
+	batchConcurrency = 8
+	batchMaxBodySize = 1 << 20
+)
+
+var (
+	RspInvalidBatchRequest = []byte("Invalid batch request.")
+	RspTooManyDomains      = []byte("Too many domains.")
+)
+
+type batchRequest struct {
+	Domains []string `json:"domains"`
+	KeyType string   `json:"key_type"`
+}
+
+type batchItem struct {
+	Domain string `json:"domain"`
+	Error  string `json:"error,omitempty"`
+
+	// Cert is the same JSON object as responded by "/cert/"
+	Cert json.RawMessage `json:"cert,omitempty"`
+	ETag string          `json:"etag,omitempty"`
+
+	OCSP         []byte `json:"ocsp,omitempty"`
+	OCSPExpireAt int64  `json:"ocsp_expire_at,omitempty"` // seconds since epoch
+	OCSPTTL      int    `json:"ocsp_ttl,omitempty"`       // in seconds
+}
+
+// HandleCertificates handles batch requests of SSL certificates and
+// OCSP staplings, which helps clients to preload many domains.
+//
+// The request body is a JSON object like
+// {"domains": ["example.com", ...], "key_type": "ecdsa"}, key_type is
+// optional, it is same with the query parameter of "/cert/".
+//
+// The response is a JSON object {"certificates": [...]}, which contains
+// an item for each requested domain in the same order. An item has
+// either "error" or "cert", "cert" is same with the response of
+// "/cert/" in JSON format, the OCSP stapling is given if it is available.
+//
+// Possible responses are:
+// - 200 with the certificates, which may contain errors of some domains
+// - 400 the request is invalid, or too many domains are requested
+func (m *Manager) HandleCertificates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req batchRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, batchMaxBodySize)).Decode(&req)
+	if err != nil {
+		managerLog.Info("got invalid batch request", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(RspInvalidBatchRequest)
+		return
+	}
+	if len(req.Domains) > batchMaxDomains {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(RspTooManyDomains)
+		return
+	}
+	keyType, err := m.validateKeyType(req.KeyType)
+	if err != nil {
+		managerLog.Info("got invalid key type in batch request", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(RspInvalidKeyType)
+		return
+	}
+
+	items := make([]*batchItem, len(req.Domains))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < batchConcurrency && i < len(items); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				items[idx] = m.getBatchItem(r.Context(), req.Domains[idx], keyType)
+			}
+		}()
+	}
+	for i := range items {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	response, err := json.Marshal(map[string]interface{}{"certificates": items})
+	if err != nil {
+		managerLog.Error("failed marshal batch certificates", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(RspErrMarshalCertificate)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+func (m *Manager) getBatchItem(ctx context.Context, domain string, keyType string) *batchItem {
+	item := &batchItem{Domain: domain}
+	domain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		item.Error = string(RspInvalidDomainName)
+		return item
+	}
+	res, err := m.lookupCertificate(ctx, domain, keyType)
+	if err != nil {
+		item.Error = err.Error()
+		return item
+	}
+	tlscert, certType := res.cert, res.certType
+	item.Cert, err = marshalCertificate(tlscert, certType, res.ttl, res.issuer)
+	if err != nil {
+		managerLog.Error("failed marshal certificate", "domain", domain, "err", err)
+		item.Error = string(RspErrMarshalCertificate)
+		return item
+	}
+	item.ETag = certETag(tlscert, certType, FormatJSON)
+
+	if certType < 100 {
+		checksum := sha1.Sum(tlscert.Leaf.Raw)
+		fingerprint := hex.EncodeToString(checksum[:])
+		stapling, nextUpdate, err := m.GetOCSPStaplingByName(domain, keyType, fingerprint)
+		if ttl := time.Until(nextUpdate); err == nil && ttl > 0 {
+			item.OCSP = stapling
+			item.OCSPExpireAt = nextUpdate.Unix()
+			item.OCSPTTL = m.limitTTL(ttl)
+		}
+	}
+	return item
+}
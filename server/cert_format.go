@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Formats of the certificate responded by "/cert/", it is selected by the
+// query parameter "format", or negotiated by the "Accept" header.
+//
+// - json: the default JSON object, the whole chain is concatenated in "cert"
+// - json-split: like json, with separate "leaf", "chain" and "fullchain"
+// - pem: a PEM file containing the full chain followed by the private key
+// - der: the DER encoded leaf certificate, without private key
+// - pkcs12: a PKCS#12 file protected by the password given by the
+//   header "X-PKCS12-Password"
+const (
+	FormatJSON      = "json"
+	FormatJSONSplit = "json-split"
+	FormatPEM       = "pem"
+	FormatDER       = "der"
+	FormatPKCS12    = "pkcs12"
+)
+
+const pkcs12PasswordHeader = "X-PKCS12-Password"
+
+var (
+	RspInvalidFormat          = []byte("Invalid certificate format.")
+	RspPKCS12PasswordRequired = []byte("PKCS#12 password required.")
+)
+
+var errInvalidFormat = errors.New("invalid certificate format")
+
+var formatContentTypes = map[string]string{
+	FormatJSON:      "application/json",
+	FormatJSONSplit: "application/vnd.ssl-cert-server.split+json",
+	FormatPEM:       "application/x-pem-file",
+	FormatDER:       "application/pkix-cert",
+	FormatPKCS12:    "application/x-pkcs12",
+}
+
+var formatAliases = map[string]string{
+	"p12": FormatPKCS12,
+	"pfx": FormatPKCS12,
+	"crt": FormatDER,
+	"cer": FormatDER,
+}
+
+// parseCertFormat gets the requested certificate format from query
+// parameter "format", or else the first acceptable one in header "Accept".
+// It falls back to json if nothing in "Accept" is supported.
+func parseCertFormat(r *http.Request) (string, error) {
+	if format := strings.ToLower(r.URL.Query().Get("format")); format != "" {
+		if alias, ok := formatAliases[format]; ok {
+			format = alias
+		}
+		if _, ok := formatContentTypes[format]; !ok {
+			return "", errInvalidFormat
+		}
+		return format, nil
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		for format, contentType := range formatContentTypes {
+			if mediaType == contentType {
+				return format, nil
+			}
+		}
+		// application/x-pkcs12 is also known as application/pkcs12
+		if mediaType == "application/pkcs12" {
+			return FormatPKCS12, nil
+		}
+	}
+	return FormatJSON, nil
+}
+
+// encodeCertificate encodes the certificate in the given format.
+func encodeCertificate(format string, cert *tls.Certificate, certType int, ttl int, issuer string, password string) ([]byte, error) {
+	switch format {
+	case FormatJSONSplit:
+		return marshalCertificateSplit(cert, certType, ttl, issuer)
+	case FormatPEM:
+		return encodePEMBundle(cert)
+	case FormatDER:
+		return cert.Certificate[0], nil
+	case FormatPKCS12:
+		return encodePKCS12(cert, password)
+	}
+	return marshalCertificate(cert, certType, ttl, issuer)
+}
+
+func marshalCertificateSplit(cert *tls.Certificate, certType int, ttl int, issuer string) ([]byte, error) {
+	var leafBuf, chainBuf, privKeyBuf bytes.Buffer
+	for i, b := range cert.Certificate {
+		buf := &chainBuf
+		if i == 0 {
+			buf = &leafBuf
+		}
+		if err := pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: b}); err != nil {
+			return nil, fmt.Errorf("encode certificate: %v", err)
+		}
+	}
+	if err := EncodePrivateKey(&privKeyBuf, cert.PrivateKey); err != nil {
+		return nil, fmt.Errorf("encode private key: %v", err)
+	}
+
+	var fingerprint string
+	var expireAt int64
+	if cert.Leaf != nil {
+		checksum := sha1.Sum(cert.Leaf.Raw)
+		fingerprint = hex.EncodeToString(checksum[:])
+		expireAt = cert.Leaf.NotAfter.Unix()
+	}
+	response := struct {
+		Type        int    `json:"type"`
+		Leaf        string `json:"leaf"`
+		Chain       string `json:"chain"`
+		FullChain   string `json:"fullchain"`
+		PKey        string `json:"pkey"`
+		Fingerprint string `json:"fingerprint"`
+		ExpireAt    int64  `json:"expire_at"` // seconds since epoch
+		TTL         int    `json:"ttl"`       // in seconds
+		KeyType     string `json:"key_type"`
+		Issuer      string `json:"issuer,omitempty"`
+	}{
+		Type:        certType,
+		Leaf:        leafBuf.String(),
+		Chain:       chainBuf.String(),
+		FullChain:   leafBuf.String() + chainBuf.String(),
+		PKey:        privKeyBuf.String(),
+		Fingerprint: fingerprint,
+		ExpireAt:    expireAt,
+		TTL:         ttl,
+		KeyType:     certKeyType(cert),
+		Issuer:      issuer,
+	}
+	return json.Marshal(response)
+}
+
+func encodePEMBundle(cert *tls.Certificate) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, b := range cert.Certificate {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: b}); err != nil {
+			return nil, fmt.Errorf("encode certificate: %v", err)
+		}
+	}
+	if err := EncodePrivateKey(&buf, cert.PrivateKey); err != nil {
+		return nil, fmt.Errorf("encode private key: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func encodePKCS12(cert *tls.Certificate, password string) ([]byte, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	var caCerts []*x509.Certificate
+	for _, b := range cert.Certificate[1:] {
+		c, err := x509.ParseCertificate(b)
+		if err != nil {
+			return nil, err
+		}
+		caCerts = append(caCerts, c)
+	}
+	return pkcs12.Encode(rand.Reader, cert.PrivateKey, leaf, caCerts, password)
+}
+
+// certETag returns a weak ETag of the certificate response, the response
+// is semantically equivalent as long as the certificate chain, type and
+// format don't change, though the TTL in the JSON body may differ.
+func certETag(cert *tls.Certificate, certType int, format string) string {
+	h := sha1.New()
+	for _, der := range cert.Certificate {
+		h.Write(der)
+	}
+	fmt.Fprintf(h, "|%d|%s", certType, format)
+	return fmt.Sprintf(`W/"%s"`, hex.EncodeToString(h.Sum(nil)))
+}
+
+// etagMatch does weak comparison of the "If-None-Match" header and etag.
+func etagMatch(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, x := range strings.Split(ifNoneMatch, ",") {
+		x = strings.TrimSpace(x)
+		if x == "*" || strings.TrimPrefix(x, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
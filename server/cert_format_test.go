@@ -0,0 +1,60 @@
+package server
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestEtagMatch(t *testing.T) {
+	const etag = `W/"abc"`
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{``, false},
+		{`*`, true},
+		{`W/"abc"`, true},
+		{`"abc"`, true},
+		{`"abd"`, false},
+		{`W/"abd"`, false},
+		{`"x", W/"abc"`, true},
+		{`"x",W/"abc" ,"y"`, true},
+		{`"x", "y"`, false},
+		{`abc`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatch(tt.ifNoneMatch, etag); got != tt.want {
+			t.Errorf("etagMatch(%q, %q) = %v, want %v", tt.ifNoneMatch, etag, got, tt.want)
+		}
+	}
+}
+
+func TestCertETag(t *testing.T) {
+	leaf, inter1, inter2 := []byte("leaf"), []byte("intermediate-1"), []byte("intermediate-2")
+	chain1 := &tls.Certificate{Certificate: [][]byte{leaf, inter1}}
+	chain2 := &tls.Certificate{Certificate: [][]byte{leaf, inter2}}
+	base := certETag(chain1, LetsEncrypt, FormatJSON)
+
+	tests := []struct {
+		name     string
+		cert     *tls.Certificate
+		certType int
+		format   string
+		same     bool
+	}{
+		{"same", &tls.Certificate{Certificate: [][]byte{leaf, inter1}}, LetsEncrypt, FormatJSON, true},
+		{"chain", chain2, LetsEncrypt, FormatJSON, false},
+		{"leaf only", &tls.Certificate{Certificate: [][]byte{leaf}}, LetsEncrypt, FormatJSON, false},
+		{"cert type", chain1, Managed, FormatJSON, false},
+		{"format", chain1, LetsEncrypt, FormatPEM, false},
+	}
+	for _, tt := range tests {
+		got := certETag(tt.cert, tt.certType, tt.format)
+		if (got == base) != tt.same {
+			t.Errorf("%s: certETag = %s, base = %s, want same %v", tt.name, got, base, tt.same)
+		}
+		if !etagMatch(got, got) {
+			t.Errorf("%s: etagMatch(%s) = false", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/alyx/x/autocert"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Offline management of the certificates in the configured storage,
+// used by the command line tools.
+
+var ErrNotCertificate = errors.New("the key is not a certificate")
+
+// StoredCertificate is a certificate in storage.
+type StoredCertificate struct {
+	Key         string
+	Certificate *tls.Certificate
+
+	// Issuer and IssuedAt are available for ACME certificates.
+	Issuer   string
+	IssuedAt int64 // seconds since epoch
+}
+
+// ListCertificates returns the certificates in storage sorted by key,
+// expired certificates are included.
+func ListCertificates(ctx context.Context) ([]*StoredCertificate, error) {
+	keys, err := listStorageKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	var out []*StoredCertificate
+	for _, key := range keys {
+		if strings.HasSuffix(key, certMetaSuffix) {
+			continue
+		}
+		stored, err := GetStoredCertificate(ctx, key)
+		if err == ErrNotCertificate || err == autocert.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, stored)
+	}
+	return out, nil
+}
+
+// GetStoredCertificate loads the certificate of key from storage,
+// it doesn't check the validity period of the certificate.
+func GetStoredCertificate(ctx context.Context, key string) (*StoredCertificate, error) {
+	data, err := Cfg.Storage.Cache.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parseKeyPair(data)
+	if err != nil {
+		return nil, ErrNotCertificate
+	}
+	stored := &StoredCertificate{Key: key, Certificate: cert}
+	if meta, err := getCertMeta(ctx, key); err == nil {
+		stored.Issuer = meta.Issuer
+		stored.IssuedAt = meta.IssuedAt
+	}
+	return stored, nil
+}
+
+// ImportCertificate saves a certificate into storage under key, the
+// certificate may contain the chain, or the chain is given separately.
+// An existing key which is not a certificate is never overwritten.
+func ImportCertificate(ctx context.Context, key string, certPEM, keyPEM, chainPEM []byte) (*tls.Certificate, error) {
+	if key == "" || strings.ContainsAny(key, "/\\") {
+		return nil, fmt.Errorf("invalid key %q", key)
+	}
+	data := append(append(append([]byte{}, keyPEM...), certPEM...), chainPEM...)
+	cert, err := parseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+	_, err = GetStoredCertificate(ctx, key)
+	if err == ErrNotCertificate {
+		return nil, fmt.Errorf("key %q exists and is not a certificate", key)
+	}
+	if err != nil && err != autocert.ErrCacheMiss {
+		return nil, err
+	}
+	if err = Cfg.Storage.Cache.Put(ctx, key, data); err != nil {
+		return nil, err
+	}
+	// the certificate is not issued by an ACME issuer anymore
+	if err = Cfg.Storage.Cache.Delete(ctx, key+certMetaSuffix); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// DeleteCertificate deletes the certificate of key from storage.
+func DeleteCertificate(ctx context.Context, key string) error {
+	if _, err := GetStoredCertificate(ctx, key); err != nil {
+		return err
+	}
+	if err := Cfg.Storage.Cache.Delete(ctx, key); err != nil {
+		return err
+	}
+	return Cfg.Storage.Cache.Delete(ctx, key+certMetaSuffix)
+}
+
+// EncodeCertificate encodes the certificate with private key in format
+// "pem" or "pkcs12", the password is required for pkcs12.
+func EncodeCertificate(cert *tls.Certificate, format string, password string) ([]byte, error) {
+	if alias, ok := formatAliases[format]; ok {
+		format = alias
+	}
+	switch format {
+	case FormatPEM:
+		return encodePEMBundle(cert)
+	case FormatPKCS12:
+		if password == "" {
+			return nil, errors.New("pkcs12 password required")
+		}
+		return encodePKCS12(cert, password)
+	}
+	return nil, errInvalidFormat
+}
+
+// CertificateExplanation tells which branch of GetCertificateByName
+// a name takes, and why.
+type CertificateExplanation struct {
+	Name     string
+	KeyType  string
+	CertType string // "managed", "letsencrypt", "internal_ca", "self_signed" or "denied"
+	Key      string // storage key of the certificate
+	Reasons  []string
+
+	// Stored is nil if the certificate is not in storage yet.
+	Stored *StoredCertificate
+}
+
+// ExplainCertificate explains how the certificate for name would be
+// served, without ordering or creating any certificate.
+func (m *Manager) ExplainCertificate(ctx context.Context, name string, keyType string) *CertificateExplanation {
+	name = strings.TrimSuffix(name, ".")
+	if keyType == "" {
+		keyType = m.DefaultKeyType()
+	}
+	exp := &CertificateExplanation{Name: name, KeyType: keyType}
+	reason := func(format string, args ...interface{}) {
+		exp.Reasons = append(exp.Reasons, fmt.Sprintf(format, args...))
+	}
+
+	for _, x := range Cfg.Managed {
+		if x.Regex.MatchString(name) {
+			reason("matches managed pattern %q", x.Pattern)
+			exp.CertType = certTypeName(Managed)
+			exp.Key = x.CertKey
+			m.explainStored(ctx, exp)
+			return exp
+		}
+	}
+	reason("matches no managed pattern")
+
+	err := m.autocertManager().HostPolicy(ctx, name)
+	if err == nil {
+		reason("%s", explainHostPolicy(name))
+		exp.CertType = certTypeName(LetsEncrypt)
+		exp.Key = m.explainSANGroup(ctx, name, keyType, reason)
+		m.explainStored(ctx, exp)
+		return exp
+	}
+	reason("not permitted by lets_encrypt host policy: %v", err)
+
+	if !Cfg.SelfSigned.Enable {
+		reason("self_signed is disabled")
+		exp.CertType = "denied"
+		return exp
+	}
+	if Cfg.SelfSigned.CheckSNI {
+		if err := checkHostIsValid(ctx, name); err != nil {
+			reason("self_signed check_sni: not a valid domain name")
+			exp.CertType = "denied"
+			return exp
+		}
+	}
+	if Cfg.SelfSigned.InternalCA.Enable {
+		reason("self_signed is enabled, certificates are issued by the internal CA")
+		exp.CertType = certTypeName(InternalCA)
+		exp.Key = internalCACertKeyName(name)
+	} else {
+		reason("self_signed is enabled, one certificate is shared by all names")
+		exp.CertType = certTypeName(SelfSigned)
+		exp.Key = Cfg.SelfSigned.CertKey
+	}
+	m.explainStored(ctx, exp)
+	return exp
+}
+
+func explainHostPolicy(name string) string {
+	le := Cfg.LetsEncrypt
+	for _, domain := range le.Domains {
+		if domain == name {
+			return "listed in lets_encrypt.domains"
+		}
+	}
+	for _, group := range le.SANGroups {
+		for _, domain := range group.Domains {
+			if domain == name {
+				return fmt.Sprintf("listed in lets_encrypt.san_groups %q", group.Name)
+			}
+		}
+	}
+	if len(le.Domains) == 0 && len(le.REPatterns) == 0 {
+		return "any valid domain name is permitted, since neither lets_encrypt.domains nor re_patterns is configured"
+	}
+	return "matches lets_encrypt.re_patterns"
+}
+
+// explainSANGroup returns the storage key of the certificate served for
+// name, either a SAN group certificate or a single domain certificate.
+func (m *Manager) explainSANGroup(ctx context.Context, name string, keyType string, reason func(string, ...interface{})) string {
+	single := m.KeyName(name, keyType)
+	if keyType != m.DefaultKeyType() {
+		return single
+	}
+	var group *sanGroup
+	if group = m.groups.members[name]; group == nil && m.groups.enabled {
+		if rd, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+			group = &sanGroup{Name: autoSANGroupPrefix + rd, auto: true}
+		}
+	}
+	if group == nil {
+		return single
+	}
+	// the group certificate is ordered if not exists, names not covered
+	// by the current one are added on next renewal
+	stored, err := GetStoredCertificate(ctx, group.KeyName())
+	if err == nil && stored.Certificate.Leaf.VerifyHostname(name) != nil {
+		reason("not covered by san group %q yet, served by single domain certificate until next renewal", group.Name)
+		return single
+	}
+	reason("served by san group %q", group.Name)
+	return group.KeyName()
+}
+
+func (m *Manager) explainStored(ctx context.Context, exp *CertificateExplanation) {
+	stored, err := GetStoredCertificate(ctx, exp.Key)
+	if err != nil {
+		return
+	}
+	exp.Stored = stored
+}
@@ -0,0 +1,385 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertSyncFailed is raised when a certificate cannot be written to disk
+// or the reload command fails.
+const AlertSyncFailed = "sync_failed"
+
+// syncTargetConfig configures writing a certificate to disk for services
+// which cannot call the API, e.g. Postfix, Dovecot and HAProxy.
+type syncTargetConfig struct {
+	Name          string `yaml:"name"`
+	Domain        string `yaml:"domain"`   // certificate served for the domain
+	KeyType       string `yaml:"key_type"` // default: lets_encrypt.default_key_type
+	CertKey       string `yaml:"cert_key"` // managed certificate, instead of domain
+	Dir           string `yaml:"dir"`
+	Fullchain     string `yaml:"fullchain"`      // default: "fullchain.pem"
+	Privkey       string `yaml:"privkey"`        // default: "privkey.pem"
+	Owner         string `yaml:"owner"`          // "user:group", default: not changed
+	CertMode      string `yaml:"cert_mode"`      // default: "0644"
+	KeyMode       string `yaml:"key_mode"`       // default: "0600"
+	ReloadCommand string `yaml:"reload_command"` // run by "sh -c"
+	PIDFile       string `yaml:"pid_file"`       // signal the process after reload command
+	Signal        string `yaml:"signal"`         // default: "HUP"
+
+	certMode os.FileMode
+	keyMode  os.FileMode
+	uid, gid int
+}
+
+func (p *syncTargetConfig) keyName() string {
+	return "sync|" + p.Name
+}
+
+// setup checks the target config and fills the defaults.
+func (p *syncTargetConfig) setup() error {
+	if p.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if (p.Domain == "") == (p.CertKey == "") {
+		return fmt.Errorf("exactly one of domain and cert_key must be given")
+	}
+	if p.Dir == "" {
+		return fmt.Errorf("missing dir")
+	}
+	if p.KeyType != "" && p.KeyType != KeyTypeRSA && p.KeyType != KeyTypeECDSA {
+		return fmt.Errorf("invalid key_type %q", p.KeyType)
+	}
+	setDefault(&p.Fullchain, "fullchain.pem")
+	setDefault(&p.Privkey, "privkey.pem")
+	setDefault(&p.CertMode, "0644")
+	setDefault(&p.KeyMode, "0600")
+	// a combined file, e.g. for HAProxy, would be overwritten by
+	// the chain after the key is written
+	if filepath.Join(p.Dir, p.Fullchain) == filepath.Join(p.Dir, p.Privkey) {
+		return fmt.Errorf("fullchain and privkey must be different files")
+	}
+	for _, x := range []struct {
+		mode string
+		out  *os.FileMode
+	}{{p.CertMode, &p.certMode}, {p.KeyMode, &p.keyMode}} {
+		mode, err := strconv.ParseUint(x.mode, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("invalid file mode %q", x.mode)
+		}
+		*x.out = os.FileMode(mode)
+	}
+	// the signal is only used with pid_file
+	if p.PIDFile != "" {
+		setDefault(&p.Signal, "HUP")
+		if _, ok := syncSignals[strings.ToUpper(strings.TrimPrefix(p.Signal, "SIG"))]; !ok {
+			return fmt.Errorf("unsupported signal %q", p.Signal)
+		}
+	}
+	var err error
+	p.uid, p.gid, err = lookupOwner(p.Owner)
+	return err
+}
+
+// lookupOwner parses "user:group" into uid and gid, user and group can
+// be names or numeric ids, -1 means not changed.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner == "" {
+		return
+	}
+	userName, groupName := owner, ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		userName, groupName = owner[:i], owner[i+1:]
+	}
+	if userName != "" {
+		if uid, err = strconv.Atoi(userName); err != nil {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return -1, -1, err
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if groupName != "" {
+		if gid, err = strconv.Atoi(groupName); err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return -1, -1, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+// SyncStatus is the state of a sync target.
+type SyncStatus struct {
+	Name        string `json:"name"`
+	Domain      string `json:"domain,omitempty"`
+	CertKey     string `json:"cert_key,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	NotAfter    int64  `json:"not_after,omitempty"` // seconds since epoch
+	SyncedAt    int64  `json:"synced_at,omitempty"` // seconds since epoch
+	Error       string `json:"error,omitempty"`
+}
+
+var certSyncer *syncer
+
+type syncer struct {
+	m    *Manager
+	kick chan struct{}
+
+	mu     sync.Mutex
+	status map[string]*SyncStatus
+
+	// names of targets pending reload, accessed only by run
+	reload map[string]bool
+}
+
+// StartCertSync starts writing certificates to disk for the configured
+// sync targets, the targets are checked on schedule and when any
+// certificate changes.
+func StartCertSync(m *Manager) {
+	if len(Cfg.Sync.Targets) == 0 {
+		return
+	}
+	s := &syncer{
+		m:      m,
+		kick:   make(chan struct{}, 1),
+		status: make(map[string]*SyncStatus),
+		reload: make(map[string]bool),
+	}
+	certSyncer = s
+	go s.run()
+}
+
+// SyncStatuses returns the states of the sync targets sorted by name.
+func SyncStatuses() []*SyncStatus {
+	s := certSyncer
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*SyncStatus, 0, len(s.status))
+	for _, st := range s.status {
+		x := *st
+		out = append(out, &x)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (s *syncer) run() {
+	sub := Changes.Subscribe(nil)
+	defer Changes.Unsubscribe(sub)
+	go func() {
+		for ev := range sub.ch {
+			if ev.Type != ChangeCertificate {
+				continue
+			}
+			select {
+			case s.kick <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	interval := time.Duration(Cfg.Sync.IntervalMinutes) * time.Minute
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for i := range Cfg.Sync.Targets {
+			s.syncTarget(&Cfg.Sync.Targets[i])
+		}
+		select {
+		case <-ticker.C:
+		case <-s.kick:
+		}
+	}
+}
+
+func (s *syncer) getCertificate(ctx context.Context, target *syncTargetConfig) (*tls.Certificate, error) {
+	if target.CertKey != "" {
+		return GetManagedCertificate(ctx, target.CertKey)
+	}
+	keyType := target.KeyType
+	if keyType == "" {
+		keyType = s.m.DefaultKeyType()
+	}
+	cert, _, err := s.m.GetCertificateByName(ctx, target.Domain, keyType)
+	return cert, err
+}
+
+// syncTarget writes the certificate to disk if the files differ from the
+// current certificate, then reloads the service.
+func (s *syncer) syncTarget(target *syncTargetConfig) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	s.mu.Lock()
+	st := s.status[target.Name]
+	if st == nil {
+		st = &SyncStatus{Name: target.Name, Domain: target.Domain, CertKey: target.CertKey}
+		s.status[target.Name] = st
+	}
+	s.mu.Unlock()
+
+	// a failed reload is retried on next check, even if the files are
+	// not changed since then
+	changed, cert, err := s.writeFiles(ctx, target)
+	if changed {
+		s.reload[target.Name] = true
+	}
+	if err == nil && s.reload[target.Name] {
+		if err = reloadSyncTarget(ctx, target); err == nil {
+			delete(s.reload, target.Name)
+		}
+	}
+
+	if err != nil {
+		s.mu.Lock()
+		st.Error = err.Error()
+		s.mu.Unlock()
+		syncLog.Error("failed sync certificate", "name", target.Name, "err", err)
+		Inventory.RaiseAlert(target.keyName(), AlertSyncFailed, "failed sync certificate: %v", err)
+		return
+	}
+	checksum := sha1.Sum(cert.Leaf.Raw)
+	fingerprint := hex.EncodeToString(checksum[:])
+	s.mu.Lock()
+	st.Fingerprint = fingerprint
+	st.NotAfter = cert.Leaf.NotAfter.Unix()
+	st.Error = ""
+	if changed {
+		st.SyncedAt = timeNow().Unix()
+	}
+	s.mu.Unlock()
+	if changed {
+		syncLog.Info("synced certificate", "name", target.Name, "dir", target.Dir, "fingerprint", fingerprint)
+	}
+	Inventory.ResolveAlert(target.keyName(), AlertSyncFailed)
+}
+
+// writeFiles writes the full chain and private key files atomically, it
+// tells whether any file is changed.
+func (s *syncer) writeFiles(ctx context.Context, target *syncTargetConfig) (changed bool, cert *tls.Certificate, err error) {
+	cert, err = s.getCertificate(ctx, target)
+	if err != nil {
+		return false, nil, err
+	}
+	var chain, key bytes.Buffer
+	for _, b := range cert.Certificate {
+		pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	}
+	if err = EncodePrivateKey(&key, cert.PrivateKey); err != nil {
+		return false, nil, fmt.Errorf("encode private key: %v", err)
+	}
+	if err = os.MkdirAll(target.Dir, 0755); err != nil {
+		return false, nil, err
+	}
+
+	// each file is replaced atomically, but not both together, a service
+	// reading the files in between may see the new private key with the
+	// old certificate, thus services are reloaded only after both files
+	// are written
+	files := []struct {
+		name string
+		data []byte
+		mode os.FileMode
+	}{
+		{target.Privkey, key.Bytes(), target.keyMode},
+		{target.Fullchain, chain.Bytes(), target.certMode},
+	}
+	for _, f := range files {
+		path := filepath.Join(target.Dir, f.name)
+		if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, f.data) {
+			continue
+		}
+		if err = writeFileAtomic(path, f.data, f.mode, target.uid, target.gid); err != nil {
+			return changed, nil, err
+		}
+		changed = true
+	}
+	return changed, cert, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory,
+// then renames it to path.
+func writeFileAtomic(path string, data []byte, mode os.FileMode, uid, gid int) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if uid >= 0 || gid >= 0 {
+		if err = tmp.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// reloadSyncTarget runs the reload command and signals the process
+// of the pid file if configured.
+func reloadSyncTarget(ctx context.Context, target *syncTargetConfig) error {
+	if target.ReloadCommand != "" {
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, "sh", "-c", target.ReloadCommand).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("reload command: %v: %s", err, bytes.TrimSpace(out))
+		}
+	}
+	if target.PIDFile != "" {
+		data, err := ioutil.ReadFile(target.PIDFile)
+		if err != nil {
+			return err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return fmt.Errorf("invalid pid file: %v", err)
+		}
+		proc, err := os.FindProcess(pid)
+		if err != nil {
+			return err
+		}
+		sig := syncSignals[strings.ToUpper(strings.TrimPrefix(target.Signal, "SIG"))]
+		if err = proc.Signal(sig); err != nil {
+			return fmt.Errorf("signal process %d: %v", pid, err)
+		}
+	}
+	return nil
+}
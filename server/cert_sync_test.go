@@ -0,0 +1,41 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSyncTargetSetup(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  syncTargetConfig
+		wantErr string
+	}{
+		{"defaults", syncTargetConfig{Name: "a", Domain: "example.com", Dir: "/tmp/a"}, ""},
+		{"signal ignored without pid_file", syncTargetConfig{Name: "a", Domain: "example.com", Dir: "/tmp/a", Signal: "BOGUS"}, ""},
+		{"unsupported signal", syncTargetConfig{Name: "a", Domain: "example.com", Dir: "/tmp/a", PIDFile: "/run/a.pid", Signal: "BOGUS"}, "unsupported signal"},
+		{"same files", syncTargetConfig{Name: "a", Domain: "example.com", Dir: "/tmp/a", Fullchain: "a.pem", Privkey: "a.pem"}, "must be different"},
+		{"same files by path", syncTargetConfig{Name: "a", Domain: "example.com", Dir: "/tmp/a", Fullchain: "a.pem", Privkey: "./a.pem"}, "must be different"},
+		{"missing domain", syncTargetConfig{Name: "a", Dir: "/tmp/a"}, "exactly one"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.target.setup()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("setup() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("setup() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	target := syncTargetConfig{Name: "a", Domain: "example.com", Dir: "/tmp/a"}
+	target.setup()
+	if target.Signal != "" {
+		t.Errorf("signal defaults to %q without pid_file", target.Signal)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+var syncSignals = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
@@ -0,0 +1,8 @@
+package server
+
+import "os"
+
+// only killing is supported on windows
+var syncSignals = map[string]os.Signal{
+	"KILL": os.Kill,
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Change events tell clients that a certificate or OCSP stapling has
+// been changed, so they can refresh it immediately instead of waiting
+// for the TTL.
+const (
+	ChangeCertificate = "cert"
+	ChangeOCSP        = "ocsp"
+
+	changeHeartbeat  = 30 * time.Second
+	changeBufferSize = 64
+)
+
+var RspStreamingNotSupported = []byte("Streaming not supported.")
+
+var Changes = newChangeHub()
+
+type ChangeEvent struct {
+	ID      uint64   `json:"id"`
+	Type    string   `json:"type"`
+	Domains []string `json:"domains"`
+	Time    int64    `json:"time"` // seconds since epoch
+}
+
+type changeHub struct {
+	mu     sync.Mutex
+	lastID uint64
+	subs   map[*changeSubscriber]struct{}
+	closed chan struct{}
+}
+
+type changeSubscriber struct {
+	domains []string // empty to subscribe all domains
+	ch      chan *ChangeEvent
+}
+
+func newChangeHub() *changeHub {
+	return &changeHub{
+		subs:   make(map[*changeSubscriber]struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// Subscribe subscribes changes of the given domains, which may contain
+// wildcard names, an empty list subscribes changes of all domains.
+func (h *changeHub) Subscribe(domains []string) *changeSubscriber {
+	sub := &changeSubscriber{
+		domains: domains,
+		ch:      make(chan *ChangeEvent, changeBufferSize),
+	}
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *changeHub) Unsubscribe(sub *changeSubscriber) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+// Close ends all the streams, it should be called when the server is
+// shutting down, else the streams block graceful shutdown.
+func (h *changeHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.closed:
+	default:
+		close(h.closed)
+	}
+}
+
+// Publish sends a change event of the certificate for domains to
+// the interested subscribers, slow subscribers miss the event and
+// fall back to refresh by TTL.
+func (h *changeHub) Publish(typ string, domains []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID++
+	event := &ChangeEvent{
+		ID:      h.lastID,
+		Type:    typ,
+		Domains: domains,
+		Time:    timeNow().Unix(),
+	}
+	for sub := range h.subs {
+		if !sub.interested(domains) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			changesLog.Warn("subscriber is too slow, event dropped", "type", typ, "domains", domains)
+		}
+	}
+}
+
+func (s *changeSubscriber) interested(domains []string) bool {
+	if len(s.domains) == 0 {
+		return true
+	}
+	for _, x := range s.domains {
+		for _, name := range domains {
+			if matchDomain(x, name) || matchDomain(name, x) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchDomain tells whether name is matched by pattern, which may be
+// a wildcard name like "*.example.com".
+func matchDomain(pattern, name string) bool {
+	if pattern == name {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		i := strings.IndexByte(name, '.')
+		return i > 0 && name[i:] == pattern[1:]
+	}
+	return false
+}
+
+// HandleChanges streams change events as Server-Sent Events.
+//
+// Domains are subscribed by the query parameter "domain", which can be
+// given multiple times or as a comma-separated list, all domains are
+// subscribed if it is not given.
+//
+// Each event is sent with the event type "cert" or "ocsp" and the JSON
+// encoded ChangeEvent as data, a comment line is sent periodically to
+// keep the connection alive.
+func (m *Manager) HandleChanges(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(RspStreamingNotSupported)
+		return
+	}
+	var domains []string
+	for _, x := range r.URL.Query()["domain"] {
+		for _, name := range strings.Split(x, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				domains = append(domains, name)
+			}
+		}
+	}
+	sub := Changes.Subscribe(domains)
+	defer Changes.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, ": subscribed\n\n")
+	flusher.Flush()
+
+	ctx := r.Context()
+	heartbeat := time.NewTicker(changeHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-Changes.closed:
+			return
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": ping\n\n")
+		case event := <-sub.ch:
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// certDomains returns the domain names of the certificate.
+func certDomains(cert *tls.Certificate) []string {
+	if cert.Leaf == nil {
+		return nil
+	}
+	return cert.Leaf.DNSNames
+}
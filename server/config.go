@@ -21,11 +21,20 @@ type config struct {
 	Listen  string `yaml:"listen"`   // default: "127.0.0.1:8999"
 	PIDFile string `yaml:"pid_file"` // default: "ssl-cert-server.pid"
 
+	// Log configures the server logs and the access logs.
+	Log struct {
+		Level      string `yaml:"level"`       // debug | info | warn | error, default: info
+		Format     string `yaml:"format"`      // text | json, default: text
+		File       string `yaml:"file"`        // default: stderr
+		AccessFile string `yaml:"access_file"` // default: stdout
+	} `yaml:"log"`
+
 	Storage struct {
 		Type     string `yaml:"type"`      // dir_cache | redis, default: dir_cache
 		DirCache string `yaml:"dir_cache"` // default: "./secret-dir"
 		Redis    struct {
-			Addr string `yaml:"addr"` // default: "127.0.0.1:6379"
+			Addr      string `yaml:"addr"`       // default: "127.0.0.1:6379"
+			KeyPrefix string `yaml:"key_prefix"` // default: ""
 		} `yaml:"redis"`
 
 		// Cache is used by Manager to store and retrieve previously obtained certificates
@@ -41,12 +50,14 @@ type config struct {
 	} `yaml:"managed"`
 
 	LetsEncrypt struct {
-		Staging     bool     `yaml:"staging"`      // default: false
-		ForceRSA    bool     `yaml:"force_rsa"`    // default: false
-		RenewBefore int      `yaml:"renew_before"` // default: 30
-		Email       string   `yaml:"email"`
-		Domains     []string `yaml:"domains"`
-		REPatterns  []string `yaml:"re_patterns"`
+		Name         string   `yaml:"name"`           // default: derived from directory_url
+		Staging      bool     `yaml:"staging"`        // default: false
+		ForceRSA     bool     `yaml:"force_rsa"`      // default: false
+		DualKeyTypes bool     `yaml:"dual_key_types"` // default: false
+		RenewBefore  int      `yaml:"renew_before"`   // default: 30
+		Email        string   `yaml:"email"`
+		Domains      []string `yaml:"domains"`
+		REPatterns   []string `yaml:"re_patterns"`
 
 		// HostPolicy is built from DomainList and PatternList.
 		// By default, any valid domain name is allowed if neither
@@ -63,14 +74,99 @@ type config struct {
 		EABKID string `yaml:"eab_kid"`
 		// EABKey is the ExternalAccountBinding HMAC key
 		EABKey string `yaml:"eab_key"`
+
+		// ECDSACurve and RSAKeySize specify key algorithms of new certificates.
+		ECDSACurve string `yaml:"ecdsa_curve"`  // default: "P-256"
+		RSAKeySize int    `yaml:"rsa_key_size"` // default: 2048
+
+		// FallbackIssuers optionally specifies ACME issuers to try in order
+		// when ordering a certificate from the above issuer fails.
+		FallbackIssuers []issuerConfig `yaml:"fallback_issuers"`
+
+		// SANGroups specifies groups of domain names, each group shares
+		// one certificate which covers all names in the group.
+		SANGroups []sanGroupConfig `yaml:"san_groups"`
+
+		// AutoSANGroup groups names by registered domain automatically,
+		// new names are added to the group's certificate on next renewal.
+		AutoSANGroup struct {
+			Enable   bool `yaml:"enable"`    // default: false
+			MaxNames int  `yaml:"max_names"` // default: 100
+		} `yaml:"auto_san_group"`
 	} `yaml:"lets_encrypt"`
 
+	// Admin enables the admin endpoints under "/admin/", requests must
+	// carry the token as "Authorization: Bearer <token>".
+	Admin struct {
+		Enable bool   `yaml:"enable"` // default: false
+		Token  string `yaml:"token"`
+	} `yaml:"admin"`
+
+	// OCSP configures the OCSP stapling manager.
+	OCSP struct {
+		// IdleDays stops watching OCSP status of certificates which are
+		// not requested within the given days, a negative value disables it.
+		IdleDays int `yaml:"idle_days"` // default: 7
+	} `yaml:"ocsp"`
+
+	// Health configures the readiness check "/readyz".
+	Health struct {
+		// ExpiryDays reports certificates being served which expire
+		// within the given days as a warning.
+		ExpiryDays int `yaml:"expiry_days"` // default: 7
+	} `yaml:"health"`
+
+	// Monitor configures checking expiry of the certificates on schedule,
+	// and sending notifications of alerts.
+	Monitor struct {
+		Enable          bool  `yaml:"enable"`           // default: false
+		IntervalMinutes int   `yaml:"interval_minutes"` // default: 60
+		Thresholds      []int `yaml:"thresholds"`       // days, default: [14, 7, 3, 1]
+		Webhooks        []struct {
+			URL    string `yaml:"url"`
+			Secret string `yaml:"secret"`
+		} `yaml:"webhooks"`
+		Email struct {
+			SMTPAddr string   `yaml:"smtp_addr"`
+			Username string   `yaml:"username"`
+			Password string   `yaml:"password"`
+			From     string   `yaml:"from"`
+			To       []string `yaml:"to"`
+		} `yaml:"email"`
+	} `yaml:"monitor"`
+
+	// Tracing configures exporting OpenTelemetry spans by OTLP over HTTP.
+	Tracing struct {
+		Enable      bool    `yaml:"enable"`       // default: false
+		Endpoint    string  `yaml:"endpoint"`     // default: "http://127.0.0.1:4318"
+		ServiceName string  `yaml:"service_name"` // default: "ssl-cert-server"
+		SampleRatio float64 `yaml:"sample_ratio"` // default: 1
+	} `yaml:"tracing"`
+
+	// EventWebhooks receive lifecycle events of the certificates.
+	EventWebhooks []eventWebhookConfig `yaml:"event_webhooks"`
+
+	// Sync writes certificates to disk and reloads the services using
+	// them, when the certificates change.
+	Sync struct {
+		IntervalMinutes int                `yaml:"interval_minutes"` // default: 5
+		Targets         []syncTargetConfig `yaml:"targets"`
+	} `yaml:"sync"`
+
 	SelfSigned struct {
-		Enable       bool     `yaml:"enable"`       // default: false
-		CheckSNI     bool     `yaml:"check_sni"`    // default: false
-		ValidDays    int      `yaml:"valid_days"`   // default: 365
-		Organization []string `yaml:"organization"` // default: ["SSL Cert Server Self-Signed"]
-		CertKey      string   `yaml:"cert_key"`     // default: "self_signed"
+		Enable       bool     `yaml:"enable"`        // default: false
+		CheckSNI     bool     `yaml:"check_sni"`     // default: false
+		ValidDays    int      `yaml:"valid_days"`    // default: 365
+		Organization []string `yaml:"organization"`  // default: ["SSL Cert Server Self-Signed"]
+		CertKey      string   `yaml:"cert_key"`      // default: "self_signed"
+		KeyAlgorithm string   `yaml:"key_algorithm"` // default: "P-256"
+
+		// InternalCA issues a certificate for each domain name from an
+		// internal CA, the certificates have OCSP stapling and can be revoked.
+		InternalCA struct {
+			Enable  bool   `yaml:"enable"`   // default: false
+			OCSPURL string `yaml:"ocsp_url"` // required if enabled
+		} `yaml:"internal_ca"`
 	} `yaml:"self_signed"`
 }
 
@@ -78,6 +174,9 @@ func (p *config) setupDefaultOptions() {
 	setDefault(&Cfg.Listen, "127.0.0.1:8999")
 	setDefault(&Cfg.PIDFile, "ssl-cert-server.pid")
 
+	setDefault(&Cfg.Log.Level, "info")
+	setDefault(&Cfg.Log.Format, LogFormatText)
+
 	setDefault(&Cfg.Storage.Type, "dir_cache")
 	setDefault(&Cfg.Storage.DirCache, "./secret-dir")
 	setDefault(&Cfg.Storage.Redis.Addr, "127.0.0.1:6379")
@@ -91,9 +190,28 @@ func (p *config) setupDefaultOptions() {
 			Cfg.LetsEncrypt.DirectoryURL = acme.LetsEncryptURL
 		}
 	}
+	setDefault(&Cfg.LetsEncrypt.Name, defaultIssuerName(Cfg.LetsEncrypt.DirectoryURL))
+	setDefault(&Cfg.LetsEncrypt.ECDSACurve, KeyAlgoP256)
+	setDefault(&Cfg.LetsEncrypt.RSAKeySize, 2048)
+	for i := range Cfg.LetsEncrypt.FallbackIssuers {
+		fallback := &Cfg.LetsEncrypt.FallbackIssuers[i]
+		fallback.setupDefaultOptions()
+		setDefault(&fallback.Email, Cfg.LetsEncrypt.Email)
+	}
+	setDefault(&Cfg.LetsEncrypt.AutoSANGroup.MaxNames, 100)
+
+	setDefault(&Cfg.OCSP.IdleDays, 7)
+	setDefault(&Cfg.Health.ExpiryDays, 7)
+	setDefault(&Cfg.Monitor.IntervalMinutes, 60)
+	setDefault(&Cfg.Monitor.Thresholds, []int{14, 7, 3, 1})
+	setDefault(&Cfg.Tracing.Endpoint, "http://127.0.0.1:4318")
+	setDefault(&Cfg.Tracing.ServiceName, "ssl-cert-server")
+	setDefault(&Cfg.Tracing.SampleRatio, 1.0)
+	setDefault(&Cfg.Sync.IntervalMinutes, 5)
 
 	setDefault(&Cfg.SelfSigned.ValidDays, 365)
 	setDefault(&Cfg.SelfSigned.CertKey, "self_signed")
+	setDefault(&Cfg.SelfSigned.KeyAlgorithm, KeyAlgoP256)
 	if len(Cfg.SelfSigned.Organization) == 0 {
 		Cfg.SelfSigned.Organization = DefaultSelfSignedOrganization
 	}
@@ -102,15 +220,20 @@ func (p *config) setupDefaultOptions() {
 func (p *config) buildHostPolicy() {
 	var listPolicy autocert.HostPolicy
 	var rePolicy autocert.HostPolicy
-	if len(p.LetsEncrypt.Domains) > 0 {
-		listPolicy = HostWhitelist(p.LetsEncrypt.Domains...)
+	// names in SAN groups are permitted implicitly
+	domains := p.LetsEncrypt.Domains
+	for _, group := range p.LetsEncrypt.SANGroups {
+		domains = append(domains, group.Domains...)
+	}
+	if len(domains) > 0 {
+		listPolicy = HostWhitelist(domains...)
 	}
 	if len(p.LetsEncrypt.REPatterns) > 0 {
 		patterns := make([]*regexp.Regexp, len(p.LetsEncrypt.REPatterns))
 		for i, p := range p.LetsEncrypt.REPatterns {
 			re, err := regexp.Compile(p)
 			if err != nil {
-				log.Fatalf("[FATAL] server: failed compile lets_encrypte domain pattern: %q, %v", p, err)
+				Fatal(serverLog, "failed compile lets_encrypt domain pattern", "pattern", p, "err", err)
 			}
 			patterns[i] = re
 		}
@@ -168,23 +291,100 @@ func InitConfig() {
 	// Prepare configuration.
 
 	Cfg.setupDefaultOptions()
+	InitLogging()
 	Cfg.buildHostPolicy()
 
+	issuerNames := make(map[string]bool)
+	for _, conf := range issuerConfigs() {
+		if conf.DirectoryURL == "" {
+			Fatal(serverLog, "missing directory_url for issuer", "issuer", conf.Name)
+		}
+		if issuerNames[conf.Name] {
+			Fatal(serverLog, "duplicate issuer name", "issuer", conf.Name)
+		}
+		issuerNames[conf.Name] = true
+		if _, err := ecdsaKeyAlgorithm(conf.ECDSACurve); err != nil {
+			Fatal(serverLog, "invalid key option for issuer", "issuer", conf.Name, "err", err)
+		}
+		if _, err := rsaKeyAlgorithm(conf.RSAKeySize); err != nil {
+			Fatal(serverLog, "invalid key option for issuer", "issuer", conf.Name, "err", err)
+		}
+	}
+	groupNames := make(map[string]bool)
+	groupDomains := make(map[string]bool)
+	for _, group := range Cfg.LetsEncrypt.SANGroups {
+		if err := validateSANGroupName(group.Name); err != nil {
+			Fatal(serverLog, "invalid san group", "err", err)
+		}
+		if groupNames[group.Name] {
+			Fatal(serverLog, "duplicate san group name", "group", group.Name)
+		}
+		groupNames[group.Name] = true
+		if len(group.Domains) == 0 {
+			Fatal(serverLog, "empty domains for san group", "group", group.Name)
+		}
+		for _, domain := range group.Domains {
+			if groupDomains[domain] {
+				Fatal(serverLog, "domain belongs to multiple san groups", "domain", domain)
+			}
+			groupDomains[domain] = true
+		}
+	}
+	Cfg.SelfSigned.KeyAlgorithm, err = ParseKeyAlgorithm(Cfg.SelfSigned.KeyAlgorithm)
+	if err != nil {
+		Fatal(serverLog, "invalid self_signed key algorithm", "err", err)
+	}
+	for _, hook := range Cfg.Monitor.Webhooks {
+		if hook.URL == "" {
+			Fatal(serverLog, "missing url for monitor webhook")
+		}
+	}
+	for _, hook := range Cfg.EventWebhooks {
+		if hook.URL == "" {
+			Fatal(serverLog, "missing url for event webhook")
+		}
+	}
+	syncNames := make(map[string]bool)
+	for i := range Cfg.Sync.Targets {
+		target := &Cfg.Sync.Targets[i]
+		if err = target.setup(); err != nil {
+			Fatal(serverLog, "invalid sync target", "name", target.Name, "err", err)
+		}
+		if syncNames[target.Name] {
+			Fatal(serverLog, "duplicate sync target", "name", target.Name)
+		}
+		syncNames[target.Name] = true
+	}
+	if email := Cfg.Monitor.Email; email.SMTPAddr != "" && (email.From == "" || len(email.To) == 0) {
+		Fatal(serverLog, "missing from or to for monitor email", "smtp_addr", email.SMTPAddr)
+	}
+	if Cfg.Admin.Enable && Cfg.Admin.Token == "" {
+		Fatal(serverLog, "missing token for admin endpoints")
+	}
+	if Cfg.SelfSigned.InternalCA.Enable && Cfg.SelfSigned.InternalCA.OCSPURL == "" {
+		Fatal(serverLog, "missing ocsp_url for self_signed internal_ca")
+	}
+
 	switch Cfg.Storage.Type {
 	case "dir_cache":
 		Cfg.Storage.Cache, _ = NewDirCache(Cfg.Storage.DirCache)
 	case "redis":
-		Cfg.Storage.Cache, err = NewRedisCache(Cfg.Storage.Redis.Addr)
+		Cfg.Storage.Cache, err = NewRedisCache(Cfg.Storage.Redis.Addr, Cfg.Storage.Redis.KeyPrefix)
 		if err != nil {
-			log.Fatalf("[FATAL] server: failed setup redis storage: %v", err)
+			Fatal(serverLog, "failed setup redis storage", "err", err)
 		}
 	}
+	if Cfg.Storage.Cache != nil {
+		Cfg.Storage.Cache = newTracingCache(Cfg.Storage.Type,
+			newMetricsCache(Cfg.Storage.Type, Cfg.Storage.Cache))
+	}
+	InitTracing()
 
 	for i := range Cfg.Managed {
 		pattern := Cfg.Managed[i].Pattern
 		re, err := regexp.Compile(pattern)
 		if err != nil {
-			log.Fatalf("[FATAL] server: failed compile managed domain pattern: %q, %v", pattern, err)
+			Fatal(serverLog, "failed compile managed domain pattern", "pattern", pattern, "err", err)
 		}
 		Cfg.Managed[i].Regex = re
 	}
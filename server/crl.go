@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// CRLs are checked for certificates whose CA doesn't provide OCSP,
+// or when the OCSP responder is unavailable. All watched certificates
+// which have CRL distribution points are also checked periodically,
+// thus revocation is noticed even if the OCSP responder says nothing.
+
+const (
+	AlertCRLRevoked     = "crl_revoked"
+	AlertCRLUnavailable = "crl_unavailable"
+
+	crlCheckInterval = time.Hour
+	crlFailureTTL    = 10 * time.Minute
+	crlMaxSize       = 32 << 20
+
+	revocationSourceOCSP = "ocsp"
+	revocationSourceCRL  = "crl"
+)
+
+var errNoCRLDistributionPoint = errors.New("certificate has no CRL distribution point")
+
+// revocationAlertTypes are alerts of checking revocation status by OCSP
+// or CRL, which are resolved by a good status, other alerts of the
+// certificate, e.g. by the expiry monitor, are kept.
+var revocationAlertTypes = []string{
+	AlertOCSPRevoked,
+	AlertOCSPUnknown,
+	AlertCRLRevoked,
+	AlertCRLUnavailable,
+	AlertIncompleteChain,
+}
+
+var crlCache sync.Map // url -> *crlEntry
+
+type crlEntry struct {
+	nextUpdate time.Time
+	revoked    map[string]x509.RevocationListEntry // serial number -> entry
+	err        error
+	fetchedAt  time.Time
+}
+
+// checkCRL checks the certificate against the CRL of its distribution
+// points, it returns the revocation entry if the certificate is revoked,
+// or nil if it is not.
+func checkCRL(ctx context.Context, leaf, issuer *x509.Certificate) (*x509.RevocationListEntry, error) {
+	if len(leaf.CRLDistributionPoints) == 0 {
+		return nil, errNoCRLDistributionPoint
+	}
+	var lastErr error
+	for _, url := range leaf.CRLDistributionPoints {
+		entry, err := fetchCRL(ctx, url, issuer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if revoked, ok := entry.revoked[leaf.SerialNumber.String()]; ok {
+			return &revoked, nil
+		}
+		return nil, nil
+	}
+	return nil, lastErr
+}
+
+func fetchCRL(ctx context.Context, url string, issuer *x509.Certificate) (*crlEntry, error) {
+	now := timeNow()
+	if x, ok := crlCache.Load(url); ok {
+		entry := x.(*crlEntry)
+		if entry.err != nil {
+			if now.Sub(entry.fetchedAt) < crlFailureTTL {
+				return nil, entry.err
+			}
+		} else if now.Sub(entry.fetchedAt) < crlCheckInterval &&
+			(entry.nextUpdate.IsZero() || now.Before(entry.nextUpdate)) {
+			return entry, nil
+		}
+	}
+	entry, err := doFetchCRL(ctx, url, issuer)
+	if err != nil {
+		entry = &crlEntry{err: err}
+	}
+	entry.fetchedAt = now
+	crlCache.Store(url, entry)
+	return entry, err
+}
+
+func doFetchCRL(ctx context.Context, url string, issuer *x509.Certificate) (*crlEntry, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch CRL from %s: unexpected status %d", url, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, crlMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil && block.Type == "X509 CRL" {
+		data = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse CRL from %s: %v", url, err)
+	}
+	if err = list.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("bad signature of CRL from %s: %v", url, err)
+	}
+	if !list.NextUpdate.IsZero() && list.NextUpdate.Before(timeNow()) {
+		return nil, fmt.Errorf("CRL from %s is expired: next_update= %s", url, list.NextUpdate.Format(time.RFC3339))
+	}
+	entry := &crlEntry{
+		nextUpdate: list.NextUpdate,
+		revoked:    make(map[string]x509.RevocationListEntry, len(list.RevokedCertificateEntries)),
+	}
+	for _, x := range list.RevokedCertificateEntries {
+		entry.revoked[x.SerialNumber.String()] = x
+	}
+	return entry, nil
+}
+
+// touchCRLState checks the CRL for a certificate without OCSP server,
+// and caches the revocation status as state of the certificate.
+func (m *ocspManager) touchCRLState(ctx context.Context, keyName string, cert *tls.Certificate, issuer *x509.Certificate) {
+	revoked, err := checkCRL(ctx, cert.Leaf, issuer)
+	if err != nil {
+		Inventory.RaiseAlert(keyName, AlertCRLUnavailable, "cannot check CRL: %v", err)
+		m.retryLater(keyName)
+		return
+	}
+	state := m.setCRLState(keyName, cert, issuer)
+	if revoked != nil {
+		m.markRevoked(keyName, state, revoked)
+	} else {
+		Inventory.ResolveAlert(keyName, revocationAlertTypes...)
+	}
+}
+
+func (m *ocspManager) setCRLState(keyName string, cert *tls.Certificate, issuer *x509.Certificate) *ocspState {
+	state := &ocspState{
+		cert:   cert,
+		issuer: issuer,
+		status: ocsp.Good,
+		source: revocationSourceCRL,
+	}
+	m.stateMu.Lock()
+	m.stateMap[keyName] = state
+	m.stateMu.Unlock()
+	return state
+}
+
+// checkCRLFallback checks the CRL when the OCSP responder is unavailable,
+// it returns true if the certificate is revoked.
+func (m *ocspManager) checkCRLFallback(ctx context.Context, keyName string, cert *tls.Certificate, issuer *x509.Certificate) bool {
+	if len(cert.Leaf.CRLDistributionPoints) == 0 {
+		return false
+	}
+	revoked, err := checkCRL(ctx, cert.Leaf, issuer)
+	if err != nil || revoked == nil {
+		return false
+	}
+	state := m.setCRLState(keyName, cert, issuer)
+	m.markRevoked(keyName, state, revoked)
+	return true
+}
+
+// checkCRLs periodically checks the CRL of all watched certificates.
+func (m *ocspManager) checkCRLs() {
+	ticker := time.NewTicker(crlCheckInterval)
+	for range ticker.C {
+		for keyName := range m.getCertMap() {
+			state, ok := m.lookupState(keyName)
+			if !ok || len(state.cert.Leaf.CRLDistributionPoints) == 0 {
+				continue
+			}
+			state.RLock()
+			status := state.status
+			state.RUnlock()
+			if status == ocsp.Revoked {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			revoked, err := checkCRL(ctx, state.cert.Leaf, state.issuer)
+			cancel()
+			if err != nil {
+				if state.source == revocationSourceCRL {
+					Inventory.RaiseAlert(keyName, AlertCRLUnavailable, "cannot check CRL: %v", err)
+				} else {
+					ocspLog.Warn("failed check CRL", "key_name", keyName, "err", err)
+				}
+				continue
+			}
+			Inventory.ResolveAlert(keyName, AlertCRLUnavailable)
+			if revoked != nil {
+				m.markRevoked(keyName, state, revoked)
+			}
+		}
+	}
+}
+
+// markRevoked marks the certificate as revoked according to the CRL.
+func (m *ocspManager) markRevoked(keyName string, state *ocspState, revoked *x509.RevocationListEntry) {
+	ocspLog.Error("certificate is revoked according to CRL", "key_name", keyName)
+	state.Lock()
+	state.status = ocsp.Revoked
+	state.ocspDER = nil
+	state.Unlock()
+	if state.renewal != nil {
+		state.renewal.stop()
+	}
+	Changes.Publish(ChangeOCSP, certDomains(state.cert))
+	m.handleRevoked(keyName, state.cert, AlertCRLRevoked, revoked.RevocationTime, revoked.ReasonCode)
+}
@@ -0,0 +1,586 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyx/x/autocert"
+)
+
+// Types of lifecycle events of certificates.
+const (
+	EventIssued                = "certificate.issued"
+	EventRenewed               = "certificate.renewed"
+	EventRevoked               = "certificate.revoked"
+	EventIssuanceFailed        = "certificate.issuance_failed"
+	EventManagedReloaded       = "managed.reloaded"
+	EventSelfSignedRegenerated = "self_signed.regenerated"
+	EventOCSPRevoked           = "ocsp.revoked"
+)
+
+const (
+	outboxStorageKey  = "events+outbox"
+	outboxQueueSize   = 1000
+	outboxMaxItems    = 10000
+	outboxMaxAttempts = 12
+	outboxMinBackoff  = 10 * time.Second
+	outboxMaxBackoff  = time.Hour
+
+	// outboxClaimTTL is how long other instances wait for the events
+	// claimed by an instance, before claiming them
+	outboxClaimTTL = 10 * time.Minute
+
+	// outboxDeliveredTTL is how long the delivered replicated events
+	// are remembered
+	outboxDeliveredTTL = 24 * time.Hour
+
+	// outboxLockTTL and outboxLockTimeout limit how long the outbox
+	// lock is held and waited for
+	outboxLockTTL     = 30 * time.Second
+	outboxLockTimeout = 30 * time.Second
+)
+
+// Event is a lifecycle event of a certificate.
+type Event struct {
+	ID          string   `json:"id"`
+	Type        string   `json:"type"`
+	KeyName     string   `json:"key_name,omitempty"`
+	CertType    string   `json:"cert_type,omitempty"`
+	Domains     []string `json:"domains,omitempty"`
+	Issuer      string   `json:"issuer,omitempty"`
+	Serial      string   `json:"serial,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	NotAfter    int64    `json:"not_after,omitempty"` // seconds since epoch
+	Reason      int      `json:"reason,omitempty"`    // revocation reason code
+
+	Error string `json:"error,omitempty"`
+	Host  string `json:"host"`
+	Time  int64  `json:"time"` // seconds since epoch
+}
+
+// newCertEvent returns an event with details of the certificate,
+// cert may be nil if the certificate is not available.
+func newCertEvent(typ string, keyName string, certType int, cert *tls.Certificate) *Event {
+	event := &Event{
+		Type:     typ,
+		KeyName:  keyName,
+		CertType: certTypeName(certType),
+	}
+	if cert != nil && cert.Leaf != nil {
+		checksum := sha1.Sum(cert.Leaf.Raw)
+		event.Domains = cert.Leaf.DNSNames
+		event.Serial = serialString(cert.Leaf.SerialNumber)
+		event.Fingerprint = hex.EncodeToString(checksum[:])
+		event.NotAfter = cert.Leaf.NotAfter.Unix()
+	}
+	return event
+}
+
+// certTypeOfKeyName returns the certificate type of an OCSP key name,
+// e.g. "autocert|example.com+rsa" and "managed|example.com".
+func certTypeOfKeyName(keyName string) int {
+	switch {
+	case strings.HasPrefix(keyName, "managed|"):
+		return Managed
+	case strings.HasPrefix(keyName, "internal_ca|"):
+		return InternalCA
+	case strings.HasPrefix(keyName, "self_signed|"):
+		return SelfSigned
+	}
+	return LetsEncrypt
+}
+
+// issuanceFailures records the last time an issuance failure event is
+// emitted for each key name.
+var issuanceFailures sync.Map // keyName -> time.Time
+
+// emitIssuanceFailed emits an issuance failure event, at most once per
+// 10 minutes for each key name, since a failed certificate may be
+// requested again and again by clients.
+func emitIssuanceFailed(keyName string, certType int, domains []string, err error) {
+	now := timeNow()
+	if last, ok := issuanceFailures.Load(keyName); ok && now.Sub(last.(time.Time)) < 10*time.Minute {
+		return
+	}
+	issuanceFailures.Store(keyName, now)
+	event := newCertEvent(EventIssuanceFailed, keyName, certType, nil)
+	event.Domains = domains
+	event.Error = err.Error()
+	Events.Emit(event)
+}
+
+// Events is the event bus of lifecycle events of certificates.
+var Events = &eventBus{}
+
+type eventBus struct {
+	mu       sync.RWMutex
+	handlers []func(*Event)
+}
+
+// Subscribe registers a handler which is called for each event emitted,
+// the handler must not block.
+func (b *eventBus) Subscribe(handler func(*Event)) {
+	b.mu.Lock()
+	b.handlers = append(b.handlers, handler)
+	b.mu.Unlock()
+}
+
+// replicatedEvents are emitted by every instance which observes the
+// same change of a certificate, they have IDs derived from the type and
+// fingerprint of the certificate, thus deduplicated in the outbox.
+var replicatedEvents = map[string]bool{
+	EventManagedReloaded: true,
+	EventOCSPRevoked:     true,
+}
+
+// eventID returns the ID of the event, it's random unless the event
+// is replicated.
+func eventID(event *Event) string {
+	if replicatedEvents[event.Type] && event.Fingerprint != "" {
+		sum := sha1.Sum([]byte(event.Type + "|" + event.Fingerprint))
+		return hex.EncodeToString(sum[:16])
+	}
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// Emit fills the ID, host and time of the event, and passes the event
+// to the handlers.
+func (b *eventBus) Emit(event *Event) {
+	event.ID = eventID(event)
+	event.Host, _ = os.Hostname()
+	event.Time = timeNow().Unix()
+	eventsLog.Info("event emitted", "type", event.Type, "key_name", event.KeyName, "id", event.ID)
+
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// StartEventWebhooks starts delivering events to the configured
+// webhooks, events are kept in an outbox in storage until delivered,
+// thus they survive restarts.
+//
+// The outbox is shared by all instances using the same storage, an
+// instance claims the due events before delivering them, and acks
+// them after delivered, claims of an instance which went away expire
+// after outboxClaimTTL. Updates of the outbox are serialized by
+// a storage lock.
+func StartEventWebhooks() {
+	if len(Cfg.EventWebhooks) == 0 {
+		return
+	}
+	outbox := newWebhookOutbox()
+	outbox.loadLegacy()
+	Events.Subscribe(outbox.enqueue)
+	go outbox.run()
+}
+
+// outboxItem is an event to be delivered to a webhook.
+type outboxItem struct {
+	Event    *Event `json:"event"`
+	URL      string `json:"url"`
+	Attempts int    `json:"attempts"`
+	NextAt   int64  `json:"next_at"` // seconds since epoch
+
+	ClaimedBy    string `json:"claimed_by,omitempty"`    // instance delivering the event
+	ClaimedUntil int64  `json:"claimed_until,omitempty"` // seconds since epoch
+}
+
+func (item *outboxItem) key() string { return item.Event.ID + "|" + item.URL }
+
+// outboxState is the outbox saved in storage.
+type outboxState struct {
+	Items []*outboxItem `json:"items"`
+
+	// Delivered records the replicated events delivered or dropped
+	// recently, thus the same event emitted later by other instances
+	// is not delivered again.
+	Delivered map[string]int64 `json:"delivered,omitempty"` // item key -> seconds since epoch
+}
+
+// outboxResult is the result of delivering a claimed item.
+type outboxResult struct {
+	done     bool // delivered or dropped
+	attempts int
+	nextAt   int64
+}
+
+// webhookOutbox delivers events to webhooks, the items are only
+// accessed by the run goroutine, events are passed to it by queue.
+type webhookOutbox struct {
+	key      string
+	instance string
+	queue    chan *Event
+
+	pending []*outboxItem // enqueued items not saved into storage yet
+}
+
+func newWebhookOutbox() *webhookOutbox {
+	var id [8]byte
+	rand.Read(id[:])
+	return &webhookOutbox{
+		key:      outboxStorageKey,
+		instance: hex.EncodeToString(id[:]),
+		queue:    make(chan *Event, outboxQueueSize),
+	}
+}
+
+// enqueue passes the event to the run goroutine, it doesn't block
+// the emitter.
+func (o *webhookOutbox) enqueue(event *Event) {
+	select {
+	case o.queue <- event:
+	default:
+		eventsLog.Error("outbox queue is full, dropped event", "type", event.Type, "id", event.ID)
+	}
+}
+
+func (o *webhookOutbox) run() {
+	for {
+		wait := o.deliver()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case event := <-o.queue:
+			timer.Stop()
+			o.addPending(event)
+		}
+	}
+}
+
+// addPending adds the event, and other events in the queue, to
+// the pending items of the webhooks which accept them.
+func (o *webhookOutbox) addPending(event *Event) {
+	for {
+		for _, hook := range Cfg.EventWebhooks {
+			if hook.accepts(event.Type) {
+				o.pending = append(o.pending, &outboxItem{Event: event, URL: hook.URL})
+			}
+		}
+		select {
+		case event = <-o.queue:
+		default:
+			return
+		}
+	}
+}
+
+// loadLegacy moves the events in the outbox of this host, which is used
+// by previous versions, into the shared outbox.
+func (o *webhookOutbox) loadLegacy() {
+	hostname, _ := os.Hostname()
+	legacyKey := "events+outbox+" + hostname
+	data, err := Cfg.Storage.Cache.Get(context.Background(), legacyKey)
+	if err != nil {
+		if err != autocert.ErrCacheMiss {
+			eventsLog.Warn("failed load outbox", "key", legacyKey, "err", err)
+		}
+		return
+	}
+	var items []*outboxItem
+	if err = json.Unmarshal(data, &items); err != nil {
+		eventsLog.Warn("failed load outbox", "key", legacyKey, "err", err)
+		return
+	}
+	o.pending = append(o.pending, items...)
+	if o.update(func(*outboxState) bool { return true }) == nil {
+		Cfg.Storage.Cache.Delete(context.Background(), legacyKey)
+	}
+}
+
+func (o *webhookOutbox) load() (*outboxState, error) {
+	state := &outboxState{}
+	data, err := Cfg.Storage.Cache.Get(context.Background(), o.key)
+	if err != nil {
+		if err == autocert.ErrCacheMiss {
+			err = nil
+		}
+		return state, err
+	}
+	err = json.Unmarshal(data, state)
+	return state, err
+}
+
+// update loads the outbox from storage, merges the pending items into
+// it, and applies fn, the outbox is saved if changed, fn tells whether
+// it changes the outbox. The pending items are cleared if saved.
+//
+// The outbox is locked during update if the storage supports locking,
+// thus updates by other instances are not lost.
+func (o *webhookOutbox) update(fn func(state *outboxState) bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), outboxLockTimeout)
+	defer cancel()
+	unlock, err := lockStorage(ctx, o.key, outboxLockTTL)
+	if err == nil {
+		defer unlock()
+	} else if err != ErrLockNotSupported {
+		eventsLog.Warn("failed lock outbox", "err", err)
+		return err
+	}
+
+	state, err := o.load()
+	if err != nil {
+		eventsLog.Warn("failed load outbox", "err", err)
+		return err
+	}
+	now := timeNow()
+	changed := len(o.pending) > 0
+	if state.Delivered == nil {
+		state.Delivered = make(map[string]int64)
+	}
+	for key, at := range state.Delivered {
+		if now.Sub(time.Unix(at, 0)) > outboxDeliveredTTL {
+			delete(state.Delivered, key)
+			changed = true
+		}
+	}
+	exists := make(map[string]bool, len(state.Items))
+	for _, item := range state.Items {
+		exists[item.key()] = true
+	}
+	for _, item := range o.pending {
+		key := item.key()
+		if exists[key] || state.Delivered[key] > 0 {
+			continue
+		}
+		exists[key] = true
+		state.Items = append(state.Items, item)
+	}
+	if n := len(state.Items) - outboxMaxItems; n > 0 {
+		eventsLog.Error("outbox is full, dropped oldest events", "count", n)
+		state.Items = state.Items[n:]
+	}
+	if fn(state) {
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = Cfg.Storage.Cache.Put(context.Background(), o.key, data)
+	}
+	if err != nil {
+		eventsLog.Warn("failed save outbox", "err", err)
+		return err
+	}
+	o.pending = nil
+	return nil
+}
+
+// claim claims the due items in order, items to a webhook wait for
+// the earlier ones which are not due or claimed by other instances,
+// to keep the order. It tells whether the outbox is changed.
+func (o *webhookOutbox) claim(state *outboxState) (claimed []*outboxItem, changed bool) {
+	now := timeNow().Unix()
+	blocked := make(map[string]bool)
+	remaining := state.Items[:0]
+	for _, item := range state.Items {
+		// drop events of webhooks no longer configured
+		if findEventWebhook(item.URL) == nil {
+			changed = true
+			continue
+		}
+		remaining = append(remaining, item)
+		if blocked[item.URL] {
+			continue
+		}
+		if item.NextAt > now || (item.ClaimedBy != o.instance && item.ClaimedUntil > now) {
+			blocked[item.URL] = true
+			continue
+		}
+		item.ClaimedBy = o.instance
+		item.ClaimedUntil = now + int64(outboxClaimTTL/time.Second)
+		claimed = append(claimed, item)
+		changed = true
+	}
+	state.Items = remaining
+	return claimed, changed
+}
+
+// nextWait returns the duration to wait until the first item to any
+// webhook is due or its claim expires.
+func nextWait(state *outboxState, now time.Time) time.Duration {
+	wait := outboxMaxBackoff
+	heads := make(map[string]bool)
+	for _, item := range state.Items {
+		if heads[item.URL] {
+			continue
+		}
+		heads[item.URL] = true
+		next := item.NextAt
+		if item.ClaimedUntil > next {
+			next = item.ClaimedUntil
+		}
+		if d := time.Unix(next, 0).Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// deliver delivers the due events in order, it returns the duration
+// to wait until the next event is due. Events to a webhook which failed
+// wait for the failed one to keep the order.
+func (o *webhookOutbox) deliver() time.Duration {
+	var claimed []*outboxItem
+	wait := outboxMaxBackoff
+	err := o.update(func(state *outboxState) (changed bool) {
+		claimed, changed = o.claim(state)
+		wait = nextWait(state, timeNow())
+		return changed
+	})
+	if err != nil {
+		return outboxMinBackoff
+	}
+	if len(claimed) == 0 {
+		return wait
+	}
+
+	results := make(map[string]outboxResult, len(claimed))
+	failed := make(map[string]bool)
+	for _, item := range claimed {
+		if failed[item.URL] {
+			continue
+		}
+		hook := findEventWebhook(item.URL)
+		err := postEvent(item.URL, hook.Secret, item.Event)
+		if err == nil {
+			results[item.key()] = outboxResult{done: true}
+			continue
+		}
+		attempts := item.Attempts + 1
+		if attempts >= outboxMaxAttempts {
+			eventsLog.Error("dropped event after retries", "url", item.URL, "type", item.Event.Type,
+				"id", item.Event.ID, "attempts", attempts, "err", err)
+			results[item.key()] = outboxResult{done: true}
+			continue
+		}
+		eventsLog.Warn("failed deliver event", "url", item.URL, "type", item.Event.Type,
+			"id", item.Event.ID, "attempts", attempts, "err", err)
+		results[item.key()] = outboxResult{
+			attempts: attempts,
+			nextAt:   timeNow().Add(outboxBackoff(attempts)).Unix(),
+		}
+		failed[item.URL] = true
+	}
+
+	err = o.update(func(state *outboxState) bool {
+		now := timeNow()
+		remaining := state.Items[:0]
+		for _, item := range state.Items {
+			if item.ClaimedBy == o.instance {
+				result, ok := results[item.key()]
+				if ok && result.done {
+					if replicatedEvents[item.Event.Type] {
+						state.Delivered[item.key()] = now.Unix()
+					}
+					continue
+				}
+				if ok {
+					item.Attempts, item.NextAt = result.attempts, result.nextAt
+				}
+				item.ClaimedBy, item.ClaimedUntil = "", 0
+			}
+			remaining = append(remaining, item)
+		}
+		state.Items = remaining
+		wait = nextWait(state, now)
+		return true
+	})
+	if err != nil {
+		return outboxMinBackoff
+	}
+	return wait
+}
+
+// outboxBackoff returns the duration to wait before retrying an event
+// failed attempts times.
+func outboxBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		return outboxMinBackoff
+	}
+	if attempts > 20 {
+		return outboxMaxBackoff
+	}
+	backoff := outboxMinBackoff << uint(attempts-1)
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+// postEvent posts the event as JSON to the webhook, the body is signed
+// by HMAC-SHA256 with the secret, same with the monitor webhooks.
+func postEvent(url string, secret string, event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", event.ID)
+	req.Header.Set("X-Event-Type", event.Type)
+	if secret != "" {
+		req.Header.Set("X-Signature-256", "sha256="+signPayload(secret, body))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type eventWebhookConfig struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Types  []string `yaml:"types"` // default: all types
+}
+
+func (p *eventWebhookConfig) accepts(typ string) bool {
+	if len(p.Types) == 0 {
+		return true
+	}
+	for _, t := range p.Types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func findEventWebhook(url string) *eventWebhookConfig {
+	for i := range Cfg.EventWebhooks {
+		if Cfg.EventWebhooks[i].URL == url {
+			return &Cfg.EventWebhooks[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alyx/x/autocert"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, outboxMinBackoff},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{6, 320 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{outboxMaxAttempts, time.Hour},
+		{64, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := outboxBackoff(tt.attempts); got != tt.want {
+			t.Errorf("outboxBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// setupOutboxTest configures a directory storage and the webhooks,
+// which are restored after the test.
+func setupOutboxTest(t *testing.T, urls ...string) {
+	oldCache, oldHooks := Cfg.Storage.Cache, Cfg.EventWebhooks
+	t.Cleanup(func() {
+		Cfg.Storage.Cache, Cfg.EventWebhooks = oldCache, oldHooks
+		timeNow = time.Now
+	})
+	Cfg.Storage.Cache = dirCache{autocert.DirCache(t.TempDir())}
+	Cfg.EventWebhooks = nil
+	for _, url := range urls {
+		Cfg.EventWebhooks = append(Cfg.EventWebhooks, eventWebhookConfig{URL: url})
+	}
+}
+
+func TestOutboxClaim(t *testing.T) {
+	setupOutboxTest(t, "http://a", "http://b")
+	now := time.Unix(1600000000, 0)
+	timeNow = func() time.Time { return now }
+
+	o := &webhookOutbox{instance: "self"}
+	item := func(id, url string, nextAt int64, claimedBy string, claimedUntil int64) *outboxItem {
+		return &outboxItem{Event: &Event{ID: id}, URL: url, NextAt: nextAt,
+			ClaimedBy: claimedBy, ClaimedUntil: claimedUntil}
+	}
+	state := &outboxState{Items: []*outboxItem{
+		item("1", "http://a", 0, "", 0),
+		item("2", "http://a", now.Unix()+10, "", 0), // not due, blocks 3
+		item("3", "http://a", 0, "", 0),
+		item("4", "http://b", 0, "other", now.Unix()+10), // claimed by other, blocks 5
+		item("5", "http://b", 0, "", 0),
+		item("6", "http://c", 0, "", 0), // webhook not configured
+	}}
+	claimed, changed := o.claim(state)
+	if !changed || len(claimed) != 1 || claimed[0].Event.ID != "1" {
+		t.Fatalf("claim = %v, %v, want item 1 claimed", claimed, changed)
+	}
+	if claimed[0].ClaimedBy != "self" || claimed[0].ClaimedUntil != now.Add(outboxClaimTTL).Unix() {
+		t.Errorf("claimed item = %+v", claimed[0])
+	}
+	if len(state.Items) != 5 {
+		t.Errorf("got %d items, want the unconfigured webhook dropped", len(state.Items))
+	}
+
+	// claims of self are claimed again, expired claims of others are taken over
+	now = now.Add(20 * time.Second)
+	claimed, _ = o.claim(state)
+	var ids []string
+	for _, item := range claimed {
+		ids = append(ids, item.Event.ID)
+	}
+	if got := strings.Join(ids, ","); got != "1,2,3,4,5" {
+		t.Errorf("claimed %s, want 1,2,3,4,5", got)
+	}
+}
+
+func TestOutboxDeliver(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string]int)
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received[r.Header.Get("X-Event-ID")]++
+	}))
+	defer srv.Close()
+	setupOutboxTest(t, srv.URL)
+
+	o1, o2 := newWebhookOutbox(), newWebhookOutbox()
+	replicated := &Event{ID: "r1", Type: EventManagedReloaded}
+	normal := &Event{ID: "n1", Type: EventIssued}
+
+	// the same replicated event emitted by both instances is delivered once
+	o1.addPending(replicated)
+	o2.addPending(replicated)
+	o1.deliver()
+	o2.deliver()
+	if received["r1"] != 1 {
+		t.Fatalf("replicated event delivered %d times, want 1", received["r1"])
+	}
+	state, err := o1.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := (&outboxItem{Event: replicated, URL: srv.URL}).key()
+	if len(state.Items) != 0 || state.Delivered[key] == 0 {
+		t.Fatalf("outbox after delivered = %+v", state)
+	}
+
+	// a replicated event emitted again later is skipped
+	o2.addPending(replicated)
+	o2.deliver()
+	if received["r1"] != 1 {
+		t.Errorf("delivered replicated event is delivered again")
+	}
+
+	// a failed event is kept with a backoff, and the claim is released
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	o1.addPending(normal)
+	o1.deliver()
+	state, _ = o1.load()
+	if len(state.Items) != 1 {
+		t.Fatalf("got %d items after failed, want 1", len(state.Items))
+	}
+	if item := state.Items[0]; item.Attempts != 1 || item.NextAt <= timeNow().Unix() || item.ClaimedBy != "" {
+		t.Errorf("failed item = %+v", item)
+	}
+
+	// acked after delivered, non-replicated events are not recorded
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	later := timeNow().Add(outboxMaxBackoff)
+	timeNow = func() time.Time { return later }
+	o2.deliver()
+	state, _ = o1.load()
+	if received["n1"] != 1 || len(state.Items) != 0 {
+		t.Errorf("received %d, items %d, want delivered and acked", received["n1"], len(state.Items))
+	}
+	if _, ok := state.Delivered[(&outboxItem{Event: normal, URL: srv.URL}).key()]; ok {
+		t.Errorf("non-replicated event is recorded as delivered")
+	}
+}
+
+func TestOutboxConcurrentUpdate(t *testing.T) {
+	setupOutboxTest(t, "http://a")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			o := newWebhookOutbox()
+			for j := 0; j < 10; j++ {
+				o.addPending(&Event{ID: fmt.Sprintf("%d-%d", i, j), Type: EventIssued})
+				if err := o.update(func(*outboxState) bool { return false }); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	state, err := newWebhookOutbox().load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Items) != 160 {
+		t.Errorf("got %d items, want 160", len(state.Items))
+	}
+}
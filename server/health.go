@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	healthCheckTimeout = 5 * time.Second
+
+	// a reachable ACME directory is not requested again within
+	// directoryCheckInterval, and an unreachable directory is considered
+	// ok if it has been reachable within directoryRecentlyReachable
+	directoryCheckInterval     = time.Minute
+	directoryRecentlyReachable = 10 * time.Minute
+)
+
+// Status of health checks.
+const (
+	HealthOK   = "ok"
+	HealthWarn = "warn"
+	HealthFail = "fail"
+)
+
+var directoryReachable sync.Map // issuer name -> time.Time
+
+type HealthCheck struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms,omitempty"`
+	CheckedAt int64  `json:"checked_at,omitempty"` // seconds since epoch
+
+	Expiring []*ExpiringCertificate `json:"expiring,omitempty"`
+}
+
+type ExpiringCertificate struct {
+	KeyName  string   `json:"key_name"`
+	Domains  []string `json:"domains"`
+	NotAfter int64    `json:"not_after"` // seconds since epoch
+}
+
+// HandleHealthz tells that the process is alive.
+func (m *Manager) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": HealthOK})
+}
+
+// HandleReadyz tells whether the server is ready to serve requests.
+//
+// It checks that the storage works by a Put/Get/Delete round trip, and
+// that ACME directory of at least one issuer is reachable, or has been
+// reachable recently. Certificates being served which are going to
+// expire within "health.expiry_days" are reported as a warning, they
+// don't make the server not ready, since restarting it doesn't help.
+//
+// Possible responses are:
+// - 200 the storage and issuer checks are ok
+// - 503 some check failed
+// The body is a JSON object with details of each check.
+func (m *Manager) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	checks := make(map[string]*HealthCheck)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	addCheck := func(name string, check func(ctx context.Context) *HealthCheck) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := check(ctx)
+			mu.Lock()
+			checks[name] = result
+			mu.Unlock()
+		}()
+	}
+	addCheck("storage", checkStorage)
+	for _, iss := range m.issuers {
+		iss := iss
+		addCheck("issuer:"+iss.Name, func(ctx context.Context) *HealthCheck {
+			return checkDirectory(ctx, iss)
+		})
+	}
+	addCheck("certificates", func(context.Context) *HealthCheck {
+		return checkExpiringCertificates()
+	})
+	wg.Wait()
+
+	status := HealthOK
+	if checks["storage"].Status != HealthOK {
+		status = HealthFail
+	}
+	// fallback issuers take over when the primary one is unreachable
+	issuerOK := false
+	for _, iss := range m.issuers {
+		if checks["issuer:"+iss.Name].Status == HealthOK {
+			issuerOK = true
+		}
+	}
+	if !issuerOK {
+		status = HealthFail
+	}
+
+	if status != HealthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, struct {
+		Status string                  `json:"status"`
+		Checks map[string]*HealthCheck `json:"checks"`
+		Time   int64                   `json:"time"`
+	}{
+		Status: status,
+		Checks: checks,
+		Time:   timeNow().Unix(),
+	})
+}
+
+func healthCheckKey() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("healthcheck+%s-%d", hostname, os.Getpid())
+}
+
+// checkStorage checks that the storage can be written and read back.
+func checkStorage(ctx context.Context) *HealthCheck {
+	start := time.Now()
+	key := healthCheckKey()
+	data := []byte(strconv.FormatInt(start.UnixNano(), 10))
+	err := Cfg.Storage.Cache.Put(ctx, key, data)
+	if err == nil {
+		var got []byte
+		got, err = Cfg.Storage.Cache.Get(ctx, key)
+		if err == nil && !bytes.Equal(got, data) {
+			err = fmt.Errorf("data read back mismatch")
+		}
+		_ = Cfg.Storage.Cache.Delete(ctx, key)
+	}
+	check := &HealthCheck{
+		Status:    HealthOK,
+		LatencyMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		check.Status = HealthFail
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// checkDirectory checks that the ACME directory of the issuer is
+// reachable, the result is cached for a while if it succeeds.
+func checkDirectory(ctx context.Context, iss *issuer) *HealthCheck {
+	if x, ok := directoryReachable.Load(iss.Name); ok {
+		if at := x.(time.Time); timeNow().Sub(at) < directoryCheckInterval {
+			return &HealthCheck{Status: HealthOK, CheckedAt: at.Unix()}
+		}
+	}
+	start := time.Now()
+	err := func() error {
+		req, err := http.NewRequest("GET", iss.DirectoryURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	}()
+	now := timeNow()
+	check := &HealthCheck{
+		Status:    HealthOK,
+		LatencyMS: time.Since(start).Milliseconds(),
+		CheckedAt: now.Unix(),
+	}
+	if err != nil {
+		check.Status = HealthFail
+		check.Error = err.Error()
+		// still ok if it has been reachable recently
+		if x, ok := directoryReachable.Load(iss.Name); ok {
+			if at := x.(time.Time); now.Sub(at) < directoryRecentlyReachable {
+				check.Status = HealthOK
+				check.CheckedAt = at.Unix()
+			}
+		}
+		return check
+	}
+	directoryReachable.Store(iss.Name, now)
+	return check
+}
+
+// checkExpiringCertificates reports certificates being served which are
+// going to expire within the configured days as a warning.
+func checkExpiringCertificates() *HealthCheck {
+	deadline := timeNow().Add(time.Duration(Cfg.Health.ExpiryDays) * 24 * time.Hour)
+	check := &HealthCheck{Status: HealthOK}
+	for keyName := range OCSPManager.getCertMap() {
+		state, ok := OCSPManager.lookupState(keyName)
+		if !ok {
+			continue
+		}
+		leaf := state.cert.Leaf
+		if leaf.NotAfter.Before(deadline) {
+			check.Expiring = append(check.Expiring, &ExpiringCertificate{
+				KeyName:  keyName,
+				Domains:  leaf.DNSNames,
+				NotAfter: leaf.NotAfter.Unix(),
+			})
+		}
+	}
+	if len(check.Expiring) > 0 {
+		sort.Slice(check.Expiring, func(i, j int) bool { return check.Expiring[i].KeyName < check.Expiring[j].KeyName })
+		check.Status = HealthWarn
+		check.Error = fmt.Sprintf("%d certificates expire within %d days", len(check.Expiring), Cfg.Health.ExpiryDays)
+	}
+	return check
+}
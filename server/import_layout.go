@@ -0,0 +1,636 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alyx/x/autocert"
+)
+
+// Importing certificates and ACME accounts from the storage of other
+// ACME clients. The certificates are saved in the format of autocert,
+// thus they are served and renewed as if they were issued by this server.
+
+// Storage layouts which can be imported.
+const (
+	LayoutCertbot = "certbot"
+	LayoutAcmeSh  = "acme.sh"
+	LayoutCaddy   = "caddy"
+)
+
+// LayoutImportOptions tells what to import from a storage layout.
+type LayoutImportOptions struct {
+	Layout    string
+	Dir       string // default: the default directory of the layout
+	Account   bool   // import the ACME account key
+	Issuer    string // issuer to import the account for, default: the primary issuer
+	Overwrite bool   // overwrite existing certificates and account key
+	DryRun    bool
+}
+
+// LayoutImportResult reports a certificate or an account key found in the
+// storage layout, Skipped tells why it is not imported.
+type LayoutImportResult struct {
+	Source   string
+	Kind     string // "certificate" or "account"
+	Domain   string // issuer name for account
+	Key      string // storage key
+	NotAfter time.Time
+	Skipped  string
+}
+
+// DefaultLayoutDir returns the default directory of the storage layout.
+func DefaultLayoutDir(layout string) (string, error) {
+	home, _ := os.UserHomeDir()
+	switch layout {
+	case LayoutCertbot:
+		return "/etc/letsencrypt", nil
+	case LayoutAcmeSh:
+		return filepath.Join(home, ".acme.sh"), nil
+	case LayoutCaddy:
+		if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+			return filepath.Join(dir, "caddy"), nil
+		}
+		return filepath.Join(home, ".local", "share", "caddy"), nil
+	}
+	return "", fmt.Errorf("unknown layout %q", layout)
+}
+
+// layoutCert is a certificate found in a storage layout.
+type layoutCert struct {
+	source    string
+	directory string // normalized ACME directory, empty if unknown
+	data      []byte // private key and certificates in PEM format
+}
+
+// layoutAccount is an ACME account key found in a storage layout.
+type layoutAccount struct {
+	source    string
+	directory string
+	key       crypto.Signer
+}
+
+// ImportLayout imports the certificates, and optionally the ACME account
+// key, from the storage of certbot, acme.sh or Caddy.
+//
+// A certificate is saved under the key of each name it covers, names which
+// are wildcard, managed or not permitted by the host policy are skipped.
+// Certificates issued by an ACME directory which is not a configured
+// issuer are skipped, e.g. staging certificates.
+func (m *Manager) ImportLayout(ctx context.Context, opts LayoutImportOptions) ([]*LayoutImportResult, error) {
+	if opts.Dir == "" {
+		dir, err := DefaultLayoutDir(opts.Layout)
+		if err != nil {
+			return nil, err
+		}
+		opts.Dir = dir
+	}
+	if _, err := os.Stat(opts.Dir); err != nil {
+		return nil, err
+	}
+	var certs []*layoutCert
+	var accounts []*layoutAccount
+	var err error
+	switch opts.Layout {
+	case LayoutCertbot:
+		certs, accounts, err = scanCertbot(opts.Dir)
+	case LayoutAcmeSh:
+		certs, accounts, err = scanAcmeSh(opts.Dir)
+	case LayoutCaddy:
+		certs, accounts, err = scanCaddy(opts.Dir)
+	default:
+		err = fmt.Errorf("unknown layout %q", opts.Layout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := m.importLayoutCerts(ctx, certs, opts)
+	if err != nil {
+		return results, err
+	}
+	if opts.Account {
+		accountResults, err := m.importLayoutAccount(ctx, accounts, opts)
+		results = append(results, accountResults...)
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+func (m *Manager) importLayoutCerts(ctx context.Context, certs []*layoutCert, opts LayoutImportOptions) ([]*LayoutImportResult, error) {
+	type candidate struct {
+		result   *LayoutImportResult
+		data     []byte
+		iss      *issuer
+		issuedAt int64
+	}
+	var results []*LayoutImportResult
+	chosen := make(map[string]*candidate)
+	now := timeNow()
+	for _, x := range certs {
+		cert, err := parseKeyPair(x.data)
+		if err != nil {
+			results = append(results, &LayoutImportResult{Source: x.source, Kind: "certificate", Skipped: err.Error()})
+			continue
+		}
+		leaf := cert.Leaf
+		skip := ""
+		var iss *issuer
+		if x.directory != "" {
+			if iss = m.issuerOfDirectory(x.directory); iss == nil {
+				skip = fmt.Sprintf("issued by %s which is not a configured issuer", x.directory)
+			}
+		}
+		if now.After(leaf.NotAfter) {
+			skip = "expired"
+		}
+		var keyType string
+		switch leaf.PublicKey.(type) {
+		case *ecdsa.PublicKey:
+			keyType = KeyTypeECDSA
+		case *rsa.PublicKey:
+			keyType = KeyTypeRSA
+		default:
+			skip = fmt.Sprintf("unsupported key algorithm %s", leaf.PublicKeyAlgorithm)
+		}
+		var data bytes.Buffer
+		if skip == "" {
+			if err = EncodePrivateKey(&data, cert.PrivateKey); err != nil {
+				return results, fmt.Errorf("%s: encode private key: %v", x.source, err)
+			}
+			for _, b := range cert.Certificate {
+				pem.Encode(&data, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+			}
+		}
+
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			result := &LayoutImportResult{
+				Source:   x.source,
+				Kind:     "certificate",
+				Domain:   name,
+				NotAfter: leaf.NotAfter,
+				Skipped:  skip,
+			}
+			results = append(results, result)
+			if skip != "" {
+				continue
+			}
+			if result.Skipped = m.checkLayoutName(ctx, name); result.Skipped != "" {
+				continue
+			}
+			result.Key = m.KeyName(name, keyType)
+			// a domain may have several certificates, e.g. certbot lineages
+			// "example.com" and "example.com-0001", the latest one wins
+			if old := chosen[result.Key]; old != nil {
+				if !leaf.NotAfter.After(old.result.NotAfter) {
+					result.Skipped = "superseded by " + old.result.Source
+					continue
+				}
+				old.result.Skipped = "superseded by " + x.source
+			}
+			chosen[result.Key] = &candidate{result: result, data: data.Bytes(), iss: iss, issuedAt: leaf.NotBefore.Unix()}
+		}
+	}
+
+	keys := make([]string, 0, len(chosen))
+	for key := range chosen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		x := chosen[key]
+		old, err := Cfg.Storage.Cache.Get(ctx, key)
+		if err != nil && err != autocert.ErrCacheMiss {
+			return results, fmt.Errorf("%s: %v", key, err)
+		}
+		if err == nil {
+			if bytes.Equal(old, x.data) {
+				x.result.Skipped = "already imported"
+				continue
+			}
+			if !opts.Overwrite {
+				x.result.Skipped = "key exists"
+				continue
+			}
+		}
+		if opts.DryRun {
+			continue
+		}
+		if err = Cfg.Storage.Cache.Put(ctx, key, x.data); err != nil {
+			return results, fmt.Errorf("%s: %v", key, err)
+		}
+		if x.iss != nil {
+			meta := &certMeta{
+				Issuer:       x.iss.Name,
+				DirectoryURL: x.iss.DirectoryURL,
+				IssuedAt:     x.issuedAt,
+			}
+			err = putCertMeta(ctx, key, meta)
+		} else {
+			err = Cfg.Storage.Cache.Delete(ctx, key+certMetaSuffix)
+		}
+		if err != nil {
+			return results, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return results, nil
+}
+
+// checkLayoutName tells why a certificate should not be imported for
+// name, or returns an empty string.
+func (m *Manager) checkLayoutName(ctx context.Context, name string) string {
+	if strings.HasPrefix(name, "*.") {
+		return "wildcard names are not supported"
+	}
+	for _, x := range Cfg.Managed {
+		if x.Regex.MatchString(name) {
+			return fmt.Sprintf("served by managed certificate %q", x.CertKey)
+		}
+	}
+	if err := m.autocertManager().HostPolicy(ctx, name); err != nil {
+		return fmt.Sprintf("not permitted by lets_encrypt host policy: %v", err)
+	}
+	return ""
+}
+
+func (m *Manager) importLayoutAccount(ctx context.Context, accounts []*layoutAccount, opts LayoutImportOptions) ([]*LayoutImportResult, error) {
+	iss, err := m.getIssuer(opts.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	var results []*LayoutImportResult
+	var chosen *LayoutImportResult
+	var keyPEM bytes.Buffer
+	for _, x := range accounts {
+		result := &LayoutImportResult{Source: x.source, Kind: "account", Domain: iss.Name}
+		results = append(results, result)
+		if x.directory != directoryKey(iss.DirectoryURL) {
+			result.Skipped = fmt.Sprintf("account of %s, not issuer %s", x.directory, iss.Name)
+			continue
+		}
+		if chosen != nil {
+			return results, fmt.Errorf("multiple accounts found for issuer %s: %s, %s", iss.Name, chosen.Source, x.source)
+		}
+		if err = EncodePrivateKey(&keyPEM, x.key); err != nil {
+			return results, fmt.Errorf("%s: encode account key: %v", x.source, err)
+		}
+		result.Key = iss.cache.accountKeyName
+		chosen = result
+	}
+	if chosen == nil {
+		results = append(results, &LayoutImportResult{
+			Kind:    "account",
+			Domain:  iss.Name,
+			Skipped: fmt.Sprintf("no account found for %s", iss.DirectoryURL),
+		})
+		return results, nil
+	}
+
+	old, err := iss.cache.Get(ctx, acmeAccountKeyName)
+	if err != nil && err != autocert.ErrCacheMiss {
+		return results, err
+	}
+	if err == nil {
+		oldKey, _ := parsePrivateKeyPEM(old)
+		if oldKey != nil && publicKeyEqual(oldKey.Public(), accountPublicKey(keyPEM.Bytes())) {
+			chosen.Skipped = "already imported"
+			return results, nil
+		}
+		if !opts.Overwrite {
+			chosen.Skipped = "account key exists"
+			return results, nil
+		}
+	}
+	if opts.DryRun {
+		return results, nil
+	}
+	if err = iss.cache.Put(ctx, acmeAccountKeyName, keyPEM.Bytes()); err != nil {
+		return results, fmt.Errorf("save account key: %v", err)
+	}
+	return results, nil
+}
+
+func accountPublicKey(keyPEM []byte) crypto.PublicKey {
+	key, err := parsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil
+	}
+	return key.Public()
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	x, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && b != nil && x.Equal(b)
+}
+
+// issuerOfDirectory returns the configured issuer of the normalized ACME
+// directory, or nil.
+func (m *Manager) issuerOfDirectory(directory string) *issuer {
+	for _, iss := range m.issuers {
+		if directoryKey(iss.DirectoryURL) == directory {
+			return iss
+		}
+	}
+	return nil
+}
+
+// directoryKey normalizes an ACME directory URL or path in the same form
+// as Caddy names its storage, e.g. "acme-v02.api.letsencrypt.org-directory".
+func directoryKey(directory string) string {
+	if i := strings.Index(directory, "://"); i >= 0 {
+		directory = directory[i+3:]
+	}
+	directory = strings.Trim(filepath.ToSlash(directory), "/")
+	return strings.ToLower(strings.Replace(directory, "/", "-", -1))
+}
+
+func readLayoutCert(source, directory, certFile, keyFile string) (*layoutCert, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	data := append(append(keyPEM, '\n'), certPEM...)
+	return &layoutCert{source: source, directory: directory, data: data}, nil
+}
+
+func readLayoutAccount(source, directory, keyFile string) (*layoutAccount, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var key crypto.Signer
+	if strings.HasSuffix(keyFile, ".json") {
+		key, err = parseJWK(data)
+	} else {
+		key, err = parsePrivateKeyPEM(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keyFile, err)
+	}
+	return &layoutAccount{source: source, directory: directory, key: key}, nil
+}
+
+// scanCertbot finds certificates in "live/<name>/" and accounts in
+// "accounts/<directory>/<id>/private_key.json", the ACME directory of
+// a certificate is read from "renewal/<name>.conf".
+func scanCertbot(dir string) ([]*layoutCert, []*layoutAccount, error) {
+	var certs []*layoutCert
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "live"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, fi := range entries {
+		// fi is the symlink itself for linked directories
+		liveDir := filepath.Join(dir, "live", fi.Name())
+		if st, err := os.Stat(liveDir); err != nil || !st.IsDir() {
+			continue
+		}
+		directory := readConfValue(filepath.Join(dir, "renewal", fi.Name()+".conf"), "server")
+		cert, err := readLayoutCert(liveDir, directoryKey(directory),
+			filepath.Join(liveDir, "fullchain.pem"), filepath.Join(liveDir, "privkey.pem"))
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	var accounts []*layoutAccount
+	accountsDir := filepath.Join(dir, "accounts")
+	err = filepath.Walk(accountsDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == accountsDir {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || fi.Name() != "private_key.json" {
+			return nil
+		}
+		// accounts/acme-v02.api.letsencrypt.org/directory/<id>/private_key.json
+		rel, _ := filepath.Rel(accountsDir, filepath.Dir(filepath.Dir(path)))
+		account, err := readLayoutAccount(filepath.Dir(path), directoryKey(rel), path)
+		if err != nil {
+			return err
+		}
+		accounts = append(accounts, account)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return certs, accounts, nil
+}
+
+// scanAcmeSh finds certificates in "<domain>/" and "<domain>_ecc/",
+// and accounts in "ca/<directory>/account.key", the ACME directory of
+// a certificate is read from "<domain>.conf".
+func scanAcmeSh(dir string) ([]*layoutCert, []*layoutAccount, error) {
+	var certs []*layoutCert
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, fi := range entries {
+		if !fi.IsDir() {
+			continue
+		}
+		certDir := filepath.Join(dir, fi.Name())
+		domain := strings.TrimSuffix(fi.Name(), "_ecc")
+		confFile := filepath.Join(certDir, domain+".conf")
+		if _, err := os.Stat(confFile); err != nil {
+			continue // not a certificate directory, e.g. "ca", "deploy"
+		}
+		certFile := filepath.Join(certDir, "fullchain.cer")
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			continue // not issued yet
+		}
+		directory := readConfValue(confFile, "Le_API")
+		cert, err := readLayoutCert(certDir, directoryKey(directory), certFile, filepath.Join(certDir, domain+".key"))
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	var accounts []*layoutAccount
+	caDir := filepath.Join(dir, "ca")
+	err = filepath.Walk(caDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == caDir {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || fi.Name() != "account.key" {
+			return nil
+		}
+		// ca/acme-v02.api.letsencrypt.org/directory/account.key
+		rel, _ := filepath.Rel(caDir, filepath.Dir(path))
+		account, err := readLayoutAccount(filepath.Dir(path), directoryKey(rel), path)
+		if err != nil {
+			return err
+		}
+		accounts = append(accounts, account)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return certs, accounts, nil
+}
+
+// scanCaddy finds certificates in "certificates/<directory>/<name>/"
+// and accounts in "acme/<directory>/users/<email>/<name>.key".
+func scanCaddy(dir string) ([]*layoutCert, []*layoutAccount, error) {
+	var certs []*layoutCert
+	certsDir := filepath.Join(dir, "certificates")
+	issuerDirs, err := ioutil.ReadDir(certsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, issuerDir := range issuerDirs {
+		if !issuerDir.IsDir() {
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(certsDir, issuerDir.Name(), "*", "*.crt"))
+		for _, certFile := range matches {
+			keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+			cert, err := readLayoutCert(filepath.Dir(certFile), directoryKey(issuerDir.Name()), certFile, keyFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+
+	var accounts []*layoutAccount
+	matches, _ := filepath.Glob(filepath.Join(dir, "acme", "*", "users", "*", "*.key"))
+	for _, keyFile := range matches {
+		userDir := filepath.Dir(keyFile)
+		directory := filepath.Base(filepath.Dir(filepath.Dir(userDir)))
+		account, err := readLayoutAccount(userDir, directoryKey(directory), keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return certs, accounts, nil
+}
+
+// readConfValue reads the value of name from a "name = value" style
+// configuration file, quotes around the value are removed.
+func readConfValue(file string, name string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.IndexByte(line, '=')
+		if i < 0 || strings.TrimSpace(line[:i]) != name {
+			continue
+		}
+		return strings.Trim(strings.TrimSpace(line[i+1:]), `'"`)
+	}
+	return ""
+}
+
+// parseJWK parses a private key in JSON Web Key format, which certbot
+// uses to store account keys.
+func parseJWK(data []byte) (crypto.Signer, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		D   string `json:"d"`
+		P   string `json:"p"`
+		Q   string `json:"q"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, fmt.Errorf("invalid JWK: %v", err)
+	}
+	var err error
+	num := func(s string) *big.Int {
+		b, e := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		if e != nil || len(b) == 0 {
+			err = errors.New("invalid JWK: bad key parameter")
+			return new(big.Int)
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	switch jwk.Kty {
+	case "RSA":
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: num(jwk.N), E: int(num(jwk.E).Int64())},
+			D:         num(jwk.D),
+			Primes:    []*big.Int{num(jwk.P), num(jwk.Q)},
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = key.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid JWK: %v", err)
+		}
+		key.Precompute()
+		return key, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("invalid JWK: unsupported curve %q", jwk.Crv)
+		}
+		key := &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: curve, X: num(jwk.X), Y: num(jwk.Y)},
+			D:         num(jwk.D),
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid JWK: point not on curve")
+		}
+		if x, y := curve.ScalarBaseMult(key.D.Bytes()); x.Cmp(key.X) != 0 || y.Cmp(key.Y) != 0 {
+			return nil, errors.New("invalid JWK: private key doesn't match public key")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid JWK: unsupported key type %q", jwk.Kty)
+}
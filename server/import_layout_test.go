@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+func TestDirectoryKey(t *testing.T) {
+	tests := []struct {
+		directory string
+		want      string
+	}{
+		{"https://acme-v02.api.letsencrypt.org/directory", "acme-v02.api.letsencrypt.org-directory"},
+		{"https://acme-staging-v02.api.letsencrypt.org/directory/", "acme-staging-v02.api.letsencrypt.org-directory"},
+		{"acme-v02.api.letsencrypt.org-directory", "acme-v02.api.letsencrypt.org-directory"},
+		{"acme-v02.api.letsencrypt.org/directory", "acme-v02.api.letsencrypt.org-directory"},
+		{"https://ACME.Example.COM/acme/dir", "acme.example.com-acme-dir"},
+		{"http://localhost:14000/dir", "localhost:14000-dir"},
+		{"/acme.zerossl.com/v2/DV90/", "acme.zerossl.com-v2-dv90"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := directoryKey(tt.directory); got != tt.want {
+			t.Errorf("directoryKey(%q) = %q, want %q", tt.directory, got, tt.want)
+		}
+	}
+}
+
+func TestParseJWK(t *testing.T) {
+	b64 := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaJWK := map[string]string{
+		"kty": "RSA",
+		"n":   b64(rsaKey.N),
+		"e":   b64(big.NewInt(int64(rsaKey.E))),
+		"d":   b64(rsaKey.D),
+		"p":   b64(rsaKey.Primes[0]),
+		"q":   b64(rsaKey.Primes[1]),
+	}
+	ecJWK := func(key *ecdsa.PrivateKey, crv string) map[string]string {
+		return map[string]string{
+			"kty": "EC",
+			"crv": crv,
+			"x":   b64(key.X),
+			"y":   b64(key.Y),
+			"d":   b64(key.D),
+		}
+	}
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	with := func(jwk map[string]string, k, v string) map[string]string {
+		out := make(map[string]string, len(jwk))
+		for key, val := range jwk {
+			out[key] = val
+		}
+		if v == "" {
+			delete(out, k)
+		} else {
+			out[k] = v
+		}
+		return out
+	}
+
+	tests := []struct {
+		name string
+		jwk  map[string]string
+		want crypto.Signer // nil if error is wanted
+	}{
+		{"rsa", rsaJWK, rsaKey},
+		{"rsa padded", with(rsaJWK, "e", b64(big.NewInt(int64(rsaKey.E)))+"="), rsaKey},
+		{"rsa wrong d", with(rsaJWK, "d", b64(big.NewInt(12345))), nil},
+		{"rsa missing q", with(rsaJWK, "q", ""), nil},
+		{"p-256", ecJWK(p256Key, "P-256"), p256Key},
+		{"p-384", ecJWK(p384Key, "P-384"), p384Key},
+		{"ec wrong curve", ecJWK(p256Key, "P-384"), nil},
+		{"ec unsupported curve", ecJWK(p256Key, "secp256k1"), nil},
+		{"ec wrong d", with(ecJWK(p256Key, "P-256"), "d", b64(otherKey.D)), nil},
+		{"ec not on curve", with(ecJWK(p256Key, "P-256"), "y", b64(otherKey.Y)), nil},
+		{"ec bad base64", with(ecJWK(p256Key, "P-256"), "x", "!!!"), nil},
+		{"ec missing d", with(ecJWK(p256Key, "P-256"), "d", ""), nil},
+		{"unsupported kty", map[string]string{"kty": "oct", "k": "c2VjcmV0"}, nil},
+	}
+	for _, tt := range tests {
+		data, _ := json.Marshal(tt.jwk)
+		got, err := parseJWK(data)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: parseJWK succeeded, want error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseJWK error = %v", tt.name, err)
+			continue
+		}
+		if !got.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(tt.want.Public()) {
+			t.Errorf("%s: parseJWK returned a different key", tt.name)
+		}
+	}
+
+	if _, err := parseJWK([]byte("not json")); err == nil {
+		t.Errorf("parseJWK(invalid json) succeeded, want error")
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Alert types
+const (
+	AlertOCSPRevoked   = "ocsp_revoked"
+	AlertOCSPUnknown   = "ocsp_unknown"
+	AlertReissueFailed = "reissue_failed"
+)
+
+// Alert is a problem of a certificate which needs attention.
+type Alert struct {
+	KeyName string `json:"key_name"`
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	Time    int64  `json:"time"` // seconds since epoch
+}
+
+// Inventory keeps alerts of the certificates being served.
+var Inventory = &inventory{alerts: make(map[string]map[string]*Alert)}
+
+type inventory struct {
+	mu       sync.RWMutex
+	alerts   map[string]map[string]*Alert // key name -> alert type -> alert
+	onChange func()
+}
+
+// setOnChange sets a function which is called when an alert is raised
+// or resolved, the function must not block.
+func (inv *inventory) setOnChange(fn func()) {
+	inv.mu.Lock()
+	inv.onChange = fn
+	inv.mu.Unlock()
+}
+
+// RaiseAlert raises an alert for the certificate, the alert is logged
+// only when it's newly raised or the message changes, in which case
+// it returns true.
+func (inv *inventory) RaiseAlert(keyName string, typ string, format string, args ...interface{}) bool {
+	msg := fmt.Sprintf(format, args...)
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	alerts := inv.alerts[keyName]
+	if alerts == nil {
+		alerts = make(map[string]*Alert)
+		inv.alerts[keyName] = alerts
+	}
+	if old := alerts[typ]; old != nil && old.Message == msg {
+		return false
+	}
+	alerts[typ] = &Alert{
+		KeyName: keyName,
+		Type:    typ,
+		Message: msg,
+		Time:    timeNow().Unix(),
+	}
+	inventoryLog.Error("alert raised", "key_name", keyName, "type", typ, "message", msg)
+	if inv.onChange != nil {
+		inv.onChange()
+	}
+	return true
+}
+
+// ResolveAlert removes the alert of the given type for the certificate,
+// if types is empty, all alerts for the certificate are removed.
+func (inv *inventory) ResolveAlert(keyName string, types ...string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	alerts := inv.alerts[keyName]
+	if len(alerts) == 0 {
+		return
+	}
+	if len(types) == 0 {
+		for typ := range alerts {
+			types = append(types, typ)
+		}
+	}
+	for _, typ := range types {
+		if alerts[typ] != nil {
+			delete(alerts, typ)
+			inventoryLog.Info("alert resolved", "key_name", keyName, "type", typ)
+			if inv.onChange != nil {
+				inv.onChange()
+			}
+		}
+	}
+	if len(alerts) == 0 {
+		delete(inv.alerts, keyName)
+	}
+}
+
+// Alerts returns the alerts of a certificate, or all alerts if keyName
+// is empty, sorted by key name and type.
+func (inv *inventory) Alerts(keyName string) []*Alert {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	var out []*Alert
+	for name, alerts := range inv.alerts {
+		if keyName != "" && name != keyName {
+			continue
+		}
+		for _, alert := range alerts {
+			out = append(out, alert)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].KeyName != out[j].KeyName {
+			return out[i].KeyName < out[j].KeyName
+		}
+		return out[i].Type < out[j].Type
+	})
+	return out
+}
+
+// InventoryItem describes a certificate being served.
+type InventoryItem struct {
+	KeyName        string   `json:"key_name"`
+	Domains        []string `json:"domains"`
+	Fingerprint    string   `json:"fingerprint"`
+	NotAfter       int64    `json:"not_after"` // seconds since epoch
+	OCSPStatus     string   `json:"ocsp_status"`
+	StatusSource   string   `json:"status_source,omitempty"`    // "ocsp" or "crl"
+	OCSPNextUpdate int64    `json:"ocsp_next_update,omitempty"` // seconds since epoch
+	Alerts         []*Alert `json:"alerts,omitempty"`
+}
+
+// Items returns the certificates watched by the OCSP manager, along with
+// their OCSP status and alerts.
+func (inv *inventory) Items() []*InventoryItem {
+	var out []*InventoryItem
+	for keyName := range OCSPManager.getCertMap() {
+		item := &InventoryItem{
+			KeyName:    keyName,
+			OCSPStatus: "pending",
+			Alerts:     inv.Alerts(keyName),
+		}
+		if state, ok := OCSPManager.lookupState(keyName); ok {
+			state.RLock()
+			item.OCSPStatus = ocspStatusString(state.status)
+			item.StatusSource = state.source
+			if !state.nextUpdate.IsZero() {
+				item.OCSPNextUpdate = state.nextUpdate.Unix()
+			}
+			state.RUnlock()
+			leaf := state.cert.Leaf
+			checksum := sha1.Sum(leaf.Raw)
+			item.Domains = leaf.DNSNames
+			item.Fingerprint = hex.EncodeToString(checksum[:])
+			item.NotAfter = leaf.NotAfter.Unix()
+		}
+		out = append(out, item)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].KeyName < out[j].KeyName })
+	return out
+}
+
+// HandleInventory responds the certificates being served and alerts.
+func (m *Manager) HandleInventory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(RspMethodNotAllowed)
+		return
+	}
+	writeJSON(w, struct {
+		Certificates []*InventoryItem `json:"certificates"`
+		Alerts       []*Alert         `json:"alerts"`
+		Syncs        []*SyncStatus    `json:"syncs,omitempty"`
+		Time         int64            `json:"time"`
+	}{
+		Certificates: Inventory.Items(),
+		Alerts:       Inventory.Alerts(""),
+		Syncs:        SyncStatuses(),
+		Time:         time.Now().Unix(),
+	})
+}
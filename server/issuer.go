@@ -0,0 +1,543 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alyx/x/autocert"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	acmeAccountKeyName = "acme_account+key"
+	certMetaSuffix     = "+meta"
+
+	// previous versions of autocert stored the account key under
+	// a different name
+	legacyAccountKeyName = "acme_account.key"
+)
+
+// issuer is an ACME certificate authority which certificates can be
+// ordered from. Each issuer has its own autocert.Manager and ACME account,
+// while the issued certificates are shared in the same storage. A
+// certificate is loaded and renewed by the issuer which issued it, other
+// issuers order a new one only if it fails.
+type issuer struct {
+	Name         string
+	DirectoryURL string
+
+	// Key algorithms to generate private keys for new certificates.
+	ECDSAKeyAlgo string
+	RSAKeyAlgo   string
+
+	conf  issuerConfig
+	cache *issuerCache
+	mMu   sync.RWMutex
+	gen   *managerGen // use autocertManager method to access
+
+	clientMu sync.Mutex
+	client   *acme.Client // initialized by acmeClient method
+}
+
+type issuerConfig struct {
+	Name         string `yaml:"name"`
+	DirectoryURL string `yaml:"directory_url"`
+	Email        string `yaml:"email"`
+	EABKID       string `yaml:"eab_kid"`
+	EABKey       string `yaml:"eab_key"`
+	ECDSACurve   string `yaml:"ecdsa_curve"`  // default: "P-256"
+	RSAKeySize   int    `yaml:"rsa_key_size"` // default: 2048
+}
+
+func (p *issuerConfig) setupDefaultOptions() {
+	setDefault(&p.Name, defaultIssuerName(p.DirectoryURL))
+	setDefault(&p.ECDSACurve, KeyAlgoP256)
+	setDefault(&p.RSAKeySize, 2048)
+}
+
+func newIssuer(conf issuerConfig, accountKeyName string) *issuer {
+	cache := &issuerCache{
+		Cache:          Cfg.Storage.Cache,
+		issuer:         conf.Name,
+		directoryURL:   conf.DirectoryURL,
+		accountKeyName: accountKeyName,
+	}
+
+	// The key options have been validated when initializing configuration.
+	ecdsaKeyAlgo, _ := ecdsaKeyAlgorithm(conf.ECDSACurve)
+	rsaKeyAlgo, _ := rsaKeyAlgorithm(conf.RSAKeySize)
+	return &issuer{
+		Name:         conf.Name,
+		DirectoryURL: conf.DirectoryURL,
+		ECDSAKeyAlgo: ecdsaKeyAlgo,
+		RSAKeyAlgo:   rsaKeyAlgo,
+		conf:         conf,
+		cache:        cache,
+		gen:          newManagerGen(conf, cache),
+	}
+}
+
+var errManagerRetired = errors.New("autocert manager is retired")
+
+// managerGen is a generation of an issuer's autocert.Manager.
+//
+// autocert keeps the certificates it has loaded in memory and renews them
+// by timers, which can't be stopped. When a manager has to be replaced,
+// e.g. the account key changes, the old generation is retired: it can't
+// access storage or the CA anymore, thus its timers can't renew, and the
+// certificates it has loaded are handed off to the new generation.
+type managerGen struct {
+	m       *autocert.Manager
+	retired int32 // atomic
+
+	mu     sync.Mutex
+	loaded map[string]bool // key names of the certificates loaded
+	puts   map[string]int  // number of times a certificate is saved
+}
+
+func newManagerGen(conf issuerConfig, cache *issuerCache) *managerGen {
+	gen := &managerGen{loaded: make(map[string]bool), puts: make(map[string]int)}
+	httpClient := newACMEHTTPClient(conf.Name, conf.DirectoryURL)
+	httpClient.Transport = &genTransport{gen: gen, next: httpClient.Transport}
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       &genCache{issuerCache: cache, gen: gen},
+		RenewBefore: time.Duration(Cfg.LetsEncrypt.RenewBefore) * 24 * time.Hour,
+		Client: &acme.Client{
+			DirectoryURL: conf.DirectoryURL,
+			HTTPClient:   httpClient,
+		},
+		Email:      conf.Email,
+		HostPolicy: Cfg.LetsEncrypt.HostPolicy,
+	}
+	if conf.EABKID != "" && conf.EABKey != "" {
+		m.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: conf.EABKID, Key: []byte(conf.EABKey)}
+	}
+	// Enable http-01 challenge for the issuer, the challenge responses
+	// are shared in storage and served by the primary issuer's handler.
+	m.HTTPHandler(nil)
+	gen.m = m
+	return gen
+}
+
+func (gen *managerGen) isRetired() bool {
+	return atomic.LoadInt32(&gen.retired) != 0
+}
+
+func (gen *managerGen) markLoaded(keyName string) {
+	gen.mu.Lock()
+	gen.loaded[keyName] = true
+	gen.mu.Unlock()
+}
+
+func (gen *managerGen) markSaved(keyName string) {
+	gen.mu.Lock()
+	gen.loaded[keyName] = true
+	gen.puts[keyName]++
+	gen.mu.Unlock()
+}
+
+func (gen *managerGen) isLoaded(keyName string) bool {
+	gen.mu.Lock()
+	defer gen.mu.Unlock()
+	return gen.loaded[keyName]
+}
+
+// loadState returns whether the certificate of keyName has been loaded,
+// and the number of times it has been saved by the generation.
+func (gen *managerGen) loadState(keyName string) (loaded bool, puts int) {
+	gen.mu.Lock()
+	defer gen.mu.Unlock()
+	return gen.loaded[keyName], gen.puts[keyName]
+}
+
+// certSource tells where autocert got the certificate of keyName from,
+// given the load state before getting it.
+func (gen *managerGen) certSource(keyName string, loaded bool, puts int) certSource {
+	if _, n := gen.loadState(keyName); n > puts {
+		return certFromIssuer
+	}
+	if loaded {
+		return certFromMemory
+	}
+	return certFromStorage
+}
+
+// retire fences the generation off and returns key names of the
+// certificates it has loaded.
+func (gen *managerGen) retire() []string {
+	atomic.StoreInt32(&gen.retired, 1)
+	gen.mu.Lock()
+	defer gen.mu.Unlock()
+	keys := make([]string, 0, len(gen.loaded))
+	for key := range gen.loaded {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// genCache is the storage seen by a manager generation.
+type genCache struct {
+	*issuerCache
+	gen *managerGen
+}
+
+func (c *genCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if c.gen.isRetired() {
+		return nil, errManagerRetired
+	}
+	data, err := c.issuerCache.Get(ctx, key)
+	if err == nil && isCertKeyName(key) {
+		c.gen.markLoaded(key)
+	}
+	return data, err
+}
+
+func (c *genCache) Put(ctx context.Context, key string, data []byte) error {
+	if c.gen.isRetired() {
+		return errManagerRetired
+	}
+	err := c.issuerCache.Put(ctx, key, data)
+	if err == nil && isCertKeyName(key) {
+		c.gen.markSaved(key)
+	}
+	return err
+}
+
+func (c *genCache) Delete(ctx context.Context, key string) error {
+	if c.gen.isRetired() {
+		return errManagerRetired
+	}
+	return c.issuerCache.Delete(ctx, key)
+}
+
+// genTransport fails all requests to the CA once the generation is retired.
+type genTransport struct {
+	gen  *managerGen
+	next http.RoundTripper
+}
+
+func (t *genTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.gen.isRetired() {
+		return nil, errManagerRetired
+	}
+	return t.next.RoundTrip(req)
+}
+
+// autocertManager returns the issuer's current autocert.Manager.
+func (iss *issuer) autocertManager() *autocert.Manager {
+	return iss.generation().m
+}
+
+// generation returns the issuer's current manager generation.
+func (iss *issuer) generation() *managerGen {
+	iss.mMu.RLock()
+	defer iss.mMu.RUnlock()
+	return iss.gen
+}
+
+// hasLoaded tells whether the issuer's current autocert.Manager has
+// loaded the certificate of keyName.
+func (iss *issuer) hasLoaded(keyName string) bool {
+	iss.mMu.RLock()
+	defer iss.mMu.RUnlock()
+	return iss.gen.isLoaded(keyName)
+}
+
+// retireAutocertManager replaces the issuer's autocert.Manager with a new
+// one, which loads the account key from storage. The certificates loaded
+// by the old manager and owned by the issuer are loaded again from
+// storage by the new one, which takes over renewing them.
+func (iss *issuer) retireAutocertManager(m *Manager) {
+	gen := newManagerGen(iss.conf, iss.cache)
+	iss.mMu.Lock()
+	old := iss.gen
+	iss.gen = gen
+	iss.mMu.Unlock()
+	keys := old.retire()
+	issuerLog.Info("retired autocert manager", "issuer", iss.Name, "loaded", len(keys))
+
+	go func() {
+		for _, keyName := range keys {
+			if m.certOwner(context.Background(), keyName) != iss {
+				continue
+			}
+			if _, err := loadCertificateFromStore(keyName); err != nil {
+				continue
+			}
+			domain, keyType := strings.TrimSuffix(keyName, "+rsa"), KeyTypeECDSA
+			if domain != keyName {
+				keyType = KeyTypeRSA
+			}
+			if _, err := gen.m.GetCertificate(m.helloInfo(domain, keyType)); err != nil {
+				issuerLog.Warn("failed hand off certificate", "key_name", keyName, "issuer", iss.Name, "err", err)
+			}
+		}
+	}()
+}
+
+// keyAlgorithm returns the key algorithm to use for new certificates
+// of the given key type.
+func (iss *issuer) keyAlgorithm(keyType string) string {
+	if keyType == KeyTypeRSA {
+		return iss.RSAKeyAlgo
+	}
+	return iss.ECDSAKeyAlgo
+}
+
+// isAutocertKeyAlgorithm tells whether the key algorithm is same with
+// which autocert generates for the key type.
+func isAutocertKeyAlgorithm(keyType string, algo string) bool {
+	if keyType == KeyTypeRSA {
+		return algo == KeyAlgoRSA2048
+	}
+	return algo == KeyAlgoP256
+}
+
+// issuerConfigs returns the configured issuers in order, the first one
+// is the primary issuer built from the lets_encrypt options, and the
+// rest are fallback issuers.
+func issuerConfigs() []issuerConfig {
+	primary := issuerConfig{
+		Name:         Cfg.LetsEncrypt.Name,
+		DirectoryURL: Cfg.LetsEncrypt.DirectoryURL,
+		Email:        Cfg.LetsEncrypt.Email,
+		EABKID:       Cfg.LetsEncrypt.EABKID,
+		EABKey:       Cfg.LetsEncrypt.EABKey,
+		ECDSACurve:   Cfg.LetsEncrypt.ECDSACurve,
+		RSAKeySize:   Cfg.LetsEncrypt.RSAKeySize,
+	}
+	return append([]issuerConfig{primary}, Cfg.LetsEncrypt.FallbackIssuers...)
+}
+
+func defaultIssuerName(directoryURL string) string {
+	switch directoryURL {
+	case acme.LetsEncryptURL:
+		return "letsencrypt"
+	case stagingDirectoryURL:
+		return "letsencrypt-staging"
+	}
+	if u, err := url.Parse(directoryURL); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return directoryURL
+}
+
+// issuerAccountKeyName returns the storage key of an issuer's ACME
+// account key. The primary issuer uses the same key as autocert to keep
+// compatible with previously registered account.
+func issuerAccountKeyName(index int, name string) string {
+	if index == 0 {
+		return acmeAccountKeyName
+	}
+	return name + "+" + acmeAccountKeyName
+}
+
+// issuerCache wraps the storage for an issuer.
+// It stores the issuer's account key under a dedicated name, and records
+// the issuer as metadata when a certificate is put into storage.
+type issuerCache struct {
+	autocert.Cache
+	issuer         string
+	directoryURL   string
+	accountKeyName string
+
+	// keyMu serializes loading and creating the account key, which is
+	// shared by autocert and the issuer's own ACME client.
+	keyMu sync.Mutex
+
+	// onOwnerChange is called when the issuer takes over a certificate
+	// issued by another one.
+	onOwnerChange func(keyName string, prev string)
+}
+
+func (c *issuerCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if key == acmeAccountKeyName {
+		return c.getAccountKey(ctx)
+	}
+	return c.Cache.Get(ctx, key)
+}
+
+// getAccountKey loads the account key from storage, or generates and
+// saves a new one if not exists. autocert never sees a cache miss for
+// the account key, thus it won't generate and register another account.
+func (c *issuerCache) getAccountKey(ctx context.Context) ([]byte, error) {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	data, err := c.Cache.Get(ctx, c.accountKeyName)
+	if err == autocert.ErrCacheMiss && c.accountKeyName == acmeAccountKeyName {
+		data, err = c.migrateLegacyAccountKey(ctx)
+	}
+	if err != autocert.ErrCacheMiss {
+		return data, err
+	}
+	key, err := GeneratePrivateKey(KeyAlgoP256)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = EncodePrivateKey(&buf, key); err != nil {
+		return nil, err
+	}
+	if err = c.Cache.Put(ctx, c.accountKeyName, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// migrateLegacyAccountKey moves the account key stored by previous
+// versions of autocert to the current name, thus only one copy exists,
+// and deleting the account key doesn't bring the legacy one back.
+func (c *issuerCache) migrateLegacyAccountKey(ctx context.Context) ([]byte, error) {
+	data, err := c.Cache.Get(ctx, legacyAccountKeyName)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Cache.Put(ctx, c.accountKeyName, data); err != nil {
+		return nil, err
+	}
+	if err = c.Cache.Delete(ctx, legacyAccountKeyName); err != nil {
+		issuerLog.Warn("failed delete legacy account key", "issuer", c.issuer, "err", err)
+	}
+	return data, nil
+}
+
+func (c *issuerCache) Put(ctx context.Context, key string, data []byte) error {
+	if key == acmeAccountKeyName {
+		key = c.accountKeyName
+	}
+	err := c.Cache.Put(ctx, key, data)
+	if err != nil || !isCertKeyName(key) {
+		return err
+	}
+	prevMeta, metaErr := getCertMeta(ctx, key)
+	meta := &certMeta{
+		Issuer:       c.issuer,
+		DirectoryURL: c.directoryURL,
+		IssuedAt:     timeNow().Unix(),
+	}
+	if err := putCertMeta(ctx, key, meta); err != nil {
+		issuerLog.Warn("failed put certificate meta", "key_name", key, "err", err)
+	}
+	issuerLog.Info("certificate issued", "key_name", key, "issuer", c.issuer)
+	if metaErr == nil && prevMeta.Issuer != c.issuer && c.onOwnerChange != nil {
+		c.onOwnerChange(key, prevMeta.Issuer)
+	}
+	acmeOrders.WithLabelValues(c.issuer, orderSucceeded).Inc()
+	// SAN groups notify the change by themselves
+	if !strings.HasPrefix(key, sanGroupKeyPrefix) {
+		OCSPManager.NotifyChange(autocertOCSPKeyName(key))
+	}
+
+	eventType := EventIssued
+	if metaErr == nil {
+		eventType = EventRenewed
+	}
+	cert, _ := parseCertificate(data)
+	event := newCertEvent(eventType, issuedOCSPKeyName(key), LetsEncrypt, cert)
+	event.Issuer = c.issuer
+	Events.Emit(event)
+	return nil
+}
+
+// issuedOCSPKeyName returns the OCSP key name of a certificate stored
+// by autocert or a SAN group.
+func issuedOCSPKeyName(key string) string {
+	if strings.HasPrefix(key, sanGroupKeyPrefix) {
+		return "group|" + strings.TrimPrefix(key, sanGroupKeyPrefix)
+	}
+	return autocertOCSPKeyName(key)
+}
+
+func (c *issuerCache) Delete(ctx context.Context, key string) error {
+	if key == acmeAccountKeyName {
+		key = c.accountKeyName
+	}
+	return c.Cache.Delete(ctx, key)
+}
+
+// isCertKeyName tells whether the storage key written by autocert is a
+// certificate, other than account key and challenge tokens.
+func isCertKeyName(key string) bool {
+	if strings.HasSuffix(key, "+rsa") {
+		return true
+	}
+	if strings.HasPrefix(key, sanGroupKeyPrefix) {
+		return !strings.Contains(strings.TrimPrefix(key, sanGroupKeyPrefix), "+")
+	}
+	return !strings.Contains(key, "+")
+}
+
+// certMeta is stored along with each ACME certificate.
+type certMeta struct {
+	Issuer       string `json:"issuer"`
+	DirectoryURL string `json:"directory_url"`
+	IssuedAt     int64  `json:"issued_at"` // seconds since epoch
+}
+
+func putCertMeta(ctx context.Context, keyName string, meta *certMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err = Cfg.Storage.Cache.Put(ctx, keyName+certMetaSuffix, data); err != nil {
+		return err
+	}
+	certIssuers.Store(keyName, &certIssuerEntry{issuer: meta.Issuer, at: timeNow()})
+	return nil
+}
+
+// certIssuers caches the issuer recorded in certificate metadata, thus
+// serving a certificate doesn't read storage. Entries expire to pick up
+// certificates renewed by other instances.
+var certIssuers sync.Map // key name -> *certIssuerEntry
+
+const certIssuerTTL = time.Hour
+
+type certIssuerEntry struct {
+	issuer string
+	at     time.Time
+}
+
+// lookupCertIssuer returns name of the issuer recorded in metadata of
+// the certificate, it returns an empty string if unknown.
+func lookupCertIssuer(ctx context.Context, keyName string) string {
+	if x, ok := certIssuers.Load(keyName); ok {
+		entry := x.(*certIssuerEntry)
+		if timeNow().Sub(entry.at) < certIssuerTTL {
+			return entry.issuer
+		}
+	}
+	issuer := ""
+	meta, err := getCertMeta(ctx, keyName)
+	if err == nil {
+		issuer = meta.Issuer
+	} else if err != autocert.ErrCacheMiss {
+		issuerLog.Warn("failed get certificate meta", "key_name", keyName, "err", err)
+		return ""
+	}
+	certIssuers.Store(keyName, &certIssuerEntry{issuer: issuer, at: timeNow()})
+	return issuer
+}
+
+// getCertMeta returns metadata of the certificate stored under keyName.
+func getCertMeta(ctx context.Context, keyName string) (*certMeta, error) {
+	data, err := Cfg.Storage.Cache.Get(ctx, keyName+certMetaSuffix)
+	if err != nil {
+		return nil, err
+	}
+	meta := &certMeta{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("unmarshal certificate meta: %v", err)
+	}
+	return meta, nil
+}
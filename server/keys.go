@@ -0,0 +1,104 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Key algorithms to generate private keys.
+const (
+	KeyAlgoP256    = "P-256"
+	KeyAlgoP384    = "P-384"
+	KeyAlgoRSA2048 = "RSA-2048"
+	KeyAlgoRSA3072 = "RSA-3072"
+	KeyAlgoRSA4096 = "RSA-4096"
+	KeyAlgoEd25519 = "Ed25519"
+)
+
+var keyAlgorithms = []string{
+	KeyAlgoP256,
+	KeyAlgoP384,
+	KeyAlgoRSA2048,
+	KeyAlgoRSA3072,
+	KeyAlgoRSA4096,
+	KeyAlgoEd25519,
+}
+
+// ParseKeyAlgorithm validates and returns the canonical name of a key
+// algorithm, the name is case-insensitive.
+func ParseKeyAlgorithm(name string) (string, error) {
+	for _, algo := range keyAlgorithms {
+		if strings.EqualFold(name, algo) {
+			return algo, nil
+		}
+	}
+	return "", fmt.Errorf("unknown key algorithm %q", name)
+}
+
+// GeneratePrivateKey generates a new private key of the given algorithm.
+func GeneratePrivateKey(algo string) (crypto.Signer, error) {
+	switch algo {
+	case KeyAlgoP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyAlgoP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyAlgoRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyAlgoRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyAlgoRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyAlgoEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unknown key algorithm %q", algo)
+}
+
+// EncodePrivateKey encodes private key in PEM format.
+//
+// RSA and ECDSA keys are encoded as PKCS#1 and SEC 1 respectively, which
+// are what autocert writes to storage, other keys are encoded as PKCS#8.
+func EncodePrivateKey(w io.Writer, key crypto.PrivateKey) error {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return EncodeRSAKey(w, key)
+	case *ecdsa.PrivateKey:
+		return EncodeECDSAKey(w, key)
+	}
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	pb := &pem.Block{Type: "PRIVATE KEY", Bytes: b}
+	return pem.Encode(w, pb)
+}
+
+// ecdsaKeyAlgorithm returns the key algorithm of an ECDSA curve name,
+// e.g. "P-384".
+func ecdsaKeyAlgorithm(curve string) (string, error) {
+	algo, err := ParseKeyAlgorithm(curve)
+	if err != nil || (algo != KeyAlgoP256 && algo != KeyAlgoP384) {
+		return "", fmt.Errorf("unsupported ECDSA curve %q", curve)
+	}
+	return algo, nil
+}
+
+// rsaKeyAlgorithm returns the key algorithm of an RSA key size,
+// e.g. 4096.
+func rsaKeyAlgorithm(size int) (string, error) {
+	algo, err := ParseKeyAlgorithm(fmt.Sprintf("RSA-%d", size))
+	if err != nil {
+		return "", fmt.Errorf("unsupported RSA key size %d", size)
+	}
+	return algo, nil
+}
@@ -1,18 +1,188 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var accessLogger = log.New(os.Stdout, "", 0)
+// Formats of the logs.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// The server logs go to stderr and the access logs go to stdout in text
+// format until InitLogging is called with the configuration.
+var (
+	logLevel      = new(slog.LevelVar)
+	serverHandler = newRootHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	accessHandler = newRootHandler(slog.NewTextHandler(os.Stdout, nil))
+
+	logFilesMu sync.Mutex
+	logFiles   []*os.File
+)
+
+// Loggers of the subsystems.
+var (
+	serverLog     = NewLogger("server")
+	managerLog    = NewLogger("manager")
+	ocspLog       = NewLogger("ocsp_manager")
+	managedLog    = NewLogger("managed")
+	selfSignedLog = NewLogger("self_signed")
+	internalCALog = NewLogger("internal_ca")
+	storageLog    = NewLogger("storage")
+	issuerLog     = NewLogger("issuer")
+	accountLog    = NewLogger("account")
+	sanGroupLog   = NewLogger("san_group")
+	adminLog      = NewLogger("admin")
+	inventoryLog  = NewLogger("inventory")
+	changesLog    = NewLogger("changes")
+	eventsLog     = NewLogger("events")
+	syncLog       = NewLogger("sync")
+
+	accessLog = slog.New(&logHandler{root: accessHandler})
+)
+
+// NewLogger returns a logger of the subsystem, the logger follows
+// the level, format and output configured by InitLogging.
+func NewLogger(subsystem string) *slog.Logger {
+	return slog.New(&logHandler{root: serverHandler}).With("subsystem", subsystem)
+}
+
+// Fatal logs the message at error level, then exits the process.
+func Fatal(logger *slog.Logger, msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	FlushLogs()
+	os.Exit(1)
+}
+
+// InitLogging sets up the level, format and output of the logs by
+// the configuration, the standard logger is redirected to the server
+// logs too.
+func InitLogging() {
+	err := logLevel.UnmarshalText([]byte(Cfg.Log.Level))
+	if err != nil {
+		log.Fatalf("[FATAL] server: invalid log level: %q", Cfg.Log.Level)
+	}
+	serverOut, err := openLogFile(Cfg.Log.File, os.Stderr)
+	if err != nil {
+		log.Fatalf("[FATAL] server: failed open log file: %v", err)
+	}
+	accessOut, err := openLogFile(Cfg.Log.AccessFile, os.Stdout)
+	if err != nil {
+		log.Fatalf("[FATAL] server: failed open access log file: %v", err)
+	}
+	var newHandler func(w io.Writer, opts *slog.HandlerOptions) slog.Handler
+	switch Cfg.Log.Format {
+	case LogFormatText:
+		newHandler = func(w io.Writer, opts *slog.HandlerOptions) slog.Handler { return slog.NewTextHandler(w, opts) }
+	case LogFormatJSON:
+		newHandler = func(w io.Writer, opts *slog.HandlerOptions) slog.Handler { return slog.NewJSONHandler(w, opts) }
+	default:
+		log.Fatalf("[FATAL] server: invalid log format: %q", Cfg.Log.Format)
+	}
+	serverHandler.set(newHandler(serverOut, &slog.HandlerOptions{Level: logLevel}))
+	accessHandler.set(newHandler(accessOut, nil))
+	slog.SetDefault(NewLogger("server"))
+}
+
+func openLogFile(filename string, std *os.File) (*os.File, error) {
+	if filename == "" {
+		return std, nil
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	logFilesMu.Lock()
+	logFiles = append(logFiles, file)
+	logFilesMu.Unlock()
+	return file, nil
+}
+
+// rootHandler holds the handler which the loggers write to, it can be
+// replaced after the loggers have been created.
+type rootHandler struct {
+	v atomic.Value // handlerBox
+}
+
+type handlerBox struct{ slog.Handler }
+
+func newRootHandler(h slog.Handler) *rootHandler {
+	root := &rootHandler{}
+	root.set(h)
+	return root
+}
+
+func (r *rootHandler) set(h slog.Handler) { r.v.Store(handlerBox{h}) }
+
+func (r *rootHandler) get() slog.Handler { return r.v.Load().(handlerBox).Handler }
+
+// logHandler passes records with its attributes and groups to the current
+// root handler.
+type logHandler struct {
+	root *rootHandler
+	ops  []logHandlerOp // applied to the root handler in order
+}
+
+// logHandlerOp is either attributes or a group added to a logHandler.
+type logHandlerOp struct {
+	attrs []slog.Attr
+	group string
+}
+
+func (h *logHandler) handler() slog.Handler {
+	handler := h.root.get()
+	for _, op := range h.ops {
+		if op.group != "" {
+			handler = handler.WithGroup(op.group)
+		} else {
+			handler = handler.WithAttrs(op.attrs)
+		}
+	}
+	return handler
+}
+
+func (h *logHandler) with(op logHandlerOp) *logHandler {
+	ops := make([]logHandlerOp, 0, len(h.ops)+1)
+	ops = append(ops, h.ops...)
+	ops = append(ops, op)
+	return &logHandler{root: h.root, ops: ops}
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.root.get().Enabled(ctx, level)
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	return h.with(logHandlerOp{attrs: attrs})
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return h.with(logHandlerOp{group: name})
+}
 
 type loggingResponseWriter struct {
 	http.ResponseWriter
@@ -24,15 +194,34 @@ func (lrw *loggingResponseWriter) WriteHeader(code int) {
 	lrw.ResponseWriter.WriteHeader(code)
 }
 
+func (lrw *loggingResponseWriter) Flush() {
+	if f, ok := lrw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		lrw := &loggingResponseWriter{w, http.StatusOK}
+		info := &accessInfo{}
+		req = req.WithContext(context.WithValue(req.Context(), accessInfoKey{}, info))
 		defer func(start time.Time) {
-			// [yyyymmdd hhmmss Addr] Status Method URI Duration
-			const LogFormat = "[%s %s] %d %s %s %s\n"
-			now := time.Now().UTC()
-			logTime := now.Format("20060102 15:04:05")
-			accessLogger.Printf(LogFormat, logTime, req.RemoteAddr, lrw.statusCode, req.Method, req.RequestURI, now.Sub(start))
+			attrs := []slog.Attr{
+				slog.String("remote_addr", req.RemoteAddr),
+				slog.Int("status", lrw.statusCode),
+				slog.String("method", req.Method),
+				slog.String("uri", req.RequestURI),
+				slog.Duration("duration", time.Since(start)),
+			}
+			if info.domain != "" {
+				attrs = append(attrs,
+					slog.String("domain", info.domain),
+					slog.String("cert_type", certTypeName(info.certType)))
+				if source := info.getSource(); source != 0 {
+					attrs = append(attrs, slog.String("source", source.String()))
+				}
+			}
+			accessLog.LogAttrs(context.Background(), slog.LevelInfo, "request", attrs...)
 		}(time.Now())
 		next.ServeHTTP(lrw, req)
 	})
@@ -59,8 +248,8 @@ func recoverMiddleware(next http.Handler) http.Handler {
 				}
 				loc := identifyPanic()
 				stack := debug.Stack()
-				log.Printf("[ERROR] catch panic: *** %s ***\n%s %s\n%s",
-					loc, req.Method, req.URL.RequestURI(), stack)
+				serverLog.Error("catch panic", "location", loc, "method", req.Method,
+					"uri", req.URL.RequestURI(), "stack", string(stack))
 				w.WriteHeader(500)
 			}
 		}()
@@ -98,4 +287,72 @@ func identifyPanic() string {
 func FlushLogs() {
 	_ = os.Stdout.Sync()
 	_ = os.Stderr.Sync()
+	logFilesMu.Lock()
+	for _, file := range logFiles {
+		_ = file.Sync()
+	}
+	logFilesMu.Unlock()
+}
+
+type accessInfoKey struct{}
+
+// accessInfo carries details of a certificate request to the access log.
+type accessInfo struct {
+	domain   string
+	certType int
+
+	mu     sync.Mutex
+	source certSource
+}
+
+func (info *accessInfo) getSource() certSource {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.source
+}
+
+// certSource tells where a served certificate comes from.
+type certSource int
+
+const (
+	certFromMemory  certSource = iota + 1 // in-memory state, e.g. autocert's
+	certFromStorage                       // loaded from storage
+	certFromIssuer                        // newly ordered or created
+)
+
+func (s certSource) String() string {
+	switch s {
+	case certFromMemory:
+		return "memory"
+	case certFromStorage:
+		return "storage"
+	case certFromIssuer:
+		return "issued"
+	}
+	return ""
+}
+
+// recordCertSource records the source of the certificate obtained for
+// the request of ctx, the most expensive one wins if there are many.
+func recordCertSource(ctx context.Context, source certSource) {
+	info, ok := ctx.Value(accessInfoKey{}).(*accessInfo)
+	if !ok {
+		return
+	}
+	info.mu.Lock()
+	if source > info.source {
+		info.source = source
+	}
+	info.mu.Unlock()
+}
+
+// setAccessInfo records the certificate served by the request to
+// the access log.
+func setAccessInfo(r *http.Request, domain string, certType int) {
+	info, ok := r.Context().Value(accessInfoKey{}).(*accessInfo)
+	if !ok {
+		return
+	}
+	info.domain = domain
+	info.certType = certType
 }
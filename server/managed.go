@@ -1,9 +1,10 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
-	"log"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -29,21 +30,21 @@ func IsManagedDomain(domain string) (certKey string, ok bool) {
 	return "", false
 }
 
-func GetManagedCertificate(certKey string) (*tls.Certificate, error) {
-	tlscert, err := getManagedCertificate(certKey)
+func GetManagedCertificate(ctx context.Context, certKey string) (*tls.Certificate, error) {
+	tlscert, err := getManagedCertificate(ctx, certKey)
 	if err != nil {
 		return nil, err
 	}
 
 	ocspKeyName := managedCertOCSPKeyName(certKey)
-	OCSPManager.Watch(ocspKeyName, func() (*tls.Certificate, error) {
-		return getManagedCertificate(certKey)
+	OCSPManager.Watch(ocspKeyName, tlscert, func() (*tls.Certificate, error) {
+		return getManagedCertificate(context.Background(), certKey)
 	})
 
 	return tlscert, nil
 }
 
-func getManagedCertificate(certKey string) (*tls.Certificate, error) {
+func getManagedCertificate(ctx context.Context, certKey string) (*tls.Certificate, error) {
 	cached, ok := managedCache.Load(certKey)
 	if ok {
 		mngCert := cached.(*managedCert)
@@ -53,6 +54,7 @@ func getManagedCertificate(certKey string) (*tls.Certificate, error) {
 				time.Now().Unix()-mngCert.loadAt > reloadInterval {
 				go reloadManagedCertificate(mngCert, certKey)
 			}
+			recordCertSource(ctx, certFromMemory)
 			return (*tls.Certificate)(tlscert), nil
 		}
 	}
@@ -64,6 +66,7 @@ func getManagedCertificate(certKey string) (*tls.Certificate, error) {
 	defer mngCert.Unlock()
 
 	if mngCert.cert != nil {
+		recordCertSource(ctx, certFromMemory)
 		return (*tls.Certificate)(mngCert.cert), nil
 	}
 	tlscert, err := loadCertificateFromStore(certKey)
@@ -72,19 +75,30 @@ func getManagedCertificate(certKey string) (*tls.Certificate, error) {
 	}
 	atomic.StorePointer(&mngCert.cert, unsafe.Pointer(tlscert))
 	mngCert.loadAt = time.Now().Unix()
+	managedLog.Debug("loaded certificate from storage", "cert_key", certKey)
+	recordCertSource(ctx, certFromStorage)
 	return tlscert, nil
 }
 
 func reloadManagedCertificate(mngCert *managedCert, certKey string) {
 	tlscert, err := loadCertificateFromStore(certKey)
 	if err != nil {
-		log.Printf("[WARN] managed: failed reload certificate: cert_key= %s err= %v", certKey, err)
+		managedLog.Warn("failed reload certificate", "cert_key", certKey, "err", err)
+		managedReloadFailures.WithLabelValues(certKey).Inc()
 		return
 	}
 	mngCert.Lock()
 	defer mngCert.Unlock()
+	old := (*tls.Certificate)(atomic.LoadPointer(&mngCert.cert))
 	atomic.StorePointer(&mngCert.cert, unsafe.Pointer(tlscert))
 	mngCert.loadAt = time.Now().Unix()
+	if old == nil || !bytes.Equal(old.Certificate[0], tlscert.Certificate[0]) {
+		managedLog.Info("reloaded changed certificate", "cert_key", certKey)
+		OCSPManager.NotifyChange(managedCertOCSPKeyName(certKey))
+		if old != nil {
+			Events.Emit(newCertEvent(EventManagedReloaded, managedCertOCSPKeyName(certKey), Managed, tlscert))
+		}
+	}
 }
 
 func managedCertOCSPKeyName(certKey string) string {
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alyx/x/autocert"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ocsp"
+)
+
+const metricsNamespace = "ssl_cert_server"
+
+// Results of ACME orders.
+const (
+	orderStarted   = "started"
+	orderSucceeded = "succeeded"
+	orderFailed    = "failed"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+
+	certLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_lookups_total",
+		Help:      "Number of certificate lookups by certificate type and result.",
+	}, []string{"type", "result"})
+
+	acmeOrders = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "acme_orders_total",
+		Help:      "Number of ACME orders started, succeeded and failed by issuer.",
+	}, []string{"issuer", "result"})
+
+	ocspRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ocsp_requests_total",
+		Help:      "Number of OCSP requests to responders by result.",
+	}, []string{"result"})
+
+	managedReloadFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "managed_reload_failures_total",
+		Help:      "Number of failures reloading managed certificates from storage.",
+	}, []string{"cert_key"})
+
+	storageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Latency of storage operations by backend, operation and result.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"backend", "operation", "result"})
+
+	certExpiryDesc = prometheus.NewDesc(
+		metricsNamespace+"_certificate_expiry_timestamp_seconds",
+		"Expiry time of the certificates being served.",
+		[]string{"key_name"}, nil)
+	staplingAgeDesc = prometheus.NewDesc(
+		metricsNamespace+"_ocsp_staple_age_seconds",
+		"Age of the cached OCSP staplings since this update.",
+		[]string{"key_name"}, nil)
+	staplingNextUpdateDesc = prometheus.NewDesc(
+		metricsNamespace+"_ocsp_staple_next_update_timestamp_seconds",
+		"Next update time of the cached OCSP staplings.",
+		[]string{"key_name"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequests,
+		httpRequestDuration,
+		certLookups,
+		acmeOrders,
+		ocspRequests,
+		managedReloadFailures,
+		storageDuration,
+		certificateCollector{},
+	)
+}
+
+// metricsMiddleware records requests by the route pattern registered
+// to mux, other than the request path, to keep the cardinality low.
+func metricsMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, route := mux.Handler(req)
+		lrw := &loggingResponseWriter{w, http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(lrw, req)
+		httpRequests.WithLabelValues(route, req.Method, strconv.Itoa(lrw.statusCode)).Inc()
+		httpRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	})
+}
+
+func certTypeName(certType int) string {
+	switch certType {
+	case LetsEncrypt:
+		return "letsencrypt"
+	case Managed:
+		return "managed"
+	case InternalCA:
+		return "internal_ca"
+	case SelfSigned:
+		return "self_signed"
+	case ALPNCert:
+		return "alpn"
+	}
+	return "unknown"
+}
+
+func observeCertLookup(certType int, err error) {
+	typ, result := certTypeName(certType), "ok"
+	if err == ErrHostNotPermitted {
+		typ, result = "none", "not_permitted"
+	} else if err != nil {
+		result = "error"
+	}
+	certLookups.WithLabelValues(typ, result).Inc()
+}
+
+func observeOCSPRequest(resp *ocsp.Response, err error) {
+	result := "error"
+	switch {
+	case err == errOCSPNotModified:
+		result = "not_modified"
+	case err == nil:
+		result = ocspStatusString(resp.Status)
+	}
+	ocspRequests.WithLabelValues(result).Inc()
+}
+
+// certificateCollector collects expiry of the certificates and age of
+// the OCSP staplings watched by the OCSP manager.
+type certificateCollector struct{}
+
+func (certificateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certExpiryDesc
+	ch <- staplingAgeDesc
+	ch <- staplingNextUpdateDesc
+}
+
+func (certificateCollector) Collect(ch chan<- prometheus.Metric) {
+	now := timeNow()
+	for keyName := range OCSPManager.getCertMap() {
+		state, ok := OCSPManager.lookupState(keyName)
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(certExpiryDesc, prometheus.GaugeValue,
+			float64(state.cert.Leaf.NotAfter.Unix()), keyName)
+		state.RLock()
+		hasStapling := len(state.ocspDER) > 0
+		thisUpdate, nextUpdate := state.thisUpdate, state.nextUpdate
+		state.RUnlock()
+		if hasStapling {
+			ch <- prometheus.MustNewConstMetric(staplingAgeDesc, prometheus.GaugeValue,
+				now.Sub(thisUpdate).Seconds(), keyName)
+			ch <- prometheus.MustNewConstMetric(staplingNextUpdateDesc, prometheus.GaugeValue,
+				float64(nextUpdate.Unix()), keyName)
+		}
+	}
+}
+
+// metricsCache records latency of the storage operations, and logs
+// the failed operations.
+type metricsCache struct {
+	autocert.Cache
+	backend string
+}
+
+func newMetricsCache(backend string, cache autocert.Cache) autocert.Cache {
+	return &metricsCache{Cache: cache, backend: backend}
+}
+
+// storageResult returns the result label of a storage operation.
+func storageResult(err error) string {
+	if err == autocert.ErrCacheMiss {
+		return "miss"
+	} else if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func (c *metricsCache) observe(operation string, key string, start time.Time, err error) {
+	result := storageResult(err)
+	if result == "error" {
+		storageLog.Warn("storage operation failed", "backend", c.backend, "operation", operation, "key", key, "err", err)
+	}
+	storageDuration.WithLabelValues(c.backend, operation, result).Observe(time.Since(start).Seconds())
+}
+
+func (c *metricsCache) Get(ctx context.Context, key string) (data []byte, err error) {
+	defer func(start time.Time) { c.observe("get", key, start, err) }(time.Now())
+	return c.Cache.Get(ctx, key)
+}
+
+func (c *metricsCache) Put(ctx context.Context, key string, data []byte) (err error) {
+	defer func(start time.Time) { c.observe("put", key, start, err) }(time.Now())
+	return c.Cache.Put(ctx, key, data)
+}
+
+func (c *metricsCache) Delete(ctx context.Context, key string) (err error) {
+	defer func(start time.Time) { c.observe("delete", key, start, err) }(time.Now())
+	return c.Cache.Delete(ctx, key)
+}
+
+func (c *metricsCache) List(ctx context.Context) (keys []string, err error) {
+	lister, ok := c.Cache.(KeyLister)
+	if !ok {
+		return nil, ErrListNotSupported
+	}
+	defer func(start time.Time) { c.observe("list", "", start, err) }(time.Now())
+	return lister.List(ctx)
+}
+
+func (c *metricsCache) Lock(ctx context.Context, name string, ttl time.Duration) (unlock func(), err error) {
+	locker, ok := c.Cache.(StorageLocker)
+	if !ok {
+		return nil, ErrLockNotSupported
+	}
+	defer func(start time.Time) { c.observe("lock", name, start, err) }(time.Now())
+	return locker.Lock(ctx, name, ttl)
+}
+
+// acmeMetricsTransport observes the ACME protocol (RFC 8555) to count
+// orders started and failed, it works for both autocert and the ACME
+// client of the issuer. Succeeded orders are counted when the
+// certificates are saved into storage.
+type acmeMetricsTransport struct {
+	issuer       string
+	directoryURL string
+
+	mu       sync.Mutex
+	newOrder string
+	failed   map[string]bool // order finalize URL or authorization URL
+}
+
+func newACMEHTTPClient(issuer string, directoryURL string) *http.Client {
+	metrics := &acmeMetricsTransport{
+		issuer:       issuer,
+		directoryURL: directoryURL,
+		failed:       make(map[string]bool),
+	}
+	return &http.Client{
+		Transport: newACMETracingTransport(issuer, directoryURL, metrics),
+	}
+}
+
+// acmeObject holds the fields of ACME resources which are interesting
+// to the transports observing the ACME protocol.
+type acmeObject struct {
+	NewOrder       string          `json:"newOrder"`
+	Status         string          `json:"status"`
+	Finalize       string          `json:"finalize"`
+	Authorizations []string        `json:"authorizations"`
+	Certificate    string          `json:"certificate"`
+	Identifier     json.RawMessage `json:"identifier"`
+	Challenges     []struct {
+		URL string `json:"url"`
+		URI string `json:"uri"` // pre-RFC 8555 CAs
+	} `json:"challenges"`
+}
+
+// readACMEObject decodes the ACME resource in body of resp, the body
+// is kept readable by the caller.
+func readACMEObject(resp *http.Response) (*acmeObject, bool) {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, false
+	}
+	obj := &acmeObject{}
+	if json.Unmarshal(body, obj) != nil {
+		return nil, false
+	}
+	return obj, true
+}
+
+func (t *acmeMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	t.mu.Lock()
+	isNewOrder := req.Method == "POST" && t.newOrder != "" && req.URL.String() == t.newOrder
+	t.mu.Unlock()
+	if isNewOrder {
+		acmeOrders.WithLabelValues(t.issuer, orderStarted).Inc()
+		if err != nil || resp.StatusCode >= 400 {
+			acmeOrders.WithLabelValues(t.issuer, orderFailed).Inc()
+		}
+	}
+	if err != nil {
+		return resp, err
+	}
+	isDirectory := req.Method == "GET" && req.URL.String() == t.directoryURL
+	if !isDirectory && req.Method != "POST" {
+		return resp, err
+	}
+	obj, ok := readACMEObject(resp)
+	if !ok {
+		return resp, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if isDirectory {
+		t.newOrder = obj.NewOrder
+		return resp, nil
+	}
+	// an invalid order, or an invalid authorization which makes
+	// the order invalid, it's counted once
+	var key string
+	if obj.Status == "invalid" {
+		if obj.Finalize != "" {
+			key = obj.Finalize
+		} else if obj.Identifier != nil && obj.Challenges != nil {
+			key = req.URL.String()
+		}
+	}
+	if key != "" && !t.failed[key] {
+		if len(t.failed) >= 1000 {
+			t.failed = make(map[string]bool)
+		}
+		t.failed[key] = true
+		acmeOrders.WithLabelValues(t.issuer, orderFailed).Inc()
+	}
+	return resp, nil
+}
@@ -0,0 +1,475 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyx/x/autocert"
+)
+
+// Alert types raised by the expiry monitor.
+const (
+	AlertExpiring       = "expiring"
+	AlertExpired        = "expired"
+	AlertRenewalOverdue = "renewal_overdue"
+)
+
+// Events of notifications.
+const (
+	EventAlertRaised   = "alert_raised"
+	EventAlertResolved = "alert_resolved"
+)
+
+const (
+	monitorStorageKey = "monitor+notified"
+
+	// autocert renews certificates renew_before days before expiry,
+	// renewal is overdue if the certificate is not renewed within
+	// renewalGraceDays after that
+	renewalGraceDays = 2
+
+	// emailTimeout limits the SMTP conversation if the context of
+	// a notification has no deadline
+	emailTimeout = time.Minute
+)
+
+// Notification tells that an alert of a certificate is raised or resolved.
+type Notification struct {
+	Event    string   `json:"event"`
+	Alert    *Alert   `json:"alert"`
+	Domains  []string `json:"domains,omitempty"`
+	NotAfter int64    `json:"not_after,omitempty"` // seconds since epoch
+	Host     string   `json:"host"`
+	Time     int64    `json:"time"` // seconds since epoch
+}
+
+// Notifier sends notifications to somewhere, e.g. a webhook or email.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, n *Notification) error
+}
+
+var monitorKick = make(chan struct{}, 1)
+
+// StartMonitor starts scanning certificates on schedule and sending
+// notifications of alerts, if the monitor is enabled.
+func StartMonitor() {
+	if !Cfg.Monitor.Enable {
+		return
+	}
+	mon := &monitor{notifiers: configuredNotifiers()}
+	Inventory.setOnChange(func() {
+		select {
+		case monitorKick <- struct{}{}:
+		default:
+		}
+	})
+	go mon.run()
+}
+
+func configuredNotifiers() []Notifier {
+	var notifiers []Notifier
+	for _, hook := range Cfg.Monitor.Webhooks {
+		notifiers = append(notifiers, &webhookNotifier{url: hook.URL, secret: hook.Secret})
+	}
+	if email := Cfg.Monitor.Email; email.SMTPAddr != "" {
+		notifiers = append(notifiers, &emailNotifier{
+			addr:     email.SMTPAddr,
+			username: email.Username,
+			password: email.Password,
+			from:     email.From,
+			to:       email.To,
+		})
+	}
+	return notifiers
+}
+
+type monitor struct {
+	notifiers []Notifier
+
+	mu       sync.Mutex
+	notified map[string]*Alert           // key name|alert type -> alert notified
+	unsaved  bool                        // notified is not saved into storage
+	certs    map[string]*tls.Certificate // key name -> certificate checked
+}
+
+func (mon *monitor) run() {
+	interval := time.Duration(Cfg.Monitor.IntervalMinutes) * time.Minute
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	mon.scan()
+	mon.reconcile()
+	for {
+		select {
+		case <-ticker.C:
+			mon.scan()
+		case <-monitorKick:
+			// alerts raised by other subsystems are sent soon without
+			// waiting for the next scan, wait a moment to send alerts
+			// raised together in one round
+			time.Sleep(time.Second)
+		}
+		mon.reconcile()
+	}
+}
+
+// scan checks expiry of the certificates being served, and the
+// configured managed and self-signed certificates.
+func (mon *monitor) scan() {
+	certs := make(map[string]*tls.Certificate)
+	for keyName, w := range OCSPManager.getCertMap() {
+		if state, ok := OCSPManager.lookupState(keyName); ok {
+			certs[keyName] = state.cert
+		} else if cert, err := w.certfunc(); err == nil {
+			certs[keyName] = cert
+		}
+	}
+	storedKeys := make(map[string]string) // key name -> storage key
+	for _, managed := range Cfg.Managed {
+		storedKeys[managedCertOCSPKeyName(managed.CertKey)] = managed.CertKey
+	}
+	if Cfg.SelfSigned.Enable && !Cfg.SelfSigned.InternalCA.Enable {
+		storedKeys["self_signed|"+Cfg.SelfSigned.CertKey] = Cfg.SelfSigned.CertKey
+	}
+	for keyName, certKey := range storedKeys {
+		if certs[keyName] != nil {
+			continue
+		}
+		cert, err := loadCertificateFromStore(certKey)
+		if err != nil {
+			if err != autocert.ErrCacheMiss {
+				inventoryLog.Warn("failed load certificate for expiry check", "cert_key", certKey, "err", err)
+			}
+			continue
+		}
+		certs[keyName] = cert
+	}
+	for keyName, cert := range certs {
+		checkExpiry(keyName, cert)
+	}
+	mon.mu.Lock()
+	mon.certs = certs
+	mon.mu.Unlock()
+}
+
+// checkExpiry raises alerts if the certificate expires within the
+// configured thresholds, the message changes only when a smaller
+// threshold is crossed, thus the alert is notified once per threshold.
+func checkExpiry(keyName string, cert *tls.Certificate) {
+	now := timeNow()
+	notAfter := cert.Leaf.NotAfter
+	left := notAfter.Sub(now)
+	if left <= 0 {
+		Inventory.ResolveAlert(keyName, AlertExpiring)
+		Inventory.RaiseAlert(keyName, AlertExpired, "certificate is expired: not_after= %s", notAfter.Format(time.RFC3339))
+		return
+	}
+	Inventory.ResolveAlert(keyName, AlertExpired)
+
+	threshold := 0
+	for _, days := range Cfg.Monitor.Thresholds {
+		if left <= time.Duration(days)*24*time.Hour && (threshold == 0 || days < threshold) {
+			threshold = days
+		}
+	}
+	if threshold > 0 {
+		Inventory.RaiseAlert(keyName, AlertExpiring, "certificate expires within %d days: not_after= %s", threshold, notAfter.Format(time.RFC3339))
+	} else {
+		Inventory.ResolveAlert(keyName, AlertExpiring)
+	}
+
+	// certificates from ACME issuers are expected to be renewed
+	if strings.HasPrefix(keyName, "autocert|") || strings.HasPrefix(keyName, "group|") {
+		overdue := time.Duration(Cfg.LetsEncrypt.RenewBefore-renewalGraceDays) * 24 * time.Hour
+		if left < overdue {
+			Inventory.RaiseAlert(keyName, AlertRenewalOverdue, "certificate is not renewed %d days before expiry: not_after= %s",
+				Cfg.LetsEncrypt.RenewBefore, notAfter.Format(time.RFC3339))
+		} else {
+			Inventory.ResolveAlert(keyName, AlertRenewalOverdue)
+		}
+	}
+}
+
+// reconcile sends notifications of alerts raised and resolved since
+// the last notification, notifications which failed are retried in
+// the next cycle.
+func (mon *monitor) reconcile() {
+	mon.mu.Lock()
+	defer mon.mu.Unlock()
+
+	mon.loadNotified()
+	current := make(map[string]*Alert)
+	for _, alert := range Inventory.Alerts("") {
+		current[alert.KeyName+"|"+alert.Type] = alert
+	}
+	var keys []string
+	for key := range current {
+		keys = append(keys, key)
+	}
+	for key := range mon.notified {
+		if current[key] == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changed := false
+	for _, key := range keys {
+		alert, old := current[key], mon.notified[key]
+		var n *Notification
+		switch {
+		case alert != nil && (old == nil || old.Message != alert.Message):
+			n = mon.newNotification(EventAlertRaised, alert)
+		case alert == nil && old != nil:
+			n = mon.newNotification(EventAlertResolved, old)
+		default:
+			continue
+		}
+		if !mon.notify(n) {
+			continue
+		}
+		if alert != nil {
+			mon.notified[key] = alert
+		} else {
+			delete(mon.notified, key)
+		}
+		changed = true
+	}
+	if changed || mon.unsaved {
+		mon.saveNotified()
+	}
+}
+
+func (mon *monitor) newNotification(event string, alert *Alert) *Notification {
+	hostname, _ := os.Hostname()
+	n := &Notification{
+		Event: event,
+		Alert: alert,
+		Host:  hostname,
+		Time:  timeNow().Unix(),
+	}
+	cert := mon.certs[alert.KeyName]
+	if state, ok := OCSPManager.lookupState(alert.KeyName); ok {
+		cert = state.cert
+	}
+	if cert != nil {
+		n.Domains = cert.Leaf.DNSNames
+		n.NotAfter = cert.Leaf.NotAfter.Unix()
+	}
+	return n
+}
+
+// notify sends the notification by all notifiers, it tells whether
+// all notifiers succeeded.
+func (mon *monitor) notify(n *Notification) bool {
+	ok := true
+	for _, notifier := range mon.notifiers {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := notifier.Notify(ctx, n)
+		cancel()
+		if err != nil {
+			inventoryLog.Warn("failed send notification", "notifier", notifier.Name(),
+				"key_name", n.Alert.KeyName, "type", n.Alert.Type, "err", err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// loadNotified reloads the notified alerts from storage before each
+// reconcile, thus alerts notified by other instances, or before
+// restarting, are not notified again. The alerts notified by this
+// instance but failed to save are kept, and saved in this reconcile.
+// The caller must hold mon.mu.
+func (mon *monitor) loadNotified() {
+	if mon.notified == nil {
+		mon.notified = make(map[string]*Alert)
+	}
+	data, err := Cfg.Storage.Cache.Get(context.Background(), monitorStorageKey)
+	if err != nil && err != autocert.ErrCacheMiss {
+		inventoryLog.Warn("failed load notified alerts", "err", err)
+		return
+	}
+	notified := make(map[string]*Alert)
+	if err == nil {
+		if err = json.Unmarshal(data, &notified); err != nil {
+			inventoryLog.Warn("failed load notified alerts", "err", err)
+			return
+		}
+	}
+	if mon.unsaved {
+		return
+	}
+	mon.notified = notified
+}
+
+// saveNotified saves the notified alerts into storage.
+// The caller must hold mon.mu.
+func (mon *monitor) saveNotified() {
+	data, err := json.Marshal(mon.notified)
+	if err == nil {
+		err = Cfg.Storage.Cache.Put(context.Background(), monitorStorageKey, data)
+	}
+	if err != nil {
+		inventoryLog.Warn("failed save notified alerts", "err", err)
+	}
+	mon.unsaved = err != nil
+}
+
+// webhookNotifier posts notifications as JSON to an URL, the body is
+// signed by HMAC-SHA256 with the secret, the signature is sent in
+// header "X-Signature-256" as "sha256=<hex>".
+type webhookNotifier struct {
+	url    string
+	secret string
+}
+
+func (p *webhookNotifier) Name() string { return "webhook" }
+
+func (p *webhookNotifier) Notify(ctx context.Context, n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.secret != "" {
+		req.Header.Set("X-Signature-256", "sha256="+signPayload(p.secret, body))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// emailNotifier sends notifications by SMTP, the connection is upgraded
+// by STARTTLS if the server supports it.
+type emailNotifier struct {
+	addr     string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func (p *emailNotifier) Name() string { return "email" }
+
+// Notify sends the notification like smtp.SendMail, but the SMTP
+// conversation is interrupted when ctx is done.
+func (p *emailNotifier) Notify(ctx context.Context, n *Notification) (err error) {
+	host, _, err := net.SplitHostPort(p.addr)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(emailTimeout)
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if p.username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err = c.Auth(smtp.PlainAuth("", p.username, p.password, host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(p.from); err != nil {
+		return err
+	}
+	for _, addr := range p.to {
+		if err = c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(p.message(n)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (p *emailNotifier) message(n *Notification) []byte {
+	action := "raised"
+	if n.Event == EventAlertResolved {
+		action = "resolved"
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", p.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(p.to, ", "))
+	fmt.Fprintf(&buf, "Subject: [ssl-cert-server] alert %s: %s %s\r\n", action, n.Alert.Type, n.Alert.KeyName)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Unix(n.Time, 0).Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "Alert %s on host %s.\r\n\r\n", action, n.Host)
+	fmt.Fprintf(&buf, "Certificate: %s\r\n", n.Alert.KeyName)
+	if len(n.Domains) > 0 {
+		fmt.Fprintf(&buf, "Domains: %s\r\n", strings.Join(n.Domains, ", "))
+	}
+	if n.NotAfter > 0 {
+		fmt.Fprintf(&buf, "Not after: %s\r\n", time.Unix(n.NotAfter, 0).UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(&buf, "Type: %s\r\n", n.Alert.Type)
+	fmt.Fprintf(&buf, "Message: %s\r\n", n.Alert.Message)
+	return buf.Bytes()
+}
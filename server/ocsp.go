@@ -8,9 +8,7 @@ import (
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
-	"io/ioutil"
-	"log"
-	"net/http"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,14 +17,23 @@ import (
 )
 
 const (
-	certsCheckInterval = time.Second
-	renewJitter        = time.Hour
-	renewBefore        = time.Hour * 48
+	renewJitter = time.Hour
+	renewBefore = time.Hour * 48
+
+	// notifyDelay delays checking a changed certificate a bit, the
+	// certificate may be saved to storage before it takes effect.
+	notifyDelay        = 5 * time.Second
+	retryInterval      = time.Minute
+	evictCheckInterval = 10 * time.Minute
 )
 
 var (
-	ErrStaplingNotCached = errors.New("OCSP stapling is not cached")
-	ErrCertfuncNotFound  = errors.New("certificate func not found")
+	ErrStaplingNotCached  = errors.New("OCSP stapling is not cached")
+	ErrCertfuncNotFound   = errors.New("certificate func not found")
+	ErrCertificateRevoked = errors.New("certificate is revoked")
+
+	errNoOCSPServer      = errors.New("certificate has no OCSP server")
+	errOCSPStatusUnknown = errors.New("OCSP status is unknown")
 )
 
 var OCSPManager = NewOCSPManager()
@@ -36,17 +43,22 @@ func NewOCSPManager() *ocspManager {
 		stateMap:   make(map[string]*ocspState),
 		stateToken: make(map[string]struct{}),
 		errMap:     make(map[string]*errlog),
+		pending:    make(map[string]*pendingCheck),
 	}
-	certMap := make(map[string]func() (*tls.Certificate, error))
+	certMap := make(map[string]*ocspWatch)
 	mgr.certMap.Store(certMap)
-	go mgr.listenCertChanges()
+	go mgr.evictIdleCerts()
+	go mgr.checkCRLs()
 	return mgr
 }
 
 type ocspManager struct {
 	// copy-on-write map
 	certMu  sync.Mutex
-	certMap atomic.Value // map[string]func() (*tls.Certificate, error)
+	certMap atomic.Value // map[string]*ocspWatch
+
+	pendingMu sync.Mutex
+	pending   map[string]*pendingCheck
 
 	stateMu    sync.RWMutex
 	stateMap   map[string]*ocspState
@@ -54,6 +66,8 @@ type ocspManager struct {
 
 	errMu  sync.RWMutex
 	errMap map[string]*errlog
+
+	revokedFuncs sync.Map // key name -> func(*tls.Certificate)
 }
 
 type errlog struct {
@@ -61,79 +75,206 @@ type errlog struct {
 	time int64
 }
 
+type ocspWatch struct {
+	certfunc   func() (*tls.Certificate, error)
+	lastAccess int64 // seconds since epoch, accessed atomically
+}
+
+type pendingCheck struct {
+	timer *time.Timer
+	due   time.Time
+}
+
 func (m *ocspManager) GetOCSPStapling(keyName string, fingerprint string) ([]byte, time.Time, error) {
+	m.markAccess(keyName)
 	state, ok := m.lookupState(keyName)
 	if ok {
 		fp := sha1.Sum(state.cert.Leaf.Raw)
 		if fingerprint == "" || fingerprint == hex.EncodeToString(fp[:]) {
 			state.RLock()
 			defer state.RUnlock()
+			// never serve a stapling which proves the certificate is revoked
+			if state.status == ocsp.Revoked {
+				return nil, time.Time{}, ErrCertificateRevoked
+			}
+			// the revocation status is checked by CRL
+			if len(state.ocspDER) == 0 {
+				return nil, time.Time{}, ErrStaplingNotCached
+			}
 			return state.ocspDER, state.nextUpdate, nil
 		}
 	}
 
 	// don't block request
-	log.Printf("[INFO] ocsp manager: OCSP stapling not cached: key_name= %v", keyName)
+	ocspLog.Info("OCSP stapling not cached", "key_name", keyName)
 	return nil, time.Time{}, ErrStaplingNotCached
 }
 
-func (m *ocspManager) Watch(keyName string, certfunc func() (*tls.Certificate, error)) {
-	certMap := m.getCertMap()
-	if certMap[keyName] != nil {
+// Watch starts watching the OCSP status of the certificate, it should be
+// called each time the certificate is requested, cert is the certificate
+// being served, which is compared with the watched one to detect changes.
+// Certificates not requested within the configured idle days are evicted.
+func (m *ocspManager) Watch(keyName string, cert *tls.Certificate, certfunc func() (*tls.Certificate, error)) {
+	if !m.markAccess(keyName) {
+		go m.watchNewCert(keyName, certfunc)
+		return
+	}
+	if state, ok := m.lookupState(keyName); ok && cert != nil &&
+		!bytes.Equal(state.cert.Certificate[0], cert.Certificate[0]) {
+		m.NotifyChange(keyName)
+	}
+}
+
+// NotifyChange tells the manager that the certificate watched under
+// keyName has been changed, e.g. renewed or reissued.
+func (m *ocspManager) NotifyChange(keyName string) {
+	if m.getCertMap()[keyName] == nil {
 		return
 	}
-	go m.watchNewCert(keyName, certfunc)
+	m.scheduleCheck(keyName, notifyDelay)
 }
 
-func (m *ocspManager) getCertMap() map[string]func() (*tls.Certificate, error) {
-	return m.certMap.Load().(map[string]func() (*tls.Certificate, error))
+// OnRevoked registers a function which is called when the OCSP responder
+// says the certificate being watched under keyName is revoked.
+// The function is expected to replace the revoked certificate, the new
+// certificate is picked up by the certfunc given to Watch.
+func (m *ocspManager) OnRevoked(keyName string, fn func(revoked *tls.Certificate)) {
+	m.revokedFuncs.Store(keyName, fn)
+}
+
+func (m *ocspManager) getCertMap() map[string]*ocspWatch {
+	return m.certMap.Load().(map[string]*ocspWatch)
+}
+
+// markAccess records the access time of a watched certificate,
+// it returns false if the certificate is not being watched.
+func (m *ocspManager) markAccess(keyName string) bool {
+	w := m.getCertMap()[keyName]
+	if w == nil {
+		return false
+	}
+	atomic.StoreInt64(&w.lastAccess, timeNow().Unix())
+	return true
 }
 
 func (m *ocspManager) watchNewCert(keyName string, certfunc func() (*tls.Certificate, error)) {
 	m.certMu.Lock()
 	defer m.certMu.Unlock()
 	oldCertMap := m.getCertMap()
-	newCertMap := make(map[string]func() (*tls.Certificate, error), len(oldCertMap)+1)
-	for k, f := range oldCertMap {
-		newCertMap[k] = f
+	if oldCertMap[keyName] != nil {
+		return
+	}
+	newCertMap := make(map[string]*ocspWatch, len(oldCertMap)+1)
+	for k, w := range oldCertMap {
+		newCertMap[k] = w
 	}
-	newCertMap[keyName] = certfunc
+	newCertMap[keyName] = &ocspWatch{certfunc: certfunc, lastAccess: timeNow().Unix()}
 	m.certMap.Store(newCertMap)
 
 	go m.touchState(keyName)
 }
 
 func (m *ocspManager) getCertificate(keyName string) (*tls.Certificate, error) {
-	certfunc := m.getCertMap()[keyName]
-	if certfunc != nil {
-		return certfunc()
+	w := m.getCertMap()[keyName]
+	if w != nil {
+		return w.certfunc()
 	}
 	return nil, ErrCertfuncNotFound
 }
 
-func (m *ocspManager) listenCertChanges() {
-	// at most 50 concurrent goroutines
-	token := make(chan struct{}, 50)
-	ticker := time.NewTicker(certsCheckInterval)
+// scheduleCheck checks the certificate after delay, checks of the same
+// certificate are merged, the earliest one wins.
+func (m *ocspManager) scheduleCheck(keyName string, delay time.Duration) {
+	due := timeNow().Add(delay)
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	if p := m.pending[keyName]; p != nil {
+		if p.due.After(due) && p.timer.Stop() {
+			p.due = due
+			p.timer.Reset(delay)
+		}
+		return
+	}
+	p := &pendingCheck{due: due}
+	p.timer = time.AfterFunc(delay, func() {
+		m.pendingMu.Lock()
+		if m.pending[keyName] == p {
+			delete(m.pending, keyName)
+		}
+		m.pendingMu.Unlock()
+		m.touchState(keyName)
+	})
+	m.pending[keyName] = p
+}
+
+// retryLater schedules another check after a failure, with some jitter.
+func (m *ocspManager) retryLater(keyName string) {
+	m.scheduleCheck(keyName, retryInterval+time.Duration(rand63n(int64(retryInterval))))
+}
+
+// evictIdleCerts periodically stops watching certificates which are not
+// requested within "ocsp.idle_days".
+func (m *ocspManager) evictIdleCerts() {
+	ticker := time.NewTicker(evictCheckInterval)
 	for range ticker.C {
-		certMap := m.getCertMap()
-		for keyName := range certMap {
-			token <- struct{}{}
-			go func(keyName string) {
-				defer func() { <-token }()
-				m.touchState(keyName)
-			}(keyName)
+		if Cfg.OCSP.IdleDays <= 0 {
+			continue
+		}
+		deadline := timeNow().Add(-time.Duration(Cfg.OCSP.IdleDays) * 24 * time.Hour).Unix()
+		for keyName, w := range m.getCertMap() {
+			if atomic.LoadInt64(&w.lastAccess) < deadline {
+				m.unwatch(keyName, w)
+			}
 		}
 	}
 }
 
+// unwatch removes the certificate from watching, it also stops the OCSP
+// stapling renewal and drops the cached stapling and alerts.
+func (m *ocspManager) unwatch(keyName string, w *ocspWatch) {
+	m.certMu.Lock()
+	oldCertMap := m.getCertMap()
+	if oldCertMap[keyName] != w {
+		m.certMu.Unlock()
+		return
+	}
+	newCertMap := make(map[string]*ocspWatch, len(oldCertMap))
+	for k, x := range oldCertMap {
+		if k != keyName {
+			newCertMap[k] = x
+		}
+	}
+	m.certMap.Store(newCertMap)
+	m.certMu.Unlock()
+
+	m.pendingMu.Lock()
+	if p := m.pending[keyName]; p != nil {
+		p.timer.Stop()
+		delete(m.pending, keyName)
+	}
+	m.pendingMu.Unlock()
+	if state, ok := m.lookupState(keyName); ok {
+		m.deleteState(keyName, state)
+	}
+	m.errMu.Lock()
+	delete(m.errMap, keyName)
+	m.errMu.Unlock()
+	m.revokedFuncs.Delete(keyName)
+	Inventory.ResolveAlert(keyName)
+	ocspLog.Info("evicted idle certificate", "key_name", keyName)
+}
+
 // touchState checks if OCSP stapling state for the given keyName is cached.
 // If not, it will request the OCSP stapling from the certificate's OCSP
 // server and cache the stateMap in Manager.
+// On failure, it is retried later.
 func (m *ocspManager) touchState(keyName string) {
 	cert, err := m.getCertificate(keyName)
 	if err != nil {
-		log.Printf("[ERROR] ocsp manager: failed get certifcate: key_name= %s err= %v", keyName, err)
+		if err != ErrCertfuncNotFound {
+			ocspLog.Error("failed get certifcate", "key_name", keyName, "err", err)
+			m.retryLater(keyName)
+		}
 		return
 	}
 	state, ok := m.lookupState(keyName)
@@ -143,10 +284,15 @@ func (m *ocspManager) touchState(keyName string) {
 		}
 		// the cached state is outdated, remove it
 		m.deleteState(keyName, state)
+		Changes.Publish(ChangeCertificate, certDomains(cert))
+	}
+	if len(cert.Leaf.OCSPServer) == 0 && len(cert.Leaf.CRLDistributionPoints) == 0 {
+		return
 	}
 
 	// allow only single worker to do request for a single certificate
 	if !m.markStateToken(keyName) {
+		m.scheduleCheck(keyName, notifyDelay)
 		return
 	}
 	defer m.unmarkStateToken(keyName)
@@ -154,21 +300,65 @@ func (m *ocspManager) touchState(keyName string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	issuer, err := x509.ParseCertificate(cert.Certificate[len(cert.Certificate)-1])
+	issuer, fromAIA, err := findIssuer(ctx, cert)
 	if err != nil {
-		log.Printf("[ERROR] ocsp manager: failed parse certificate: key_name= %s err= %v", keyName, err)
+		Inventory.RaiseAlert(keyName, AlertIncompleteChain, "cannot complete certificate chain: %v", err)
+		m.logRequestError(keyName, err)
+		m.retryLater(keyName)
+		return
+	}
+	if fromAIA {
+		ocspLog.Warn("issuer certificate not in chain, fetched from AIA", "key_name", keyName, "issuer", issuer.Subject.String())
+	}
+	if len(cert.Leaf.OCSPServer) == 0 {
+		m.touchCRLState(ctx, keyName, cert, issuer)
 		return
 	}
-	der, response, err := requestOCSPStapling(ctx, cert, issuer)
+	der, response, httpCache, err := requestOCSPStapling(ctx, cert, issuer, nil)
+	if err == nil && response.Status == ocsp.Unknown {
+		Inventory.RaiseAlert(keyName, AlertOCSPUnknown, "OCSP responder doesn't know the certificate: serial= %x", cert.Leaf.SerialNumber)
+		err = errOCSPStatusUnknown
+	}
 	if err != nil {
 		m.logRequestError(keyName, err)
+		// don't miss the revocation while OCSP is unavailable
+		if m.checkCRLFallback(ctx, keyName, cert, issuer) {
+			return
+		}
+		m.retryLater(keyName)
 		return
 	}
 	m.logRequestSuccess(keyName)
-	state = m.setState(keyName, cert, issuer, der, response)
+	state = m.setState(keyName, cert, issuer, der, response, httpCache)
+	if m.getCertMap()[keyName] == nil {
+		// evicted while requesting
+		m.deleteState(keyName, state)
+		return
+	}
+	if response.Status == ocsp.Revoked {
+		m.handleRevoked(keyName, cert, AlertOCSPRevoked, response.RevokedAt, response.RevocationReason)
+	} else {
+		Inventory.ResolveAlert(keyName, revocationAlertTypes...)
+		Changes.Publish(ChangeOCSP, certDomains(cert))
+	}
 	return
 }
 
+// handleRevoked raises an alert for the revoked certificate, and calls
+// the function registered by OnRevoked to replace the certificate.
+func (m *ocspManager) handleRevoked(keyName string, cert *tls.Certificate, alertType string, revokedAt time.Time, reason int) {
+	raised := Inventory.RaiseAlert(keyName, alertType, "certificate is revoked: serial= %x revoked_at= %s reason= %d",
+		cert.Leaf.SerialNumber, revokedAt.Format(time.RFC3339), reason)
+	if raised {
+		event := newCertEvent(EventOCSPRevoked, keyName, certTypeOfKeyName(keyName), cert)
+		event.Reason = reason
+		Events.Emit(event)
+	}
+	if fn, ok := m.revokedFuncs.Load(keyName); ok {
+		go fn.(func(*tls.Certificate))(cert)
+	}
+}
+
 // logRequestError suppresses error logging, it logs at most once
 // for an error message per minute for each keyName.
 //
@@ -191,7 +381,7 @@ func (m *ocspManager) logRequestError(keyName string, err error) {
 	}
 	m.errMu.Unlock()
 	if shouldLog {
-		log.Printf("[ERROR] ocsp manager: failed request OCSP stapling: key_name= %s err= %v", keyName, err)
+		ocspLog.Error("failed request OCSP stapling", "key_name", keyName, "err", err)
 	}
 }
 
@@ -199,7 +389,7 @@ func (m *ocspManager) logRequestSuccess(keyName string) {
 	m.errMu.Lock()
 	delete(m.errMap, keyName)
 	m.errMu.Unlock()
-	log.Printf("[INFO] ocsp manager: request OCSP stapling success: key_name= %s", keyName)
+	ocspLog.Info("request OCSP stapling success", "key_name", keyName)
 }
 
 func (m *ocspManager) markStateToken(keyName string) bool {
@@ -243,22 +433,30 @@ func (m *ocspManager) setState(
 	issuer *x509.Certificate,
 	der []byte,
 	response *ocsp.Response,
+	httpCache *ocspHTTPCache,
 ) *ocspState {
 	m.stateMu.Lock()
 	defer m.stateMu.Unlock()
 
-	renewal := &ocspRenewal{manager: m, keyName: keyName}
 	state := &ocspState{
 		cert:       cert,
 		issuer:     issuer,
-		ocspDER:    der,
+		status:     response.Status,
+		source:     revocationSourceOCSP,
+		thisUpdate: response.ThisUpdate,
 		nextUpdate: response.NextUpdate,
-		renewal:    renewal,
+		httpCache:  httpCache,
 	}
 	m.stateMap[keyName] = state
 
-	// start OCSP stapling renewal timer loop
-	go renewal.start(state.nextUpdate)
+	// revocation is permanent, no need to renew the OCSP stapling
+	if response.Status == ocsp.Good {
+		state.ocspDER = der
+		state.renewal = &ocspRenewal{manager: m, keyName: keyName}
+
+		// start OCSP stapling renewal timer loop
+		go state.renewal.start(state.nextUpdate, httpCache)
+	}
 	return state
 }
 
@@ -266,11 +464,25 @@ type ocspState struct {
 	sync.RWMutex
 	cert       *tls.Certificate
 	issuer     *x509.Certificate
+	status     int    // ocsp.Good or ocsp.Revoked
+	source     string // "ocsp" or "crl"
 	ocspDER    []byte
+	thisUpdate time.Time
 	nextUpdate time.Time
+	httpCache  *ocspHTTPCache
 	renewal    *ocspRenewal
 }
 
+func ocspStatusString(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	}
+	return "unknown"
+}
+
 type ocspRenewal struct {
 	manager *ocspManager
 	keyName string
@@ -279,14 +491,14 @@ type ocspRenewal struct {
 	timer   *time.Timer
 }
 
-func (or *ocspRenewal) start(next time.Time) {
+func (or *ocspRenewal) start(next time.Time, httpCache *ocspHTTPCache) {
 	or.timerMu.Lock()
 	defer or.timerMu.Unlock()
 	if or.timer != nil {
 		return
 	}
-	or.timer = time.AfterFunc(or.next(next), or.update)
-	log.Printf("[INFO] ocsp renewal: started OCSP stapling renewal: key_name= %s next_update= %s", or.keyName, next.Format(time.RFC3339Nano))
+	or.timer = time.AfterFunc(or.nextWithCache(next, httpCache), or.update)
+	ocspLog.Info("started OCSP stapling renewal", "key_name", or.keyName, "next_update", next)
 }
 
 func (or *ocspRenewal) stop() {
@@ -297,7 +509,7 @@ func (or *ocspRenewal) stop() {
 	}
 	or.timer.Stop()
 	or.timer = nil
-	log.Printf("[INFO] ocsp renewal: stoped OCSP stapling renewal: key_name= %s", or.keyName)
+	ocspLog.Info("stoped OCSP stapling renewal", "key_name", or.keyName)
 }
 
 func (or *ocspRenewal) update() {
@@ -317,18 +529,57 @@ func (or *ocspRenewal) update() {
 	var next time.Duration
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
-	der, response, err := requestOCSPStapling(ctx, state.cert, state.issuer)
+	state.RLock()
+	oldCache, thisUpdate := state.httpCache, state.thisUpdate
+	state.RUnlock()
+	der, response, httpCache, err := requestOCSPStapling(ctx, state.cert, state.issuer, oldCache)
+	if err == errOCSPNotModified {
+		// the responder has nothing newer, check again after its cache expires
+		state.Lock()
+		state.httpCache = httpCache
+		next = or.nextWithCache(state.nextUpdate, httpCache)
+		state.Unlock()
+		ocspLog.Info("OCSP stapling not modified", "key_name", or.keyName)
+		or.timer = time.AfterFunc(next, or.update)
+		testOCSPDidUpdateLoop(next, nil)
+		return
+	}
+	if err == nil && response.ThisUpdate.Before(thisUpdate) {
+		// a stale response from some cache, keep the newer one
+		err = fmt.Errorf("OCSP response is older than the cached one: this_update= %s", response.ThisUpdate.Format(time.RFC3339))
+	}
+	if err == nil && response.Status == ocsp.Unknown {
+		// keep the previous stapling which is still valid
+		Inventory.RaiseAlert(or.keyName, AlertOCSPUnknown, "OCSP responder doesn't know the certificate: serial= %x", state.cert.Leaf.SerialNumber)
+		err = errOCSPStatusUnknown
+	}
+	if err == nil && response.Status == ocsp.Revoked {
+		ocspLog.Error("certificate is revoked", "key_name", or.keyName)
+		state.Lock()
+		state.status = ocsp.Revoked
+		state.ocspDER = nil
+		state.nextUpdate = response.NextUpdate
+		state.Unlock()
+		or.timer = nil
+		Changes.Publish(ChangeOCSP, certDomains(state.cert))
+		or.manager.handleRevoked(or.keyName, state.cert, AlertOCSPRevoked, response.RevokedAt, response.RevocationReason)
+		return
+	}
 	if err != nil {
-		log.Printf("[ERROR] ocsp renewal: failed request OCSP stapling: key_name= %s err= %v", or.keyName, err)
+		ocspLog.Error("failed request OCSP stapling", "key_name", or.keyName, "err", err)
 		next = renewJitter / 2
 		next += time.Duration(rand63n(int64(next)))
 	} else {
-		log.Printf("[INFO] ocsp renewal: request OCSP stapling success: key_name= %s next_update= %s", or.keyName, response.NextUpdate.Format(time.RFC3339Nano))
+		Inventory.ResolveAlert(or.keyName, AlertOCSPUnknown)
+		ocspLog.Info("request OCSP stapling success", "key_name", or.keyName, "next_update", response.NextUpdate)
 		state.Lock()
 		defer state.Unlock()
 		state.ocspDER = der
+		state.thisUpdate = response.ThisUpdate
 		state.nextUpdate = response.NextUpdate
-		next = or.next(response.NextUpdate)
+		state.httpCache = httpCache
+		next = or.nextWithCache(response.NextUpdate, httpCache)
+		Changes.Publish(ChangeOCSP, certDomains(state.cert))
 	}
 
 	or.timer = time.AfterFunc(next, or.update)
@@ -352,28 +603,15 @@ func (or *ocspRenewal) next(expiry time.Time) time.Duration {
 	return d
 }
 
-func requestOCSPStapling(ctx context.Context, cert *tls.Certificate, issuer *x509.Certificate) (der []byte, resp *ocsp.Response, err error) {
-	ocspReq, err := ocsp.CreateRequest(cert.Leaf, issuer, nil)
-	if err != nil {
-		return nil, nil, err
-	}
-	httpReq, err := http.NewRequest("POST", cert.Leaf.OCSPServer[0], bytes.NewBuffer(ocspReq))
-	if err != nil {
-		return nil, nil, err
-	}
-	httpReq.Header.Set("Content-Type", "application/ocsp-request")
-	httpResp, err := httpClient.Do(httpReq.WithContext(ctx))
-	if err != nil {
-		return nil, nil, err
-	}
-	defer httpResp.Body.Close()
-	der, err = ioutil.ReadAll(httpResp.Body)
-	if err != nil {
-		return nil, nil, err
-	}
-	resp, err = ocsp.ParseResponse(der, issuer)
-	if err != nil {
-		return nil, nil, err
+// nextWithCache is like next, but it won't request the responder again
+// before the HTTP cache expires, as long as the response is still valid
+// by then, the responder won't have a newer response before that.
+func (or *ocspRenewal) nextWithCache(expiry time.Time, httpCache *ocspHTTPCache) time.Duration {
+	d := or.next(expiry)
+	if httpCache != nil && httpCache.expires.Before(expiry.Add(-renewBefore/2)) {
+		if wait := httpCache.expires.Sub(timeNow()); wait > d {
+			d = wait
+		}
 	}
-	return der, resp, nil
+	return d
 }
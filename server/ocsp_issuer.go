@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	AlertIncompleteChain = "incomplete_chain"
+
+	aiaFailureTTL = 10 * time.Minute
+	aiaMaxSize    = 1 << 20
+)
+
+var errIssuerNotFound = errors.New("issuer certificate not found in chain nor AIA")
+
+// aiaCache caches issuer certificates fetched from AIA CA Issuers URLs,
+// failures are cached for a while to avoid hammering the CA.
+var aiaCache sync.Map // url -> *aiaEntry
+
+type aiaEntry struct {
+	cert      *x509.Certificate
+	err       error
+	fetchedAt time.Time
+}
+
+// findIssuer returns the certificate which signed the leaf certificate.
+//
+// It looks for the issuer in the chain first, the chain may be in any
+// order and may contain the root or not. If the issuer is not in the
+// chain, e.g. a managed bundle contains only the leaf, it fetches the
+// issuer from the CA Issuers URL of the leaf's Authority Information
+// Access extension.
+func findIssuer(ctx context.Context, cert *tls.Certificate) (issuer *x509.Certificate, fromAIA bool, err error) {
+	leaf := cert.Leaf
+	for _, der := range cert.Certificate[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		if leaf.CheckSignatureFrom(c) == nil {
+			return c, false, nil
+		}
+	}
+
+	var lastErr error
+	for _, url := range leaf.IssuingCertificateURL {
+		c, err := fetchAIAIssuer(ctx, url)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err = leaf.CheckSignatureFrom(c); err != nil {
+			lastErr = fmt.Errorf("certificate from %s didn't sign the leaf: %v", url, err)
+			continue
+		}
+		return c, true, nil
+	}
+	if lastErr != nil {
+		return nil, false, fmt.Errorf("%v: %v", errIssuerNotFound, lastErr)
+	}
+	return nil, false, errIssuerNotFound
+}
+
+func fetchAIAIssuer(ctx context.Context, url string) (*x509.Certificate, error) {
+	if x, ok := aiaCache.Load(url); ok {
+		entry := x.(*aiaEntry)
+		if entry.err == nil || time.Since(entry.fetchedAt) < aiaFailureTTL {
+			return entry.cert, entry.err
+		}
+	}
+	cert, err := doFetchAIAIssuer(ctx, url)
+	aiaCache.Store(url, &aiaEntry{cert: cert, err: err, fetchedAt: time.Now()})
+	return cert, err
+}
+
+func doFetchAIAIssuer(ctx context.Context, url string) (*x509.Certificate, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch issuer from %s: unexpected status %d", url, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, aiaMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	// CA Issuers are usually DER encoded, some CAs serve PEM.
+	if block, _ := pem.Decode(data); block != nil && block.Type == "CERTIFICATE" {
+		data = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse issuer from %s: %v", url, err)
+	}
+	return cert, nil
+}
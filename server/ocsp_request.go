@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// RFC 5019 section 5: clients use GET when the encoded request is
+	// less than 255 bytes, which makes the response cacheable by CDNs.
+	ocspGetMaxSize = 255
+
+	ocspMaxResponseSize = 1 << 20
+	ocspClockSkew       = 5 * time.Minute
+)
+
+var errOCSPNotModified = errors.New("OCSP response not modified")
+
+// ocspHTTPCache keeps the HTTP caching headers of the last OCSP response,
+// they are used to do conditional requests to the same responder and
+// to avoid requesting the responder before the cached response expires.
+type ocspHTTPCache struct {
+	responder    string
+	etag         string
+	lastModified string
+	expires      time.Time
+}
+
+// requestOCSPStapling requests the OCSP response for the certificate,
+// it tries the OCSP servers listed in the certificate one by one until
+// a valid response is received.
+//
+// If cache is not nil, the request to the same responder is conditional,
+// errOCSPNotModified is returned if the responder says the response
+// is not modified since the last request.
+func requestOCSPStapling(ctx context.Context, cert *tls.Certificate, issuer *x509.Certificate, cache *ocspHTTPCache) (
+	der []byte, resp *ocsp.Response, httpCache *ocspHTTPCache, err error) {
+	if len(cert.Leaf.OCSPServer) == 0 {
+		return nil, nil, nil, errNoOCSPServer
+	}
+	ocspReq, err := ocsp.CreateRequest(cert.Leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var errs []string
+	for _, server := range cert.Leaf.OCSPServer {
+		var conditional *ocspHTTPCache
+		if cache != nil && cache.responder == server {
+			conditional = cache
+		}
+		reqCtx, span := tracer.Start(ctx, "ocsp.request", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("responder", server), attribute.Bool("conditional", conditional != nil)))
+		der, resp, httpCache, err = doOCSPRequest(reqCtx, server, ocspReq, cert.Leaf, issuer, conditional)
+		observeOCSPRequest(resp, err)
+		if err == errOCSPNotModified {
+			span.SetAttributes(attribute.Bool("not_modified", true))
+			span.End()
+		} else {
+			endSpan(span, err)
+		}
+		if err == nil || err == errOCSPNotModified {
+			return der, resp, httpCache, err
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", server, err))
+	}
+	return nil, nil, nil, fmt.Errorf("all OCSP responders failed: %s", strings.Join(errs, "; "))
+}
+
+func doOCSPRequest(ctx context.Context, server string, ocspReq []byte, leaf, issuer *x509.Certificate, cache *ocspHTTPCache) (
+	der []byte, resp *ocsp.Response, httpCache *ocspHTTPCache, err error) {
+	var httpReq *http.Request
+	getURL := strings.TrimSuffix(server, "/") + "/" + url.QueryEscape(base64.StdEncoding.EncodeToString(ocspReq))
+	if len(getURL) < ocspGetMaxSize {
+		httpReq, err = http.NewRequest("GET", getURL, nil)
+	} else {
+		httpReq, err = http.NewRequest("POST", server, bytes.NewReader(ocspReq))
+		if err == nil {
+			httpReq.Header.Set("Content-Type", "application/ocsp-request")
+		}
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if cache != nil {
+		if cache.etag != "" {
+			httpReq.Header.Set("If-None-Match", cache.etag)
+		}
+		if cache.lastModified != "" {
+			httpReq.Header.Set("If-Modified-Since", cache.lastModified)
+		}
+	}
+	httpResp, err := httpClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer httpResp.Body.Close()
+
+	httpCache = parseOCSPHTTPCache(server, httpResp.Header)
+	if httpResp.StatusCode == http.StatusNotModified && cache != nil {
+		return nil, nil, httpCache, errOCSPNotModified
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, nil, fmt.Errorf("unexpected status %d", httpResp.StatusCode)
+	}
+	der, err = ioutil.ReadAll(http.MaxBytesReader(nil, httpResp.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// ParseResponseForCert checks the responder signature and that the
+	// response is for the requested certificate.
+	resp, err = ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err = checkOCSPFreshness(resp); err != nil {
+		return nil, nil, nil, err
+	}
+	return der, resp, httpCache, nil
+}
+
+// checkOCSPFreshness rejects responses which are not yet valid or already
+// expired, e.g. a stale response served by a misbehaving cache.
+func checkOCSPFreshness(resp *ocsp.Response) error {
+	now := timeNow()
+	if resp.ThisUpdate.After(now.Add(ocspClockSkew)) {
+		return fmt.Errorf("OCSP response is not yet valid: this_update= %s", resp.ThisUpdate.Format(time.RFC3339))
+	}
+	if !resp.NextUpdate.IsZero() {
+		if resp.NextUpdate.Before(resp.ThisUpdate) {
+			return fmt.Errorf("OCSP response has next_update before this_update")
+		}
+		if resp.NextUpdate.Before(now) {
+			return fmt.Errorf("OCSP response is expired: next_update= %s", resp.NextUpdate.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// parseOCSPHTTPCache parses the caching headers as described in
+// RFC 5019 section 6.
+func parseOCSPHTTPCache(server string, header http.Header) *ocspHTTPCache {
+	cache := &ocspHTTPCache{
+		responder:    server,
+		etag:         header.Get("ETag"),
+		lastModified: header.Get("Last-Modified"),
+	}
+	hasMaxAge := false
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			cache.expires = time.Time{}
+			return cache
+		case strings.HasPrefix(directive, "max-age="):
+			if sec, err := strconv.ParseInt(directive[len("max-age="):], 10, 64); err == nil && sec > 0 {
+				cache.expires = timeNow().Add(time.Duration(sec) * time.Second)
+				hasMaxAge = true
+			}
+		}
+	}
+	if !hasMaxAge {
+		if t, err := http.ParseTime(header.Get("Expires")); err == nil {
+			cache.expires = t
+		}
+	}
+	return cache
+}
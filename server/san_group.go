@@ -0,0 +1,533 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alyx/x/autocert"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	sanGroupKeyPrefix     = "group+"
+	sanGroupMembersSuffix = "+members"
+	autoSANGroupPrefix    = "auto-"
+
+	// a member removed from an automatic group for failed validation
+	// is not added again within removedMemberTTL
+	removedMemberTTL = 24 * time.Hour
+)
+
+type sanGroupConfig struct {
+	Name    string   `yaml:"name"`
+	Domains []string `yaml:"domains"`
+}
+
+// sanGroup is a group of domain names which share one certificate.
+//
+// Configured groups have fixed members, while automatic groups are
+// created by registered domain and grow when new names are requested,
+// the members are persisted in storage.
+// The certificate is ordered when any member is requested for the first
+// time, new members which are not covered by the current certificate
+// are added on next renewal.
+type sanGroup struct {
+	Name string
+	auto bool
+
+	// mu protects the members and the renewal timer, it is not held
+	// while ordering certificate, orders are serialized by ordering.
+	mu       sync.Mutex
+	members  []string
+	loaded   bool
+	timer    *time.Timer
+	ordering chan struct{}        // closed when the in-flight order finishes
+	orderErr error                // error of the last order
+	source   certSource           // where the last loaded certificate comes from
+	removed  map[string]time.Time // members removed for failed validation
+
+	cert atomic.Value // *tls.Certificate
+}
+
+func (g *sanGroup) KeyName() string {
+	return sanGroupKeyPrefix + g.Name
+}
+
+func (g *sanGroup) OCSPKeyName() string {
+	return fmt.Sprintf("group|%s", g.Name)
+}
+
+func (g *sanGroup) membersKeyName() string {
+	return g.KeyName() + sanGroupMembersSuffix
+}
+
+// setCert replaces the group's current certificate.
+func (g *sanGroup) setCert(cert *tls.Certificate) {
+	old := g.currentCert()
+	g.cert.Store(cert)
+	if old != nil && !bytes.Equal(old.Certificate[0], cert.Certificate[0]) {
+		OCSPManager.NotifyChange(g.OCSPKeyName())
+	}
+}
+
+func (g *sanGroup) currentCert() *tls.Certificate {
+	cert, _ := g.cert.Load().(*tls.Certificate)
+	return cert
+}
+
+// isExpired tells whether cert is expired.
+func isExpired(cert *tls.Certificate) bool {
+	return timeNow().After(cert.Leaf.NotAfter)
+}
+
+type sanGroupManager struct {
+	m        *Manager
+	autoMax  int
+	enabled  bool
+	mu       sync.Mutex
+	members  map[string]*sanGroup // configured member name -> group
+	autoByRD map[string]*sanGroup // registered domain -> automatic group
+}
+
+func newSANGroupManager(m *Manager) *sanGroupManager {
+	gm := &sanGroupManager{
+		m:        m,
+		autoMax:  Cfg.LetsEncrypt.AutoSANGroup.MaxNames,
+		enabled:  Cfg.LetsEncrypt.AutoSANGroup.Enable,
+		members:  make(map[string]*sanGroup),
+		autoByRD: make(map[string]*sanGroup),
+	}
+	for _, conf := range Cfg.LetsEncrypt.SANGroups {
+		group := &sanGroup{Name: conf.Name}
+		for _, name := range conf.Domains {
+			group.members = append(group.members, name)
+			gm.members[name] = group
+		}
+		sort.Strings(group.members)
+	}
+	return gm
+}
+
+// lookup returns the group which name belongs to, or nil if the name
+// doesn't belong to any group. The name must be permitted by host policy.
+// If create is true, an automatic group is created when not exists.
+func (gm *sanGroupManager) lookup(name string, create bool) *sanGroup {
+	if group := gm.members[name]; group != nil {
+		return group
+	}
+	if !gm.enabled {
+		return nil
+	}
+	rd, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return nil
+	}
+	gm.mu.Lock()
+	group := gm.autoByRD[rd]
+	if group == nil && create {
+		group = &sanGroup{Name: autoSANGroupPrefix + rd, auto: true}
+		gm.autoByRD[rd] = group
+	}
+	gm.mu.Unlock()
+	return group
+}
+
+// GetCertificate returns the group certificate for name.
+// It returns nil without error if the name is not in a group, the name
+// is not covered by the group's current certificate, or the certificate
+// is expired, in which case the caller should fallback to get a single
+// domain certificate.
+func (gm *sanGroupManager) GetCertificate(ctx context.Context, name string) (*tls.Certificate, *sanGroup, error) {
+	name = strings.TrimSuffix(name, ".")
+	loadCtx, cancel := context.WithTimeout(detachContext(ctx), 5*time.Minute)
+	defer cancel()
+	group := gm.lookup(name, true)
+	if group == nil {
+		return nil, nil, nil
+	}
+	cert, source, err := gm.load(loadCtx, group, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cert != nil && isExpired(cert) {
+		return nil, nil, nil
+	}
+	if cert == nil || cert.Leaf.VerifyHostname(name) != nil {
+		gm.addMember(loadCtx, group, name)
+		return nil, nil, nil
+	}
+	recordCertSource(ctx, source)
+	OCSPManager.Watch(group.OCSPKeyName(), cert, func() (*tls.Certificate, error) {
+		if cert := group.currentCert(); cert != nil {
+			return cert, nil
+		}
+		return nil, ErrCertfuncNotFound
+	})
+	OCSPManager.OnRevoked(group.OCSPKeyName(), func(revoked *tls.Certificate) {
+		gm.renew(group, revoked)
+	})
+	return cert, group, nil
+}
+
+// Serving returns the group whose current certificate covers name,
+// it returns nil if the certificate for name is not served by a group.
+func (gm *sanGroupManager) Serving(name string) *sanGroup {
+	name = strings.TrimSuffix(name, ".")
+	group := gm.lookup(name, false)
+	if group == nil {
+		return nil
+	}
+	cert := group.currentCert()
+	if cert == nil || isExpired(cert) || cert.Leaf.VerifyHostname(name) != nil {
+		return nil
+	}
+	return group
+}
+
+// load loads the group's certificate from memory or storage, if the
+// certificate is not available, a new one is ordered.
+// It also tells where the certificate comes from.
+func (gm *sanGroupManager) load(ctx context.Context, group *sanGroup, name string) (*tls.Certificate, certSource, error) {
+	if cert := group.currentCert(); cert != nil {
+		return cert, certFromMemory, nil
+	}
+	group.mu.Lock()
+	if cert := group.currentCert(); cert != nil {
+		group.mu.Unlock()
+		return cert, certFromMemory, nil
+	}
+	if done := group.ordering; done != nil {
+		group.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+		group.mu.Lock()
+		source, err := group.source, group.orderErr
+		group.mu.Unlock()
+		if cert := group.currentCert(); cert != nil {
+			return cert, source, nil
+		}
+		return nil, 0, err
+	}
+	done := make(chan struct{})
+	group.ordering = done
+	group.mu.Unlock()
+
+	cert, source, err := gm.loadOrOrder(ctx, group, name)
+
+	group.mu.Lock()
+	group.ordering = nil
+	group.orderErr = err
+	if err == nil {
+		group.source = source
+		group.setCert(cert)
+		gm.scheduleRenewal(group, cert)
+	}
+	group.mu.Unlock()
+	close(done)
+	return cert, source, err
+}
+
+// loadOrOrder loads the group's certificate from storage, or orders
+// a new one. The caller marks the order in flight.
+func (gm *sanGroupManager) loadOrOrder(ctx context.Context, group *sanGroup, name string) (*tls.Certificate, certSource, error) {
+	if group.auto {
+		if err := gm.loadMembers(ctx, group, false); err != nil {
+			return nil, 0, err
+		}
+	}
+	cert, err := loadCertificateFromStore(group.KeyName())
+	if err != nil && err != autocert.ErrCacheMiss {
+		sanGroupLog.Warn("failed load certificate", "group", group.Name, "err", err)
+	}
+	if cert != nil {
+		return cert, certFromStorage, nil
+	}
+	group.mu.Lock()
+	if group.auto && len(group.members) == 0 {
+		group.members = []string{name}
+		if err = saveSANGroupMembers(ctx, group); err != nil {
+			group.mu.Unlock()
+			return nil, 0, err
+		}
+	}
+	group.mu.Unlock()
+	cert, _, err = gm.orderMembers(ctx, group)
+	return cert, certFromIssuer, err
+}
+
+// loadMembers loads the members of an automatic group from storage,
+// once unless reload is true. Members added in memory meanwhile are kept.
+func (gm *sanGroupManager) loadMembers(ctx context.Context, group *sanGroup, reload bool) error {
+	group.mu.Lock()
+	loaded := group.loaded
+	group.mu.Unlock()
+	if loaded && !reload {
+		return nil
+	}
+	members, err := loadSANGroupMembers(ctx, group)
+	if err != nil {
+		return err
+	}
+	group.mu.Lock()
+	seen := make(map[string]bool, len(members))
+	for _, name := range members {
+		seen[name] = true
+	}
+	for _, name := range group.members {
+		if !seen[name] {
+			members = append(members, name)
+		}
+	}
+	sort.Strings(members)
+	group.members = members
+	group.loaded = true
+	group.mu.Unlock()
+	return nil
+}
+
+// addMember adds a new member to an automatic group, the member will
+// be included in the certificate on next renewal.
+func (gm *sanGroupManager) addMember(ctx context.Context, group *sanGroup, name string) {
+	if !group.auto {
+		return
+	}
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	for _, x := range group.members {
+		if x == name {
+			return
+		}
+	}
+	if len(group.members) >= gm.autoMax {
+		return
+	}
+	if at, ok := group.removed[name]; ok && timeNow().Sub(at) < removedMemberTTL {
+		return
+	}
+	group.members = append(group.members, name)
+	sort.Strings(group.members)
+	if err := saveSANGroupMembers(ctx, group); err != nil {
+		sanGroupLog.Warn("failed save group members", "group", group.Name, "err", err)
+		return
+	}
+	sanGroupLog.Info("added new member", "group", group.Name, "domain", name)
+}
+
+// removeMembers removes the failed names from an automatic group, it
+// tells whether any member is removed and members are left.
+func (gm *sanGroupManager) removeMembers(ctx context.Context, group *sanGroup, failed []string) bool {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	isFailed := make(map[string]bool, len(failed))
+	for _, name := range failed {
+		isFailed[name] = true
+	}
+	var members []string
+	for _, name := range group.members {
+		if !isFailed[name] {
+			members = append(members, name)
+		}
+	}
+	if len(members) == len(group.members) || len(members) == 0 {
+		return false
+	}
+	if group.removed == nil {
+		group.removed = make(map[string]time.Time)
+	}
+	for _, name := range group.members {
+		if isFailed[name] {
+			group.removed[name] = timeNow()
+			sanGroupLog.Warn("removed member failed validation", "group", group.Name, "domain", name)
+		}
+	}
+	group.members = members
+	if err := saveSANGroupMembers(ctx, group); err != nil {
+		sanGroupLog.Warn("failed save group members", "group", group.Name, "err", err)
+	}
+	return true
+}
+
+// orderMembers orders a certificate for the group's current members.
+// Members of an automatic group which fail validation are removed, and
+// the certificate is ordered again without them, thus one stale name
+// doesn't fail the whole group. It returns the names ordered.
+func (gm *sanGroupManager) orderMembers(ctx context.Context, group *sanGroup) (*tls.Certificate, []string, error) {
+	for {
+		group.mu.Lock()
+		names := append([]string(nil), group.members...)
+		group.mu.Unlock()
+		cert, err := gm.order(ctx, group, names)
+		if err == nil || !group.auto || !gm.removeMembers(ctx, group, failedDomains(err)) {
+			return cert, names, err
+		}
+	}
+}
+
+// order orders a certificate for the group's members, trying the
+// configured issuers in order.
+func (gm *sanGroupManager) order(ctx context.Context, group *sanGroup, names []string) (cert *tls.Certificate, err error) {
+	keyType := gm.m.DefaultKeyType()
+	for _, iss := range gm.m.issuers {
+		key, keyErr := GeneratePrivateKey(iss.keyAlgorithm(keyType))
+		if keyErr != nil {
+			return nil, keyErr
+		}
+		sanGroupLog.Info("ordering certificate", "group", group.Name, "issuer", iss.Name, "domains", names)
+		cert, err = iss.orderCertificate(ctx, group.KeyName(), names, key)
+		if err == nil {
+			return cert, nil
+		}
+		sanGroupLog.Warn("failed order certificate", "group", group.Name, "issuer", iss.Name, "err", err)
+	}
+	err = fmt.Errorf("san group: failed order certificate: %w", err)
+	emitIssuanceFailed(group.OCSPKeyName(), LetsEncrypt, names, err)
+	return nil, err
+}
+
+// scheduleRenewal resets the group's renewal timer, group.mu must be held.
+func (gm *sanGroupManager) scheduleRenewal(group *sanGroup, cert *tls.Certificate) {
+	if group.timer != nil {
+		group.timer.Stop()
+	}
+	next := gm.nextRenewal(cert.Leaf.NotAfter)
+	group.timer = time.AfterFunc(next, func() { gm.renew(group, nil) })
+}
+
+func (gm *sanGroupManager) nextRenewal(expiry time.Time) time.Duration {
+	renewBefore := time.Duration(Cfg.LetsEncrypt.RenewBefore) * 24 * time.Hour
+	d := expiry.Sub(timeNow()) - renewBefore
+	// add a bit randomness to renew deadline
+	d -= time.Duration(rand63n(int64(renewJitter)))
+	if d < time.Minute {
+		d = time.Minute
+	}
+	return d
+}
+
+// renew re-orders the group's certificate with the current members.
+// It is called by the renewal timer, or when the certificate is revoked,
+// in which case the revoked certificate is given.
+func (gm *sanGroupManager) renew(group *sanGroup, revoked *tls.Certificate) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	group.mu.Lock()
+	for group.ordering != nil {
+		// another order is in flight, which schedules the next renewal,
+		// but a revoked certificate must not be adopted
+		done := group.ordering
+		group.mu.Unlock()
+		if revoked == nil {
+			return
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return
+		}
+		group.mu.Lock()
+	}
+	done := make(chan struct{})
+	group.ordering = done
+	group.mu.Unlock()
+	defer func() {
+		group.mu.Lock()
+		group.ordering = nil
+		group.mu.Unlock()
+		close(done)
+	}()
+
+	if group.auto {
+		gm.loadMembers(ctx, group, true)
+	}
+	group.mu.Lock()
+	names := append([]string(nil), group.members...)
+	group.mu.Unlock()
+
+	// a race is likely unavoidable in a distributed environment,
+	// check storage for certificate renewed by other instances
+	cert, err := loadCertificateFromStore(group.KeyName())
+	if err == nil && gm.nextRenewal(cert.Leaf.NotAfter) > renewJitter &&
+		coversAllNames(cert, names) &&
+		(revoked == nil || !bytes.Equal(cert.Certificate[0], revoked.Certificate[0])) {
+		group.mu.Lock()
+		group.setCert(cert)
+		gm.scheduleRenewal(group, cert)
+		group.mu.Unlock()
+		return
+	}
+
+	cert, names, err = gm.orderMembers(ctx, group)
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	group.orderErr = err
+	if err != nil {
+		sanGroupLog.Error("failed renew certificate", "group", group.Name, "err", err)
+		if revoked != nil {
+			Inventory.RaiseAlert(group.OCSPKeyName(), AlertReissueFailed, "failed reissue revoked certificate: %v", err)
+		}
+		if group.timer != nil {
+			group.timer.Stop()
+		}
+		next := renewJitter / 2
+		next += time.Duration(rand63n(int64(next)))
+		group.timer = time.AfterFunc(next, func() { gm.renew(group, revoked) })
+		return
+	}
+	sanGroupLog.Info("renewed certificate", "group", group.Name, "domains", names)
+	group.setCert(cert)
+	gm.scheduleRenewal(group, cert)
+}
+
+func coversAllNames(cert *tls.Certificate, names []string) bool {
+	for _, name := range names {
+		if cert.Leaf.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func loadSANGroupMembers(ctx context.Context, group *sanGroup) ([]string, error) {
+	data, err := Cfg.Storage.Cache.Get(ctx, group.membersKeyName())
+	if err == autocert.ErrCacheMiss {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	if err = json.Unmarshal(data, &members); err != nil {
+		return nil, fmt.Errorf("unmarshal group members: %v", err)
+	}
+	return members, nil
+}
+
+func saveSANGroupMembers(ctx context.Context, group *sanGroup) error {
+	data, err := json.Marshal(group.members)
+	if err != nil {
+		return err
+	}
+	return Cfg.Storage.Cache.Put(ctx, group.membersKeyName(), data)
+}
+
+func validateSANGroupName(name string) error {
+	if name == "" || strings.ContainsAny(name, "+\\/:*?\"<>|") {
+		return fmt.Errorf("invalid san group name %q", name)
+	}
+	if strings.HasPrefix(name, autoSANGroupPrefix) {
+		return fmt.Errorf("san group name %q is reserved for automatic groups", name)
+	}
+	return nil
+}
@@ -3,8 +3,6 @@ package server
 import (
 	"bytes"
 	"context"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
@@ -36,14 +34,16 @@ func IsSelfSignedAllowed(domain string) bool {
 	return true
 }
 
-func GetSelfSignedCertificate() (*tls.Certificate, error) {
+func GetSelfSignedCertificate(ctx context.Context) (*tls.Certificate, error) {
 	if tlscert, ok := selfSignedCert.Load().(*tls.Certificate); ok {
+		recordCertSource(ctx, certFromMemory)
 		return tlscert, nil
 	}
 
 	selfSignedMu.Lock()
 	defer selfSignedMu.Unlock()
 	if tlscert, ok := selfSignedCert.Load().(*tls.Certificate); ok {
+		recordCertSource(ctx, certFromMemory)
 		return tlscert, nil
 	}
 
@@ -53,7 +53,9 @@ func GetSelfSignedCertificate() (*tls.Certificate, error) {
 		return nil, fmt.Errorf("self_signed: %v", err)
 	}
 	if tlscert != nil {
+		selfSignedLog.Debug("loaded certificate from storage", "cert_key", Cfg.SelfSigned.CertKey)
 		selfSignedCert.Store(tlscert)
+		recordCertSource(ctx, certFromStorage)
 		return tlscert, nil
 	}
 
@@ -62,14 +64,18 @@ func GetSelfSignedCertificate() (*tls.Certificate, error) {
 	if err != nil {
 		return nil, err
 	}
+	selfSignedLog.Info("created new certificate", "cert_key", Cfg.SelfSigned.CertKey)
+	Events.Emit(newCertEvent(EventSelfSignedRegenerated, "self_signed|"+Cfg.SelfSigned.CertKey, SelfSigned, tlscert))
 	selfSignedCert.Store(tlscert)
+	recordCertSource(ctx, certFromIssuer)
 	return tlscert, nil
 }
 
 func createAndSaveSelfSignedCertificate() (*tls.Certificate, error) {
 	validDays := Cfg.SelfSigned.ValidDays
 	organization := Cfg.SelfSigned.Organization
-	certPEM, privKeyPEM, err := CreateSelfSignedCertificate(validDays, organization)
+	keyAlgorithm := Cfg.SelfSigned.KeyAlgorithm
+	certPEM, privKeyPEM, err := CreateSelfSignedCertificate(validDays, organization, keyAlgorithm)
 	if err != nil {
 		return nil, err
 	}
@@ -83,8 +89,8 @@ func createAndSaveSelfSignedCertificate() (*tls.Certificate, error) {
 	return tlscert, nil
 }
 
-func CreateSelfSignedCertificate(validDays int, organization []string) (certPEM, privKeyPEM []byte, err error) {
-	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+func CreateSelfSignedCertificate(validDays int, organization []string, keyAlgorithm string) (certPEM, privKeyPEM []byte, err error) {
+	privKey, err := GeneratePrivateKey(keyAlgorithm)
 	if err != nil {
 		err = fmt.Errorf("self_singed: failed generate private key: %v", err)
 		return
@@ -111,7 +117,7 @@ func CreateSelfSignedCertificate(validDays int, organization []string) (certPEM,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 	}
-	certBytes, err := x509.CreateCertificate(rand.Reader, certificate, certificate, &privKey.PublicKey, privKey)
+	certBytes, err := x509.CreateCertificate(rand.Reader, certificate, certificate, privKey.Public(), privKey)
 	if err != nil {
 		err = fmt.Errorf("self_signed: failed create certificate: %v", err)
 		return
@@ -122,7 +128,10 @@ func CreateSelfSignedCertificate(validDays int, organization []string) (certPEM,
 		Bytes: certBytes,
 	})
 	privKeyBuf := &bytes.Buffer{}
-	_ = EncodeECDSAKey(privKeyBuf, privKey)
+	if err = EncodePrivateKey(privKeyBuf, privKey); err != nil {
+		err = fmt.Errorf("self_signed: failed encode private key: %v", err)
+		return
+	}
 	privKeyPEM = privKeyBuf.Bytes()
 	return
 }
@@ -1,18 +1,154 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/alyx/x/autocert"
 )
 
 func NewDirCache(cacheDir string) (autocert.Cache, error) {
-	return autocert.DirCache(cacheDir), nil
+	return dirCache{autocert.DirCache(cacheDir)}, nil
+}
+
+// KeyLister is implemented by storages which can list the keys stored.
+type KeyLister interface {
+	List(ctx context.Context) ([]string, error)
+}
+
+var ErrListNotSupported = errors.New("storage doesn't support listing keys")
+
+// StorageLocker is implemented by storages which can hold locks shared
+// by the instances using the storage.
+type StorageLocker interface {
+	// Lock waits until the lock of name is acquired or ctx is done.
+	// The lock expires after ttl if not unlocked, e.g. the holder
+	// crashed.
+	Lock(ctx context.Context, name string, ttl time.Duration) (unlock func(), err error)
+}
+
+var ErrLockNotSupported = errors.New("storage doesn't support locking")
+
+const (
+	// storageLockSuffix is appended to the lock names, keys with
+	// the suffix are not listed
+	storageLockSuffix = ".lock"
+
+	storageLockRetry = 50 * time.Millisecond
+)
+
+// lockStorage acquires the lock of name in the configured storage.
+func lockStorage(ctx context.Context, name string, ttl time.Duration) (func(), error) {
+	locker, ok := Cfg.Storage.Cache.(StorageLocker)
+	if !ok {
+		return nil, ErrLockNotSupported
+	}
+	return locker.Lock(ctx, name, ttl)
+}
+
+// newLockToken returns a random token which identifies the lock holder.
+func newLockToken() string {
+	var token [16]byte
+	rand.Read(token[:])
+	return hex.EncodeToString(token[:])
+}
+
+// waitLockRetry waits before trying to acquire a lock again.
+func waitLockRetry(ctx context.Context) error {
+	timer := time.NewTimer(storageLockRetry)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// listStorageKeys returns all keys in the configured storage.
+func listStorageKeys(ctx context.Context) ([]string, error) {
+	lister, ok := Cfg.Storage.Cache.(KeyLister)
+	if !ok {
+		return nil, ErrListNotSupported
+	}
+	return lister.List(ctx)
+}
+
+type dirCache struct {
+	autocert.DirCache
+}
+
+// List returns names of the files in the directory.
+func (d dirCache) List(ctx context.Context) ([]string, error) {
+	files, err := ioutil.ReadDir(string(d.DirCache))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	keys := make([]string, 0, len(files))
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && !strings.HasSuffix(fi.Name(), storageLockSuffix) {
+			keys = append(keys, fi.Name())
+		}
+	}
+	return keys, nil
+}
+
+// Lock acquires the lock by creating a lock file exclusively, a lock
+// file older than ttl is taken over.
+func (d dirCache) Lock(ctx context.Context, name string, ttl time.Duration) (func(), error) {
+	if err := os.MkdirAll(string(d.DirCache), 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(string(d.DirCache), name+storageLockSuffix)
+	token := []byte(newLockToken())
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.Write(token)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			unlock := func() {
+				// don't remove the lock taken over by others after expired
+				if data, err := ioutil.ReadFile(path); err == nil && bytes.Equal(data, token) {
+					os.Remove(path)
+				}
+			}
+			return unlock, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > ttl {
+			os.Remove(path)
+			continue
+		}
+		if err = waitLockRetry(ctx); err != nil {
+			return nil, err
+		}
+	}
 }
 
 // loadCertificateFromStore loads certificate from storage, if the certificate
@@ -26,25 +162,93 @@ func loadCertificateFromStore(certKey string) (*tls.Certificate, error) {
 	return parseCertificate(data)
 }
 
+// parseCertificate parses certificate data which contains a private key
+// and certificate chain in PEM format, in any order.
+// The private key can be in PKCS#1, PKCS#8 or SEC 1 format, RSA, ECDSA
+// and Ed25519 keys are supported.
 func parseCertificate(data []byte) (*tls.Certificate, error) {
-	priv, pubPEM := pem.Decode(data)
-	if priv == nil || !strings.Contains(priv.Type, "PRIVATE") {
-		return nil, errors.New("no private key found")
-	}
-	privPEM := pem.EncodeToMemory(priv)
-	tlscert, err := tls.X509KeyPair(pubPEM, privPEM)
+	tlscert, err := parseKeyPair(data)
 	if err != nil {
 		return nil, err
 	}
-
 	now := timeNow()
-	leaf, _ := x509.ParseCertificate(tlscert.Certificate[0])
-	if now.Before(leaf.NotBefore) {
+	if now.Before(tlscert.Leaf.NotBefore) {
 		return nil, errors.New("certificate is not valid yet")
 	}
-	if now.After(leaf.NotAfter) {
+	if now.After(tlscert.Leaf.NotAfter) {
 		return nil, errors.New("certificate is expired")
 	}
-	tlscert.Leaf = leaf
+	return tlscert, nil
+}
+
+// parseKeyPair is like parseCertificate, but it doesn't check the
+// validity period of the certificate.
+func parseKeyPair(data []byte) (*tls.Certificate, error) {
+	var privPEM, pubPEM []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if strings.Contains(block.Type, "PRIVATE") {
+			if privPEM != nil {
+				return nil, errors.New("multiple private keys found")
+			}
+			privPEM = pem.EncodeToMemory(block)
+		} else if block.Type == "CERTIFICATE" {
+			pubPEM = append(pubPEM, pem.EncodeToMemory(block)...)
+		}
+	}
+	if privPEM == nil {
+		return nil, errors.New("no private key found")
+	}
+	tlscert, err := tls.X509KeyPair(pubPEM, privPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	tlscert.Leaf, err = x509.ParseCertificate(tlscert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
 	return &tlscert, nil
 }
+
+// parsePrivateKeyPEM parses the first private key in PEM data.
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found")
+		}
+		if strings.Contains(block.Type, "PRIVATE") {
+			return parsePrivateKey(block.Bytes)
+		}
+	}
+}
+
+// parsePrivateKey parses a DER encoded private key in PKCS#1, PKCS#8
+// or SEC 1 format.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case *ecdsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		default:
+			return nil, errors.New("unknown private key type in PKCS#8 wrapping")
+		}
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("failed to parse private key")
+}
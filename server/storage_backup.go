@@ -0,0 +1,326 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/alyx/x/autocert"
+	"golang.org/x/crypto/scrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// OpenStorage opens a storage by spec, which is "dir_cache:<dir>",
+// "redis:<addr>", a redis URL, or path of a configuration file whose storage
+// section is used.
+func OpenStorage(spec string) (autocert.Cache, error) {
+	switch {
+	case strings.HasPrefix(spec, "dir_cache:"):
+		return NewDirCache(strings.TrimPrefix(spec, "dir_cache:"))
+	case strings.HasPrefix(spec, "redis://"), strings.HasPrefix(spec, "rediss://"):
+		return NewRedisCache(spec, "")
+	case strings.HasPrefix(spec, "redis:"):
+		return NewRedisCache(strings.TrimPrefix(spec, "redis:"), "")
+	}
+	confbuf, err := ioutil.ReadFile(spec)
+	if err != nil {
+		return nil, err
+	}
+	var conf config
+	if err = yaml.Unmarshal(confbuf, &conf); err != nil {
+		return nil, fmt.Errorf("failed read configuration: %v", err)
+	}
+	setDefault(&conf.Storage.Type, "dir_cache")
+	setDefault(&conf.Storage.DirCache, "./secret-dir")
+	setDefault(&conf.Storage.Redis.Addr, "127.0.0.1:6379")
+	switch conf.Storage.Type {
+	case "dir_cache":
+		return NewDirCache(conf.Storage.DirCache)
+	case "redis":
+		return NewRedisCache(conf.Storage.Redis.Addr, conf.Storage.Redis.KeyPrefix)
+	}
+	return nil, fmt.Errorf("unknown storage type %q", conf.Storage.Type)
+}
+
+func listKeys(ctx context.Context, cache autocert.Cache) ([]string, error) {
+	lister, ok := cache.(KeyLister)
+	if !ok {
+		return nil, ErrListNotSupported
+	}
+	keys, err := lister.List(ctx)
+	sort.Strings(keys)
+	return keys, err
+}
+
+// readEntries reads all entries of cache.
+func readEntries(ctx context.Context, cache autocert.Cache) ([]backupData, error) {
+	keys, err := listKeys(ctx, cache)
+	if err != nil {
+		return nil, err
+	}
+	var entries []backupData
+	for _, key := range keys {
+		data, err := cache.Get(ctx, key)
+		if err == autocert.ErrCacheMiss {
+			continue // deleted after listing
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		entries = append(entries, backupData{key: key, data: data})
+	}
+	return entries, nil
+}
+
+// writeEntries puts the entries into dst, each entry is verified by
+// reading back. Existing entries with different data are overwritten
+// only if overwrite is true, else nothing is written.
+func writeEntries(ctx context.Context, dst autocert.Cache, entries []backupData, overwrite bool) ([]string, error) {
+	if !overwrite {
+		var conflicts []string
+		for _, x := range entries {
+			old, err := dst.Get(ctx, x.key)
+			if err != nil && err != autocert.ErrCacheMiss {
+				return nil, fmt.Errorf("%s: %v", x.key, err)
+			}
+			if err == nil && !bytes.Equal(old, x.data) {
+				conflicts = append(conflicts, x.key)
+			}
+		}
+		if len(conflicts) > 0 {
+			return nil, fmt.Errorf("entries exist with different data: %s", strings.Join(conflicts, ", "))
+		}
+	}
+	var written []string
+	for _, x := range entries {
+		if err := dst.Put(ctx, x.key, x.data); err != nil {
+			return written, fmt.Errorf("%s: %v", x.key, err)
+		}
+		check, err := dst.Get(ctx, x.key)
+		if err != nil {
+			return written, fmt.Errorf("%s: failed verify: %v", x.key, err)
+		}
+		if !bytes.Equal(check, x.data) {
+			return written, fmt.Errorf("%s: failed verify: data mismatch", x.key)
+		}
+		written = append(written, x.key)
+	}
+	return written, nil
+}
+
+// MigrateStorage copies all entries from src to dst, see writeEntries.
+// It returns the keys copied.
+func MigrateStorage(ctx context.Context, src, dst autocert.Cache, overwrite bool) ([]string, error) {
+	entries, err := readEntries(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	return writeEntries(ctx, dst, entries, overwrite)
+}
+
+// Backup archive format:
+//
+//	magic "SCSBACKUP1\n" | salt (16 bytes) | nonce (12 bytes) | ciphertext
+//
+// The ciphertext is the gzip compressed tar archive sealed by AES-256-GCM,
+// with key derived from the password by scrypt. The tar archive contains
+// "manifest.json" followed by the entries as "data/<key>", the manifest
+// records SHA-256 checksum of each entry.
+const (
+	backupMagic        = "SCSBACKUP1\n"
+	backupManifestName = "manifest.json"
+	backupDataPrefix   = "data/"
+)
+
+var ErrBackupPassword = errors.New("backup: wrong password or corrupted archive")
+
+type backupManifest struct {
+	Version   int            `json:"version"`
+	CreatedAt int64          `json:"created_at"` // seconds since epoch
+	Entries   []*backupEntry `json:"entries"`
+}
+
+type backupEntry struct {
+	Key    string `json:"key"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupStorage writes an encrypted archive of all entries in cache to w.
+// It returns the keys backed up.
+func BackupStorage(ctx context.Context, cache autocert.Cache, w io.Writer, password string) ([]string, error) {
+	if password == "" {
+		return nil, errors.New("backup: password required")
+	}
+	all, err := readEntries(ctx, cache)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &backupManifest{Version: 1, CreatedAt: timeNow().Unix()}
+	entries := make(map[string][]byte)
+	for _, x := range all {
+		checksum := sha256.Sum256(x.data)
+		manifest.Entries = append(manifest.Entries, &backupEntry{
+			Key:    x.key,
+			Size:   len(x.data),
+			SHA256: hex.EncodeToString(checksum[:]),
+		})
+		entries[x.key] = x.data
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	writeFile := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: timeNow()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	manifestData, _ := json.MarshalIndent(manifest, "", "  ")
+	if err = writeFile(backupManifestName, manifestData); err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, x := range manifest.Entries {
+		if err = writeFile(backupDataPrefix+x.Key, entries[x.Key]); err != nil {
+			return nil, err
+		}
+		out = append(out, x.Key)
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := backupCipher(password, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := append(append([]byte(backupMagic), salt...), nonce...)
+	sealed := aead.Seal(nil, nonce, buf.Bytes(), header)
+	if _, err = w.Write(append(header, sealed...)); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RestoreStorage decrypts the archive read from r, verifies the
+// checksums, then puts the entries into cache, see writeEntries.
+// It returns the keys restored.
+func RestoreStorage(ctx context.Context, cache autocert.Cache, r io.Reader, password string, overwrite bool) ([]string, error) {
+	entries, err := readBackup(r, password)
+	if err != nil {
+		return nil, err
+	}
+	return writeEntries(ctx, cache, entries, overwrite)
+}
+
+type backupData struct {
+	key  string
+	data []byte
+}
+
+func readBackup(r io.Reader, password string) ([]backupData, error) {
+	archive, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	headerLen := len(backupMagic) + 16 + 12
+	if len(archive) < headerLen || string(archive[:len(backupMagic)]) != backupMagic {
+		return nil, errors.New("backup: not a backup archive")
+	}
+	header := archive[:headerLen]
+	salt := header[len(backupMagic) : len(backupMagic)+16]
+	nonce := header[len(backupMagic)+16:]
+	aead, err := backupCipher(password, salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, nonce, archive[headerLen:], header)
+	if err != nil {
+		return nil, ErrBackupPassword
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+	tr := tar.NewReader(zr)
+	var manifest *backupManifest
+	files := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("backup: %v", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("backup: %v", err)
+		}
+		if hdr.Name == backupManifestName {
+			manifest = &backupManifest{}
+			if err = json.Unmarshal(data, manifest); err != nil {
+				return nil, fmt.Errorf("backup: invalid manifest: %v", err)
+			}
+			continue
+		}
+		files[strings.TrimPrefix(hdr.Name, backupDataPrefix)] = data
+	}
+	if manifest == nil {
+		return nil, errors.New("backup: missing manifest")
+	}
+	out := make([]backupData, 0, len(manifest.Entries))
+	for _, x := range manifest.Entries {
+		data, ok := files[x.Key]
+		if !ok {
+			return nil, fmt.Errorf("backup: missing entry %s", x.Key)
+		}
+		checksum := sha256.Sum256(data)
+		if len(data) != x.Size || hex.EncodeToString(checksum[:]) != x.SHA256 {
+			return nil, fmt.Errorf("backup: checksum mismatch of entry %s", x.Key)
+		}
+		out = append(out, backupData{key: x.Key, data: data})
+	}
+	return out, nil
+}
+
+func backupCipher(password string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(password), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
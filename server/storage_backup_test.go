@@ -0,0 +1,131 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+// sealBackup builds an archive of the files like BackupStorage.
+func sealBackup(t *testing.T, password string, files map[string][]byte, names []string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, name := range names {
+		data := files[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+	tw.Close()
+	zw.Close()
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	aead, err := backupCipher(password, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	header := append(append([]byte(backupMagic), salt...), nonce...)
+	return append(header, aead.Seal(nil, nonce, buf.Bytes(), header)...)
+}
+
+func TestReadBackup(t *testing.T) {
+	const password = "s3cret"
+	ctx := context.Background()
+	src, _ := NewDirCache(t.TempDir())
+	entries := map[string][]byte{
+		"example.com":      []byte("certificate"),
+		"example.com+rsa":  []byte("rsa certificate"),
+		"acme_account+key": []byte("account key"),
+		"empty":            {},
+	}
+	for key, data := range entries {
+		if err := src.Put(ctx, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var archive bytes.Buffer
+	keys, err := BackupStorage(ctx, src, &archive, password)
+	if err != nil || len(keys) != len(entries) {
+		t.Fatalf("BackupStorage = %v, %v", keys, err)
+	}
+
+	got, err := readBackup(bytes.NewReader(archive.Bytes()), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("got %d entries, want %d", len(got), len(entries))
+	}
+	for _, x := range got {
+		if want, ok := entries[x.key]; !ok || !bytes.Equal(x.data, want) {
+			t.Errorf("entry %s = %q, want %q", x.key, x.data, want)
+		}
+	}
+
+	data := []byte("certificate")
+	checksum := sha256.Sum256(data)
+	manifest := func(entries ...*backupEntry) []byte {
+		b, _ := json.Marshal(&backupManifest{Version: 1, Entries: entries})
+		return b
+	}
+	goodEntry := &backupEntry{Key: "example.com", Size: len(data), SHA256: hex.EncodeToString(checksum[:])}
+	tamper := func(offset int) []byte {
+		b := append([]byte(nil), archive.Bytes()...)
+		if offset < 0 {
+			offset += len(b)
+		}
+		b[offset] ^= 0xff
+		return b
+	}
+
+	tests := []struct {
+		name     string
+		archive  []byte
+		password string
+		wantErr  bool
+		err      error // the specific error wanted, if not nil
+	}{
+		{"wrong password", archive.Bytes(), "wrong", true, ErrBackupPassword},
+		{"tampered ciphertext", tamper(-20), password, true, ErrBackupPassword},
+		{"tampered tag", tamper(-1), password, true, ErrBackupPassword},
+		{"tampered salt", tamper(len(backupMagic)), password, true, ErrBackupPassword},
+		{"tampered nonce", tamper(len(backupMagic) + 16), password, true, ErrBackupPassword},
+		{"tampered magic", tamper(0), password, true, nil},
+		{"truncated", archive.Bytes()[:len(backupMagic)+20], password, true, nil},
+		{"good", sealBackup(t, password, map[string][]byte{
+			backupManifestName:               manifest(goodEntry),
+			backupDataPrefix + "example.com": data,
+		}, []string{backupManifestName, backupDataPrefix + "example.com"}), password, false, nil},
+		{"checksum mismatch", sealBackup(t, password, map[string][]byte{
+			backupManifestName:               manifest(goodEntry),
+			backupDataPrefix + "example.com": []byte("certificatE"),
+		}, []string{backupManifestName, backupDataPrefix + "example.com"}), password, true, nil},
+		{"size mismatch", sealBackup(t, password, map[string][]byte{
+			backupManifestName:               manifest(goodEntry),
+			backupDataPrefix + "example.com": []byte("certificate\n"),
+		}, []string{backupManifestName, backupDataPrefix + "example.com"}), password, true, nil},
+		{"missing entry", sealBackup(t, password, map[string][]byte{
+			backupManifestName: manifest(goodEntry),
+		}, []string{backupManifestName}), password, true, nil},
+		{"missing manifest", sealBackup(t, password, map[string][]byte{
+			backupDataPrefix + "example.com": data,
+		}, []string{backupDataPrefix + "example.com"}), password, true, nil},
+	}
+	for _, tt := range tests {
+		_, err := readBackup(bytes.NewReader(tt.archive), tt.password)
+		if (err != nil) != tt.wantErr || (tt.err != nil && err != tt.err) {
+			t.Errorf("%s: readBackup error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -2,33 +2,135 @@ package server
 
 import (
 	"context"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/alyx/x/autocert"
 	"github.com/go-redis/redis/v8"
 )
 
-func NewRedisCache(redisURL string) (autocert.Cache, error) {
+// NewRedisCache returns a storage backed by Redis, keys are stored with
+// keyPrefix, which can also be given by query parameter "key_prefix" of
+// redisURL.
+func NewRedisCache(redisURL string, keyPrefix string) (autocert.Cache, error) {
+	// plain address "host:port" is accepted as well as redis URL
+	if !strings.Contains(redisURL, "://") {
+		redisURL = "redis://" + redisURL
+	}
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	if query := u.Query(); query.Has("key_prefix") {
+		if keyPrefix == "" {
+			keyPrefix = query.Get("key_prefix")
+		}
+		query.Del("key_prefix")
+		u.RawQuery = query.Encode()
+		redisURL = u.String()
+	}
 	opt, err := redis.ParseURL(redisURL)
 	if err != nil {
 		return nil, err
 	}
-	cache := &rediscache{}
+	cache := &rediscache{prefix: keyPrefix}
 	cache.client = redis.NewClient(opt)
 	return cache, nil
 }
 
 type rediscache struct {
 	client *redis.Client
+	prefix string
 }
 
 func (c *rediscache) Get(ctx context.Context, key string) ([]byte, error) {
-	return c.client.Get(ctx, key).Bytes()
+	data, err := c.client.Get(ctx, c.prefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
 }
 
 func (c *rediscache) Put(ctx context.Context, key string, data []byte) error {
-	return c.client.Set(ctx, key, data, 0).Err()
+	return c.client.Set(ctx, c.prefix+key, data, 0).Err()
 }
 
 func (c *rediscache) Delete(ctx context.Context, key string) error {
-	return c.client.Del(ctx, key).Err()
+	return c.client.Del(ctx, c.prefix+key).Err()
+}
+
+// redisUnlockScript deletes the lock only if it's still held by
+// the token, which may be taken over by others after expired.
+var redisUnlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// Lock acquires the lock by SET NX with ttl.
+func (c *rediscache) Lock(ctx context.Context, name string, ttl time.Duration) (func(), error) {
+	key := c.prefix + name + storageLockSuffix
+	token := newLockToken()
+	for {
+		ok, err := c.client.SetNX(ctx, key, token, ttl).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if err = waitLockRetry(ctx); err != nil {
+			return nil, err
+		}
+	}
+	unlock := func() {
+		redisUnlockScript.Run(context.Background(), c.client, []string{key}, token)
+	}
+	return unlock, nil
+}
+
+// List returns the keys with the key prefix by SCAN, the prefix is
+// trimmed. All keys in the database are returned if the prefix is
+// empty, thus the database should be dedicated to the server.
+func (c *rediscache) List(ctx context.Context) ([]string, error) {
+	var scanned []string
+	iter := c.client.Scan(ctx, 0, escapeRedisPattern(c.prefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		scanned = append(scanned, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return trimRedisKeys(c.prefix, scanned), nil
+}
+
+// trimRedisKeys trims the prefix of the scanned keys, the locks are
+// skipped. SCAN may return a key more than once, the duplicates are
+// removed.
+func trimRedisKeys(prefix string, scanned []string) []string {
+	seen := make(map[string]bool, len(scanned))
+	keys := make([]string, 0, len(scanned))
+	for _, key := range scanned {
+		if seen[key] || !strings.HasPrefix(key, prefix) || strings.HasSuffix(key, storageLockSuffix) {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, strings.TrimPrefix(key, prefix))
+	}
+	return keys
+}
+
+// escapeRedisPattern escapes the special characters of glob-style
+// patterns used by SCAN.
+func escapeRedisPattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
 }
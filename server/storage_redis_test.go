@@ -0,0 +1,89 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewRedisCacheKeyPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		keyPrefix  string
+		wantPrefix string
+		wantAddr   string
+	}{
+		{"plain address", "127.0.0.1:6379", "", "", "127.0.0.1:6379"},
+		{"config value", "redis://127.0.0.1:6379", "cfg:", "cfg:", "127.0.0.1:6379"},
+		{"url parameter", "127.0.0.1:6380?key_prefix=url:", "", "url:", "127.0.0.1:6380"},
+		{"config value wins", "redis://127.0.0.1:6379/0?key_prefix=url:", "cfg:", "cfg:", "127.0.0.1:6379"},
+		{"other parameters kept", "redis://127.0.0.1:6379/2?dial_timeout=3s&key_prefix=url:", "", "url:", "127.0.0.1:6379"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the unknown parameter key_prefix fails parsing if not removed
+			cache, err := NewRedisCache(tt.url, tt.keyPrefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := cache.(*rediscache)
+			defer c.client.Close()
+			if c.prefix != tt.wantPrefix {
+				t.Errorf("prefix = %q, want %q", c.prefix, tt.wantPrefix)
+			}
+			if addr := c.client.Options().Addr; addr != tt.wantAddr {
+				t.Errorf("addr = %q, want %q", addr, tt.wantAddr)
+			}
+		})
+	}
+
+	cache, err := NewRedisCache("redis://127.0.0.1:6379/2?dial_timeout=3s&key_prefix=url:", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.(*rediscache).client.Close()
+	opt := cache.(*rediscache).client.Options()
+	if opt.DB != 2 || opt.DialTimeout != 3*time.Second {
+		t.Errorf("db = %d, dial_timeout = %v, want 2, 3s", opt.DB, opt.DialTimeout)
+	}
+}
+
+func TestEscapeRedisPattern(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"ssl:", "ssl:"},
+		{"a*b?c", `a\*b\?c`},
+		{"[x]", `\[x\]`},
+		{`a\b`, `a\\b`},
+		{"证书:", "证书:"},
+	}
+	for _, tt := range tests {
+		if got := escapeRedisPattern(tt.in); got != tt.want {
+			t.Errorf("escapeRedisPattern(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTrimRedisKeys(t *testing.T) {
+	scanned := []string{
+		"ssl:example.com",
+		"ssl:events+outbox",
+		"ssl:events+outbox.lock",
+		"ssl:example.com", // returned again by SCAN
+		"ssl:ssl:nested",
+		"other:key",
+	}
+	got := trimRedisKeys("ssl:", scanned)
+	want := []string{"example.com", "events+outbox", "ssl:nested"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("trimRedisKeys = %q, want %q", got, want)
+	}
+
+	got = trimRedisKeys("", []string{"a", "b", "a"})
+	if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("trimRedisKeys without prefix = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseKeyPair(t *testing.T) {
+	newPair := func(algo string) (certPEM, keyPEM []byte) {
+		certPEM, keyPEM, err := CreateSelfSignedCertificate(1, []string{"test"}, algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certPEM, keyPEM
+	}
+	certP256, keyP256 := newPair(KeyAlgoP256)
+	certEd25519, keyEd25519 := newPair(KeyAlgoEd25519)
+	_, otherKey := newPair(KeyAlgoP256)
+	concat := func(blocks ...[]byte) []byte { return bytes.Join(blocks, nil) }
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+		chain   int
+	}{
+		{"key first", concat(keyP256, certP256), false, 1},
+		{"cert first", concat(certP256, keyP256), false, 1},
+		{"chain", concat(keyP256, certP256, certEd25519), false, 2},
+		{"ed25519", concat(keyEd25519, certEd25519), false, 1},
+		{"garbage around", concat([]byte("junk\n"), keyP256, []byte("junk\n"), certP256), false, 1},
+		{"no key", certP256, true, 0},
+		{"no certificate", keyP256, true, 0},
+		{"multiple keys", concat(keyP256, otherKey, certP256), true, 0},
+		{"mismatched key", concat(otherKey, certP256), true, 0},
+		{"empty", nil, true, 0},
+	}
+	for _, tt := range tests {
+		cert, err := parseKeyPair(tt.data)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseKeyPair error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if cert.Leaf == nil || len(cert.Certificate) != tt.chain {
+			t.Errorf("%s: got leaf %v and %d certificates, want %d", tt.name, cert.Leaf != nil, len(cert.Certificate), tt.chain)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alyx/x/autocert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/jxskiss/ssl-cert-server/server"
+
+// tracer is a no-op tracer until InitTracing installs the tracer provider.
+var tracer = otel.Tracer(tracerName)
+
+var tracerProvider *sdktrace.TracerProvider
+
+// autocertSpans tracks the spans waiting for autocert to get
+// certificates, autocert creates contexts of its own, thus the storage
+// and ACME requests made by autocert are correlated by OCSP key name,
+// which tells both the domain name and key type.
+var autocertSpans sync.Map // OCSP key name -> *trace.SpanContext
+
+// InitTracing sets up propagation of the trace context, and exporting
+// spans by OTLP over HTTP if tracing is enabled.
+func InitTracing() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	if !Cfg.Tracing.Enable {
+		return
+	}
+	endpoint, err := url.Parse(Cfg.Tracing.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		Fatal(serverLog, "invalid tracing endpoint", "endpoint", Cfg.Tracing.Endpoint)
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host)}
+	if endpoint.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if endpoint.Path != "" && endpoint.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(endpoint.Path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		Fatal(serverLog, "failed create trace exporter", "err", err)
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(Cfg.Tracing.ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(Cfg.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+}
+
+// ShutdownTracing exports the pending spans and stops the tracer provider.
+func ShutdownTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		serverLog.Warn("failed shutdown tracer provider", "err", err)
+	}
+}
+
+// tracingMiddleware starts a span for each request, named by the route
+// pattern registered to mux, the trace context sent by clients is
+// continued.
+func tracingMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, route := mux.Handler(req)
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, req.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(req.Method),
+				semconv.HTTPRouteKey.String(route),
+				semconv.HTTPTargetKey.String(req.RequestURI),
+			))
+		defer span.End()
+		lrw := &loggingResponseWriter{w, http.StatusOK}
+		next.ServeHTTP(lrw, req.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(lrw.statusCode))
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(lrw.statusCode))
+	})
+}
+
+// endSpan records err to span if it's not nil, then ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// detachContext returns a context carrying the span of ctx, but not
+// canceled with ctx, it's used when the work should not be interrupted
+// by the caller, e.g. ordering a certificate.
+func detachContext(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
+
+// startAutocertSpan starts a span waiting for autocert to get
+// certificate for domain, the returned function must be called to
+// end the span.
+func startAutocertSpan(ctx context.Context, ocspKeyName string, domain string, keyType string, issuer string) func(err error) {
+	_, span := tracer.Start(ctx, "autocert.GetCertificate", trace.WithAttributes(
+		attribute.String("domain", domain),
+		attribute.String("key_type", keyType),
+		attribute.String("issuer", issuer),
+	))
+	sc := span.SpanContext()
+	autocertSpans.Store(ocspKeyName, &sc)
+	return func(err error) {
+		autocertSpans.CompareAndDelete(ocspKeyName, &sc)
+		endSpan(span, err)
+	}
+}
+
+// autocertParent returns ctx with the span waiting for the first of
+// ocspKeyNames if ctx carries no span.
+func autocertParent(ctx context.Context, ocspKeyNames ...string) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	for _, keyName := range ocspKeyNames {
+		if sc, ok := autocertSpans.Load(keyName); ok {
+			return trace.ContextWithSpanContext(ctx, *sc.(*trace.SpanContext))
+		}
+	}
+	return ctx
+}
+
+// domainSpanKeys returns the OCSP key names of the certificates of
+// domain of both key types, an ACME order tells only the domain name.
+func domainSpanKeys(domain string) []string {
+	return []string{
+		autocertOCSPKeyName(domain),
+		autocertOCSPKeyName(domain + "+rsa"),
+	}
+}
+
+// storageSpanKeys returns the OCSP key names of the certificates which
+// the storage key written by autocert belongs to, e.g. "example.com+rsa"
+// belongs to the RSA certificate, while the challenge certificate
+// "example.com+token" belongs to either key type.
+func storageSpanKeys(key string) []string {
+	i := strings.IndexByte(key, '+')
+	if i <= 0 {
+		return []string{autocertOCSPKeyName(key)}
+	}
+	if key[i+1:] == "rsa" {
+		return []string{autocertOCSPKeyName(key)}
+	}
+	return domainSpanKeys(key[:i])
+}
+
+// tracingCache traces the storage operations, the operations made by
+// autocert are traced under the span waiting for the certificate.
+type tracingCache struct {
+	autocert.Cache
+	backend string
+}
+
+func newTracingCache(backend string, cache autocert.Cache) autocert.Cache {
+	return &tracingCache{Cache: cache, backend: backend}
+}
+
+func (c *tracingCache) startSpan(ctx context.Context, operation string, key string) (context.Context, trace.Span) {
+	ctx = autocertParent(ctx, storageSpanKeys(key)...)
+	return tracer.Start(ctx, "storage."+operation, trace.WithAttributes(
+		attribute.String("backend", c.backend),
+		attribute.String("key", key),
+	))
+}
+
+func endStorageSpan(span trace.Span, err error) {
+	result := storageResult(err)
+	span.SetAttributes(attribute.String("result", result))
+	if result == "error" {
+		endSpan(span, err)
+	} else {
+		span.End()
+	}
+}
+
+func (c *tracingCache) Get(ctx context.Context, key string) (data []byte, err error) {
+	ctx, span := c.startSpan(ctx, "get", key)
+	defer func() { endStorageSpan(span, err) }()
+	return c.Cache.Get(ctx, key)
+}
+
+func (c *tracingCache) Put(ctx context.Context, key string, data []byte) (err error) {
+	ctx, span := c.startSpan(ctx, "put", key)
+	defer func() { endStorageSpan(span, err) }()
+	return c.Cache.Put(ctx, key, data)
+}
+
+func (c *tracingCache) Delete(ctx context.Context, key string) (err error) {
+	ctx, span := c.startSpan(ctx, "delete", key)
+	defer func() { endStorageSpan(span, err) }()
+	return c.Cache.Delete(ctx, key)
+}
+
+func (c *tracingCache) List(ctx context.Context) (keys []string, err error) {
+	lister, ok := c.Cache.(KeyLister)
+	if !ok {
+		return nil, ErrListNotSupported
+	}
+	ctx, span := c.startSpan(ctx, "list", "")
+	defer func() { endStorageSpan(span, err) }()
+	return lister.List(ctx)
+}
+
+func (c *tracingCache) Lock(ctx context.Context, name string, ttl time.Duration) (unlock func(), err error) {
+	locker, ok := c.Cache.(StorageLocker)
+	if !ok {
+		return nil, ErrLockNotSupported
+	}
+	ctx, span := c.startSpan(ctx, "lock", name)
+	defer func() { endStorageSpan(span, err) }()
+	return locker.Lock(ctx, name, ttl)
+}
+
+// acmeTracingTransport traces the ACME requests, requests of an order
+// are traced under the span which waits for the order, the order's URLs
+// are learned from the responses.
+type acmeTracingTransport struct {
+	issuer       string
+	directoryURL string
+	next         http.RoundTripper
+
+	mu       sync.Mutex
+	newOrder string
+	steps    map[string]acmeStep // URLs of orders
+}
+
+// acmeStep is a step of an ACME order, which is requested by an URL.
+type acmeStep struct {
+	name   string
+	parent trace.SpanContext
+}
+
+func newACMETracingTransport(issuer string, directoryURL string, next http.RoundTripper) *acmeTracingTransport {
+	return &acmeTracingTransport{
+		issuer:       issuer,
+		directoryURL: directoryURL,
+		next:         next,
+		steps:        make(map[string]acmeStep),
+	}
+}
+
+func (t *acmeTracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parentCtx, step := t.parentContext(req)
+	ctx, span := tracer.Start(parentCtx, "acme "+step,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("issuer", t.issuer),
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.HTTPURLKey.String(req.URL.String()),
+		))
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err == nil {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(resp.StatusCode))
+		t.learnSteps(req, resp, trace.SpanContextFromContext(parentCtx))
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+// parentContext returns context of the request with the span of the
+// order which the request belongs to, and name of the step.
+func (t *acmeTracingTransport) parentContext(req *http.Request) (context.Context, string) {
+	ctx := req.Context()
+	reqURL := req.URL.String()
+	t.mu.Lock()
+	step, known := t.steps[reqURL]
+	isNewOrder := req.Method == "POST" && t.newOrder != "" && reqURL == t.newOrder
+	t.mu.Unlock()
+
+	name := "request"
+	switch {
+	case req.Method == "GET" && reqURL == t.directoryURL:
+		name = "directory"
+	case req.Method == "HEAD":
+		name = "nonce"
+	case isNewOrder:
+		name = "new-order"
+	case known:
+		name = step.name
+	}
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, name
+	}
+	if known {
+		return trace.ContextWithSpanContext(ctx, step.parent), name
+	}
+	if isNewOrder {
+		for _, domain := range orderIdentifiers(req) {
+			if parent := autocertParent(ctx, domainSpanKeys(domain)...); parent != ctx {
+				return parent, name
+			}
+		}
+	}
+	return ctx, name
+}
+
+// learnSteps learns the URLs of the order traced by parent from
+// the response.
+func (t *acmeTracingTransport) learnSteps(req *http.Request, resp *http.Response, parent trace.SpanContext) {
+	reqURL := req.URL.String()
+	isDirectory := req.Method == "GET" && reqURL == t.directoryURL
+	if !isDirectory && (req.Method != "POST" || !parent.IsValid()) {
+		return
+	}
+	obj, ok := readACMEObject(resp)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if isDirectory {
+		t.newOrder = obj.NewOrder
+		return
+	}
+	if t.newOrder != "" && reqURL == t.newOrder {
+		t.learnStep(parent, "order", resp.Header.Get("Location"))
+	}
+	t.learnStep(parent, "finalize", obj.Finalize)
+	t.learnStep(parent, "certificate", obj.Certificate)
+	for _, authz := range obj.Authorizations {
+		t.learnStep(parent, "authorization", authz)
+	}
+	for _, chal := range obj.Challenges {
+		t.learnStep(parent, "challenge", chal.URL)
+		t.learnStep(parent, "challenge", chal.URI)
+	}
+}
+
+// learnStep remembers the URL as a step of the order traced by parent.
+// The caller must hold t.mu.
+func (t *acmeTracingTransport) learnStep(parent trace.SpanContext, name string, stepURL string) {
+	if stepURL == "" {
+		return
+	}
+	if len(t.steps) >= 1000 {
+		t.steps = make(map[string]acmeStep)
+	}
+	t.steps[stepURL] = acmeStep{name: name, parent: parent}
+}
+
+// orderIdentifiers returns the domain names of a newOrder request,
+// which is a JWS object with the order as payload.
+func orderIdentifiers(req *http.Request) []string {
+	if req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil
+	}
+	defer body.Close()
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if json.NewDecoder(body).Decode(&jws) != nil {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil
+	}
+	var order struct {
+		Identifiers []struct {
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}
+	if json.Unmarshal(payload, &order) != nil {
+		return nil
+	}
+	domains := make([]string, 0, len(order.Identifiers))
+	for _, id := range order.Identifiers {
+		domains = append(domains, id.Value)
+	}
+	return domains
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alyx/x/autocert"
+
+	"github.com/jxskiss/ssl-cert-server/server"
+)
+
+/*
+Sub commands to migrate, backup and restore the storage.
+*/
+
+const (
+	migrateSubCommand = "migrate"
+	backupSubCommand  = "backup"
+	restoreSubCommand = "restore"
+
+	backupPasswordEnv = "SSL_CERT_SERVER_BACKUP_PASSWORD"
+	storageSpecUsage  = `"dir_cache:<dir>", "redis:<addr>", a redis URL with optional "key_prefix" parameter, or a configuration file`
+)
+
+var (
+	migrateFlagSet = flag.NewFlagSet(migrateSubCommand, flag.ExitOnError)
+	backupFlagSet  = flag.NewFlagSet(backupSubCommand, flag.ExitOnError)
+	restoreFlagSet = flag.NewFlagSet(restoreSubCommand, flag.ExitOnError)
+)
+
+var storageOptions = struct {
+	from         string
+	to           string
+	overwrite    bool
+	file         string
+	passwordFile string
+}{}
+
+func init() {
+	migrateFlagSet.StringVar(&storageOptions.from, "from", "", "source storage: "+storageSpecUsage)
+	migrateFlagSet.StringVar(&storageOptions.to, "to", "", "destination storage: "+storageSpecUsage)
+	migrateFlagSet.BoolVar(&storageOptions.overwrite, "overwrite", false, "overwrite entries exist in destination with different data")
+
+	backupFlagSet.StringVar(&storageOptions.from, "from", "./conf.yaml", "storage to backup: "+storageSpecUsage)
+	backupFlagSet.StringVar(&storageOptions.file, "out", "", "output archive file")
+	backupFlagSet.StringVar(&storageOptions.passwordFile, "password-file", "", "file containing the password to encrypt the archive (default env "+backupPasswordEnv+")")
+
+	restoreFlagSet.StringVar(&storageOptions.to, "to", "./conf.yaml", "storage to restore to: "+storageSpecUsage)
+	restoreFlagSet.StringVar(&storageOptions.file, "in", "", "input archive file")
+	restoreFlagSet.StringVar(&storageOptions.passwordFile, "password-file", "", "file containing the password to decrypt the archive (default env "+backupPasswordEnv+")")
+	restoreFlagSet.BoolVar(&storageOptions.overwrite, "overwrite", false, "overwrite entries exist in storage with different data")
+}
+
+func openStorage(cmd string, spec string) autocert.Cache {
+	if spec == "" {
+		log.Fatalf("[FATAL] %s: missing storage", cmd)
+	}
+	cache, err := server.OpenStorage(spec)
+	if err != nil {
+		log.Fatalf("[FATAL] %s: failed open storage %s: %v", cmd, spec, err)
+	}
+	return cache
+}
+
+func backupPassword(cmd string) string {
+	password := os.Getenv(backupPasswordEnv)
+	if file := storageOptions.passwordFile; file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatalf("[FATAL] %s: failed read password: %v", cmd, err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+	if password == "" {
+		log.Fatalf("[FATAL] %s: missing password, see -password-file", cmd)
+	}
+	return password
+}
+
+func cmdMigrate() {
+	migrateFlagSet.Parse(os.Args[2:])
+	opts := storageOptions
+	src := openStorage(migrateSubCommand, opts.from)
+	dst := openStorage(migrateSubCommand, opts.to)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	keys, err := server.MigrateStorage(ctx, src, dst, opts.overwrite)
+	for _, key := range keys {
+		fmt.Printf("copied %s\n", key)
+	}
+	if err != nil {
+		log.Fatalf("[FATAL] migrate: %v", err)
+	}
+	fmt.Printf("migrated %d entries from %s to %s\n", len(keys), opts.from, opts.to)
+}
+
+func cmdBackup() {
+	backupFlagSet.Parse(os.Args[2:])
+	opts := storageOptions
+	if opts.file == "" {
+		log.Fatalf("[FATAL] backup: missing -out")
+	}
+	password := backupPassword(backupSubCommand)
+	cache := openStorage(backupSubCommand, opts.from)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	out, err := os.OpenFile(opts.file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatalf("[FATAL] backup: %v", err)
+	}
+	keys, err := server.BackupStorage(ctx, cache, out, password)
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(opts.file)
+		log.Fatalf("[FATAL] backup: %v", err)
+	}
+	fmt.Printf("backed up %d entries to %s\n", len(keys), opts.file)
+}
+
+func cmdRestore() {
+	restoreFlagSet.Parse(os.Args[2:])
+	opts := storageOptions
+	if opts.file == "" {
+		log.Fatalf("[FATAL] restore: missing -in")
+	}
+	password := backupPassword(restoreSubCommand)
+	cache := openStorage(restoreSubCommand, opts.to)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	in, err := os.Open(opts.file)
+	if err != nil {
+		log.Fatalf("[FATAL] restore: %v", err)
+	}
+	defer in.Close()
+	keys, err := server.RestoreStorage(ctx, cache, in, password, opts.overwrite)
+	for _, key := range keys {
+		fmt.Printf("restored %s\n", key)
+	}
+	if err != nil {
+		log.Fatalf("[FATAL] restore: %v", err)
+	}
+	fmt.Printf("restored %d entries from %s\n", len(keys), opts.file)
+}